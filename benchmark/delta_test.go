@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/benchmark/models"
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+)
+
+func snapshot() models.Snapshot {
+	return models.Snapshot{
+		Tick: 1,
+		Players: []models.Player{
+			{ID: 1, Name: "one", Pos: models.Vec{X: 1, Y: 1}},
+			{ID: 2, Name: "two", Pos: models.Vec{X: 2, Y: 2}},
+		},
+		Focus:  &models.Player{ID: 1, Name: "one"},
+		Camera: models.Vec{X: 10, Y: 10},
+		Scores: []int32{5, 6},
+		Map:    "arena",
+		Info:   &models.Benchy{Name: "info"},
+		Enumy:  models.B,
+	}
+}
+
+// applyDelta serializes the delta from base to msg and applies it to base again.
+func applyDelta(t *testing.T, base, msg models.Snapshot) (models.Snapshot, int) {
+	t.Helper()
+	l := msg.DeltaLength(models.Context, &base)
+	buf := ngen.NewBuffer(make([]byte, l))
+	if err := msg.SerializeDelta(models.Context, &base, buf); err != nil {
+		t.Fatalf("SerializeDelta failed: %v", err)
+	}
+	if int(buf.Loc) != l {
+		t.Fatalf("DeltaLength %d doesn't match written %d", l, buf.Loc)
+	}
+	var out models.Snapshot
+	if err := out.ApplyDelta(models.Context, &base, ngen.NewBuffer(buf.Bytes())); err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+	if !reflect.DeepEqual(out, msg) {
+		t.Fatalf("Applied delta doesn't match:\n%#v\n%#v", out, msg)
+	}
+	return out, l
+}
+
+func TestDelta(t *testing.T) {
+	base := snapshot()
+	full := base.Length(models.Context)
+
+	// Against the zero value every set field is sent.
+	applyDelta(t, models.Snapshot{}, base)
+
+	next := snapshot()
+	next.Tick = 2
+	next.Players = []models.Player{next.Players[0], next.Players[1]}
+	next.Players[1].Pos.X = 3
+	_, l := applyDelta(t, base, next)
+	if l >= full/2 {
+		t.Fatalf("Expected delta of two changed fields to be small, got %d of %d bytes", l, full)
+	}
+	if base.Players[1].Pos.X != 2 {
+		t.Fatalf("Applying delta changed the baseline")
+	}
+
+	next = snapshot()
+	next.Players = append(next.Players, models.Player{ID: 3})
+	next.Focus = nil
+	next.Info = nil
+	next.Scores = next.Scores[:1]
+	applyDelta(t, base, next)
+
+	next = snapshot()
+	next.Players = []models.Player{}
+	next.Focus.Pos.Y = 4
+	next.Map = ""
+	applyDelta(t, base, next)
+
+	// Nothing changed but the always sent unversioned field.
+	_, l = applyDelta(t, base, snapshot())
+	if l != 1+1+base.Info.Length(models.Context)+1 {
+		t.Fatalf("Unexpected length of delta without changes: %d", l)
+	}
+}
+
+func TestDeltaBaselines(t *testing.T) {
+	a, b := net.Pipe()
+	ca := &client.Client{Conn: a, Outgoing: make(chan ngen.Message, 10), Incoming: make(chan ngen.Message, 10)}
+	cb := &client.Client{Conn: b, Outgoing: make(chan ngen.Message, 10), Incoming: make(chan ngen.Message, 10)}
+	client.ManageClient(models.Context, ca)
+	client.ManageClient(models.Context, cb)
+	defer ca.Close()
+	defer cb.Close()
+
+	snap := snapshot()
+	var d *ngservice.Delta
+	for tick := uint32(1); tick < 100; tick++ {
+		next := snapshot()
+		next.Tick = tick
+		d = ca.Delta(next)
+		ca.Outgoing <- d
+		select {
+		case msg := <-cb.Incoming:
+			if got := msg.(*models.Snapshot); !reflect.DeepEqual(*got, next) {
+				t.Fatalf("Received snapshot doesn't match:\n%#v\n%#v", *got, next)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for snapshot %d", tick)
+		}
+		if d.Base != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond) // Let the ack arrive.
+	}
+	if d.Base == 0 {
+		t.Fatalf("Remote never acknowledged a baseline")
+	}
+	if d.Length(models.Context) >= 12+snap.DeltaLength(models.Context, nil) {
+		t.Fatalf("Delta against baseline isn't smaller than a full one")
+	}
+}
+
+func TestDeltaMutation(t *testing.T) {
+	a, b := net.Pipe()
+	ca := &client.Client{Conn: a, Outgoing: make(chan ngen.Message, 10), Incoming: make(chan ngen.Message, 10)}
+	cb := &client.Client{Conn: b, Outgoing: make(chan ngen.Message, 10), Incoming: make(chan ngen.Message, 10)}
+	client.ManageClient(models.Context, ca)
+	client.ManageClient(models.Context, cb)
+	defer ca.Close()
+	defer cb.Close()
+
+	based := 0
+	for tick := uint32(1); tick < 100 && based < 3; tick++ {
+		next := snapshot()
+		next.Tick = tick
+		sent := snapshot()
+		sent.Tick = tick
+		d := ca.Delta(sent)
+		// Neither the sent nor the delivered message are baselines the application can change.
+		sent.Players[0].Name = "changed after Delta"
+		sent.Focus.Name = "changed after Delta"
+		ca.Outgoing <- d
+		select {
+		case msg := <-cb.Incoming:
+			got := msg.(*models.Snapshot)
+			if !reflect.DeepEqual(*got, next) {
+				t.Fatalf("Received snapshot %d doesn't match:\n%#v\n%#v", tick, *got, next)
+			}
+			got.Players[0].Name = "changed after delivery"
+			got.Scores[0] = 99
+			got.Focus.Pos.X = 99
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for snapshot %d", tick)
+		}
+		if d.Base != 0 {
+			based++
+		}
+		time.Sleep(time.Millisecond) // Let the ack arrive.
+	}
+	if based == 0 {
+		t.Fatalf("Remote never acknowledged a baseline")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	oldmodels "github.com/lologarithm/netgen/example/models"
+	"github.com/lologarithm/netgen/example/models/secret"
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+func TestInterfaceOtherPackage(t *testing.T) {
+	env := oldmodels.Envelope{Payload: &secret.Msg{Message: "psst", To: "you"}}
+	buf := ngen.NewBuffer(make([]byte, env.Length(nil)))
+	env.Serialize(nil, buf)
+	read := ngen.NewBuffer(buf.Buf)
+	got := oldmodels.DeserializeEnvelope(nil, read)
+	if msg, ok := got.Payload.(*secret.Msg); read.Err != nil || !ok || *msg != (secret.Msg{Message: "psst", To: "you"}) {
+		t.Fatalf("Expected the secret message back, got %#v, %v", got.Payload, read.Err)
+	}
+}
+
+func TestInterfaceUnknownType(t *testing.T) {
+	// An Envelope holding a message that doesn't implement Payload.
+	msg := oldmodels.Message{Message: "plain"}
+	buf := ngen.NewBuffer(make([]byte, 1+4+msg.Length(nil)))
+	buf.WriteBool(true)
+	buf.WriteUint32(uint32(msg.MsgType()))
+	msg.Serialize(nil, buf)
+	read := ngen.NewBuffer(buf.Buf)
+	got := oldmodels.DeserializeEnvelope(nil, read)
+	if read.Err != ngen.ErrUnknownType || got.Payload != nil {
+		t.Fatalf("Expected an unknown type error, got %#v, %v", got.Payload, read.Err)
+	}
+}
@@ -1,7 +1,14 @@
 package models
 
-import "github.com/lologarithm/netgen/lib/ngen"
+import (
+	"context"
 
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Benchy has its message type set to test the id directive.
+//
+//ngen:id 4242
 type Benchy struct {
 	Name     string
 	BirthDay int64
@@ -40,3 +47,44 @@ type MyInterface interface {
 	ngen.Message
 	Stuff()
 }
+
+// Echoer is a rpc service used to test the generated service code.
+type Echoer interface {
+	Echo(ctx context.Context, req *Benchy) (*Benchy, error)
+	Wait(ctx context.Context, req *FeaturesOne) (*FeaturesOne, error)
+}
+
+// Snapshot is versioned game state used to test delta and tagged serialization.
+//
+//ngen:tagged
+type Snapshot struct {
+	Tick    uint32   `ngen:"1"`
+	Players []Player `ngen:"2"`
+	Focus   *Player  `ngen:"3"`
+	Camera  Vec      `ngen:"4"`
+	Scores  []int32  `ngen:"5"`
+	Map     string   `ngen:"6"`
+	Info    *Benchy  `ngen:"7"`
+	Enumy   Enumy    `ngen:"8"`
+}
+
+//ngen:tagged
+type Player struct {
+	ID   uint32 `ngen:"1"`
+	Name string `ngen:"2"`
+	Pos  Vec    `ngen:"3"`
+}
+
+//ngen:tagged
+type Vec struct {
+	X float64 `ngen:"1"`
+	Y float64 `ngen:"2"`
+}
+
+// Profile is tagged with a required field and a default.
+//
+//ngen:tagged
+type Profile struct {
+	Name   string  `ngen:"1,required"`
+	Volume float32 `ngen:"2,default=0.8"`
+}
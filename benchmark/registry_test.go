@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lologarithm/netgen/benchmark/models"
+	oldmodels "github.com/lologarithm/netgen/example/models"
+	"github.com/lologarithm/netgen/example/models/notes"
+	"github.com/lologarithm/netgen/example/models/secret"
+	"github.com/lologarithm/netgen/example/newmodels"
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+func TestRegistryRead(t *testing.T) {
+	r, err := ngen.NewRegistry(models.Context, oldmodels.Context, secret.Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := r.Context()
+	if _, ok := ctx.FieldVersions[models.SnapshotMsgType]; !ok {
+		t.Fatalf("Expected the field versions of all packages")
+	}
+
+	msgs := []ngen.Message{
+		&models.Benchy{Name: "bench"},
+		&oldmodels.VersionedMessage{Message: "old"},
+		&secret.Msg{Message: "secret"},
+	}
+	for _, msg := range msgs {
+		buf := ngen.NewBuffer(make([]byte, msg.Length(ctx)))
+		msg.Serialize(ctx, buf)
+		got := ctx.Read(ctx, msg.MsgType(), ngen.NewBuffer(buf.Buf))
+		if got == nil || got.MsgType() != msg.MsgType() {
+			t.Fatalf("Expected to read %T, got %#v", msg, got)
+		}
+	}
+	if got := ctx.Read(ctx, 12345, ngen.NewBuffer(nil)); got != nil {
+		t.Fatalf("Expected nothing for an unknown message type, got %#v", got)
+	}
+
+	// Remote Contexts read with the registry too.
+	remote := handshake(ctx, oldmodels.Context)
+	buf := serialize(&secret.Msg{Message: "secret"}, &models.Benchy{})
+	if got, ok := remote.Read(remote, secret.MsgMsgType, buf).(*secret.Msg); !ok || got.Message != "secret" {
+		t.Fatalf("Expected the remote Context to read other packages, got %#v", got)
+	}
+}
+
+func TestRegistryConflict(t *testing.T) {
+	r, err := ngen.NewRegistry(oldmodels.Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Add(newmodels.Context)
+	if ce, ok := err.(*ngen.ConflictError); !ok || ce.Type != newmodels.MessageMsgType && ce.Type != newmodels.VersionedMessageMsgType {
+		t.Fatalf("Expected a conflict for the messages in both packages, got %v", err)
+	}
+	if fv := r.Context().FieldVersions[oldmodels.VersionedMessageMsgType]; string(fv) != string(oldmodels.Context.FieldVersions[oldmodels.VersionedMessageMsgType]) {
+		t.Fatalf("Expected nothing of the conflicting package to be registered, got field versions %v", fv)
+	}
+}
+
+func TestRegistryInterface(t *testing.T) {
+	// notes imports models, so models.ReadPayload only knows Note through the registry.
+	env := oldmodels.Envelope{Payload: &notes.Note{Text: "hi", Re: &oldmodels.Message{Message: "re"}}}
+	buf := ngen.NewBuffer(make([]byte, env.Length(nil)))
+	env.Serialize(nil, buf)
+
+	read := ngen.NewBuffer(buf.Buf)
+	oldmodels.DeserializeEnvelope(oldmodels.Context, read)
+	if read.Err != ngen.ErrUnknownType {
+		t.Fatalf("Expected an unknown type error without the registry, got %v", read.Err)
+	}
+
+	r, err := ngen.NewRegistry(oldmodels.Context, secret.Context, notes.Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read = ngen.NewBuffer(buf.Buf)
+	got := oldmodels.DeserializeEnvelope(r.Context(), read)
+	if note, ok := got.Payload.(*notes.Note); read.Err != nil || !ok || note.Text != "hi" || note.Re == nil || note.Re.Message != "re" {
+		t.Fatalf("Expected the note back, got %#v, %v", got.Payload, read.Err)
+	}
+}
+
+func TestRegistryEmpty(t *testing.T) {
+	if _, err := ngen.NewRegistry(&ngen.Context{Read: oldmodels.Read}); err != ngen.ErrNoMessages {
+		t.Fatalf("Expected ErrNoMessages for a Context without message types, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lologarithm/netgen/benchmark/models"
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+)
+
+func TestRouter(t *testing.T) {
+	var got []string
+	r := models.NewRouter()
+	r.Use(func(next client.Handler) client.Handler {
+		return func(c *client.Client, msg ngen.Message) {
+			got = append(got, "mw")
+			next(c, msg)
+		}
+	})
+	r.OnBenchy(func(c *client.Client, msg *models.Benchy) {
+		got = append(got, "benchy "+msg.Name)
+	})
+	r.Unhandled(func(c *client.Client, msg ngen.Message) {
+		got = append(got, "unhandled")
+	})
+
+	r.Dispatch(nil, &models.Benchy{Name: "pointer"})
+	r.Dispatch(nil, models.Benchy{Name: "value"})
+	r.Dispatch(nil, &models.Vec{})
+	r.Dispatch(nil, nil)
+
+	want := []string{"mw", "benchy pointer", "mw", "benchy value", "mw", "unhandled"}
+	if len(got) != len(want) {
+		t.Fatalf("handled %v, expected %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("handled %v, expected %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/benchmark/models"
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+	"github.com/lologarithm/netgen/lib/ngservice/rpc"
+)
+
+type echoer struct{}
+
+func (echoer) Echo(ctx context.Context, req *models.Benchy) (*models.Benchy, error) {
+	if req.Name == "" {
+		return nil, errors.New("missing name")
+	}
+	return req, nil
+}
+
+func (echoer) Wait(ctx context.Context, req *models.FeaturesOne) (*models.FeaturesOne, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func rpcPipe() (*rpc.Conn, *rpc.Conn) {
+	a, b := net.Pipe()
+	conns := []*rpc.Conn{}
+	for _, conn := range []net.Conn{a, b} {
+		c := &client.Client{
+			Conn:     conn,
+			Outgoing: make(chan ngen.Message, 10),
+			Incoming: make(chan ngen.Message, 10),
+		}
+		client.ManageClient(models.Context, c)
+		rc := rpc.NewConn(c)
+		go func() {
+			for msg := range c.Incoming {
+				rc.Dispatch(msg)
+			}
+		}()
+		conns = append(conns, rc)
+	}
+	return conns[0], conns[1]
+}
+
+func TestRPC(t *testing.T) {
+	callerConn, serverConn := rpcPipe()
+	models.RegisterEchoer(serverConn, echoer{})
+	caller := models.NewEchoerClient(callerConn)
+
+	resp, err := caller.Echo(context.Background(), &models.Benchy{Name: "hi", Money: 1.5})
+	if err != nil {
+		t.Fatalf("Echo failed: %s", err)
+	}
+	if resp.Name != "hi" || resp.Money != 1.5 {
+		t.Fatalf("Unexpected echo response: %#v", resp)
+	}
+
+	_, err = caller.Echo(context.Background(), &models.Benchy{})
+	if rerr, ok := err.(*rpc.RemoteError); !ok || rerr.Message != "missing name" {
+		t.Fatalf("Expected remote error, got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = caller.Wait(ctx, &models.FeaturesOne{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got: %v", err)
+	}
+}
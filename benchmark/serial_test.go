@@ -7,6 +7,7 @@ import (
 
 	"github.com/lologarithm/netgen/benchmark/models"
 	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
 )
 
 func TestFeaturesOne(t *testing.T) {
@@ -55,6 +56,19 @@ func TestFeatures(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestMessageIDDirective(t *testing.T) {
+	if models.BenchyMsgType != 4242 || (models.Benchy{}).MsgType() != 4242 {
+		t.Fatalf("expected the id from the directive, got %d", models.BenchyMsgType)
+	}
+	b := &models.Benchy{Name: "b"}
+	buf := ngen.NewBuffer(make([]byte, b.Length(nil)))
+	b.Serialize(nil, buf)
+	if got, ok := models.Read(nil, 4242, ngen.NewBuffer(buf.Bytes())).(*models.Benchy); !ok || got.Name != "b" {
+		t.Fatalf("expected to read a Benchy with id 4242, got %#v", got)
+	}
+}
+
 func generateNetGen() []*models.Benchy {
 	a := make([]*models.Benchy, 0, 1000)
 	for i := 0; i < 1000; i++ {
@@ -108,3 +122,39 @@ func BenchmarkNetGenUnmarshal(b *testing.B) {
 		}
 	}
 }
+
+func TestWriteMessageToAllocs(t *testing.T) {
+	msgs := []ngen.Message{&models.FeaturesOne{V: 2}, generateNetGen()[0]}
+	for _, msg := range msgs {
+		allocs := testing.AllocsPerRun(100, func() {
+			buf := ngen.GetBuffer(0)
+			if err := ngservice.WriteMessageTo(buf, nil, msg); err != nil {
+				t.Fatalf("Failed to write message: %s", err)
+			}
+			ngen.PutBuffer(buf)
+		})
+		if allocs != 0 {
+			t.Fatalf("Expected WriteMessageTo(%T) to not allocate, got %v allocs", msg, allocs)
+		}
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	data := generateNetGen()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ngservice.WriteMessage(nil, data[i%len(data)])
+	}
+}
+
+func BenchmarkWriteMessageTo(b *testing.B) {
+	data := generateNetGen()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := ngen.GetBuffer(0)
+		ngservice.WriteMessageTo(buf, nil, data[i%len(data)])
+		ngen.PutBuffer(buf)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/lologarithm/netgen/benchmark/models"
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+func TestTagged(t *testing.T) {
+	snap := snapshot()
+	l := snap.TaggedLength()
+	buf := ngen.NewBuffer(make([]byte, l))
+	if err := snap.SerializeTagged(buf); err != nil {
+		t.Fatalf("SerializeTagged failed: %v", err)
+	}
+	if int(buf.Loc) != l {
+		t.Fatalf("TaggedLength %d doesn't match written %d", l, buf.Loc)
+	}
+
+	read := ngen.NewBuffer(buf.Buf)
+	got := models.ReadTagged(models.SnapshotMsgType, read)
+	if read.Err != nil || !reflect.DeepEqual(got, &snap) {
+		t.Fatalf("Tagged snapshot read wrong:\n%#v\n%#v\n%v", got, &snap, read.Err)
+	}
+
+	// A truncated message fails instead of reading past its end.
+	read = ngen.NewBuffer(buf.Buf[:l-1])
+	models.DeserializeTaggedSnapshot(read)
+	if read.Err != io.EOF {
+		t.Fatalf("Expected EOF reading truncated message, got %v", read.Err)
+	}
+}
+
+// TestTaggedUnknownFields reads a Snapshot written by a version with a field it doesn't know
+// and a field whose type changed.
+func TestTaggedUnknownFields(t *testing.T) {
+	buf := ngen.NewBuffer(make([]byte, 128))
+	start := buf.BeginLength()
+	buf.WriteTag(1, ngen.WireFixed32)
+	buf.WriteUint32(5)
+	buf.WriteTag(99, ngen.WireBytes)
+	buf.WriteString("from the future")
+	buf.WriteTag(8, ngen.WireFixed64) // Enumy is 8 bytes now.
+	buf.WriteUint64(2)
+	buf.WriteTag(4, ngen.WireBytes)
+	camera := buf.BeginLength()
+	models.Vec{X: 1, Y: 2}.SerializeTagged(buf)
+	buf.WriteUint32(0) // Appended by a newer Vec.
+	buf.EndLength(camera)
+	buf.WriteTag(6, ngen.WireBytes)
+	buf.WriteString("arena")
+	buf.EndLength(start)
+	buf.WriteUint32(1234)
+
+	read := ngen.NewBuffer(buf.Bytes())
+	got := models.DeserializeTaggedSnapshot(read)
+	want := models.Snapshot{Tick: 5, Camera: models.Vec{X: 1, Y: 2}, Map: "arena"}
+	if read.Err != nil || !reflect.DeepEqual(got, want) || read.ReadUint32() != 1234 {
+		t.Fatalf("Unknown fields not skipped:\n%#v\n%#v\n%v", got, want, read.Err)
+	}
+}
+
+// TestTaggedHugeCount reads array counts that the data can't hold without allocating them.
+func TestTaggedHugeCount(t *testing.T) {
+	for _, fld := range []byte{2, 5} { // Players and Scores
+		buf := ngen.NewBuffer(make([]byte, 64))
+		start := buf.BeginLength()
+		buf.WriteTag(fld, ngen.WireBytes)
+		array := buf.BeginLength()
+		buf.WriteUint32(1 << 30)
+		buf.EndLength(array)
+		buf.EndLength(start)
+
+		read := ngen.NewBuffer(buf.Bytes())
+		allocs := testing.AllocsPerRun(1, func() {
+			read.Loc, read.Err = 0, nil
+			models.DeserializeTaggedSnapshot(read)
+		})
+		if read.Err != io.EOF || allocs > 0 {
+			t.Fatalf("Expected EOF without allocating for field %d, got %v after %v allocations", fld, read.Err, allocs)
+		}
+	}
+}
+
+// TestTaggedDefaults reads tagged messages without some of their fields.
+func TestTaggedDefaults(t *testing.T) {
+	buf := ngen.NewBuffer(make([]byte, 64))
+	start := buf.BeginLength()
+	buf.WriteTag(1, ngen.WireBytes)
+	buf.WriteString("ada")
+	buf.EndLength(start)
+	read := ngen.NewBuffer(buf.Bytes())
+	if p := models.DeserializeTaggedProfile(read); read.Err != nil || p.Name != "ada" || p.Volume != 0.8 {
+		t.Fatalf("Expected the default volume, got %+v, %v", p, read.Err)
+	}
+
+	// A sent zero value is kept.
+	p := models.Profile{Name: "ada"}
+	buf = ngen.NewBuffer(make([]byte, p.TaggedLength()))
+	p.SerializeTagged(buf)
+	read = ngen.NewBuffer(buf.Buf)
+	if p := models.DeserializeTaggedProfile(read); read.Err != nil || p.Volume != 0 {
+		t.Fatalf("Expected the sent volume, got %+v, %v", p, read.Err)
+	}
+
+	buf = ngen.NewBuffer(make([]byte, 64))
+	start = buf.BeginLength()
+	buf.WriteTag(2, ngen.WireFixed32)
+	buf.WriteFloat32(1)
+	buf.EndLength(start)
+	read = ngen.NewBuffer(buf.Bytes())
+	models.DeserializeTaggedProfile(read)
+	if re, ok := read.Err.(*ngen.RequiredError); !ok || re.Type != models.ProfileMsgType || re.Order != 1 {
+		t.Fatalf("Expected missing required Name, got %v", read.Err)
+	}
+}
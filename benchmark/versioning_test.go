@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lologarithm/netgen/benchmark/models"
+	oldmodels "github.com/lologarithm/netgen/example/models"
+	"github.com/lologarithm/netgen/example/newmodels"
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// handshake returns the remote's Context as the local side reads it in the handshake.
+func handshake(local, remote *ngen.Context) *ngen.Context {
+	buf := ngen.NewBuffer(make([]byte, remote.Length(nil)))
+	remote.Serialize(nil, buf)
+	return ngen.DeserializeContext(local, ngen.NewBuffer(buf.Buf))
+}
+
+// serialize writes both messages into one buffer, so a field read wrong shows up in the second.
+func serialize(a, b ngen.Message) *ngen.Buffer {
+	buf := ngen.NewBuffer(make([]byte, a.Length(nil)+b.Length(nil)))
+	a.Serialize(nil, buf)
+	b.Serialize(nil, buf)
+	return ngen.NewBuffer(buf.Buf)
+}
+
+func TestVersionsSkipUnknownFields(t *testing.T) {
+	// Old to new, UselessData is skipped and NewHotness gets its default.
+	remote := handshake(newmodels.Context, oldmodels.Context)
+	buf := serialize(
+		oldmodels.VersionedMessage{Message: "hi", From: "old", UselessData: 42},
+		oldmodels.Message{Message: "after"},
+	)
+	vm := newmodels.DeserializeVersionedMessage(remote, buf)
+	next := newmodels.DeserializeMessage(remote, buf)
+	if buf.Err != nil || vm.Message != "hi" || vm.From != "old" || vm.NewHotness != 1.5 || next.Message != "after" {
+		t.Fatalf("Old message read wrong: %+v, %+v, %v", vm, next, buf.Err)
+	}
+	if vm.HasNewHotness(remote) || !vm.HasFrom(remote) {
+		t.Fatalf("Expected only NewHotness to be missing")
+	}
+
+	// New to old, NewHotness is skipped.
+	remote = handshake(oldmodels.Context, newmodels.Context)
+	buf = serialize(
+		newmodels.VersionedMessage{Message: "hi", From: "new", NewHotness: 1.5},
+		newmodels.Message{Message: "after"},
+	)
+	old := oldmodels.DeserializeVersionedMessage(remote, buf)
+	oldNext := oldmodels.DeserializeMessage(remote, buf)
+	if buf.Err != nil || old.Message != "hi" || old.From != "new" || old.UselessData != 0 || oldNext.Message != "after" {
+		t.Fatalf("New message read wrong: %+v, %+v, %v", old, oldNext, buf.Err)
+	}
+}
+
+func TestVersionsLegacySender(t *testing.T) {
+	// A sender from before wire types writes the fields it shares with the reader, in the reader's order.
+	// That is what generated serializers do for a Context without wire types.
+	legacyNew := *newmodels.Context
+	legacyNew.WireTypes = nil
+	sent := ngen.NewBuffer(nil)
+	for _, msg := range []ngen.Message{oldmodels.VersionedMessage{Message: "hi", From: "old", UselessData: 42}, oldmodels.Message{Message: "after"}} {
+		b := ngen.NewBuffer(make([]byte, msg.Length(&legacyNew)))
+		if err := msg.Serialize(&legacyNew, b); err != nil {
+			t.Fatalf("Serialize failed: %v", err)
+		}
+		sent.Buf = append(sent.Buf, b.Buf...)
+	}
+
+	// The reader gets the sender's Context without wire types, UselessData is in it but wasn't sent.
+	legacyOld := *oldmodels.Context
+	legacyOld.WireTypes = nil
+	remote := handshake(newmodels.Context, &legacyOld)
+	vm := newmodels.DeserializeVersionedMessage(remote, sent)
+	next := newmodels.DeserializeMessage(remote, sent)
+	if sent.Err != nil || vm != (newmodels.VersionedMessage{Message: "hi", From: "old", NewHotness: 1.5}) || next.Message != "after" {
+		t.Fatalf("Legacy message read wrong: %+v, %+v, %v", vm, next, sent.Err)
+	}
+}
+
+func TestVersionsLegacyRemote(t *testing.T) {
+	// A remote from before wire types reads the fields it knows in the order of its field versions.
+	legacy := *oldmodels.Context
+	legacy.WireTypes = nil
+	legacy.FieldVersions = map[ngen.MessageType][]byte{oldmodels.VersionedMessageMsgType: {3, 2, 1}}
+	remote := handshake(newmodels.Context, &legacy)
+	msg := newmodels.VersionedMessage{Message: "hi", From: "new", NewHotness: 2}
+	buf := ngen.NewBuffer(make([]byte, msg.Length(remote)))
+	if err := msg.Serialize(remote, buf); err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+	read := ngen.NewBuffer(buf.Buf)
+	if from, text := read.ReadString(), read.ReadString(); read.Err != nil || from != "new" || text != "hi" || int(read.Loc) != len(read.Buf) {
+		t.Fatalf("Expected From and Message only, got %q %q in %d bytes, %v", from, text, len(read.Buf), read.Err)
+	}
+
+	// Remotes with wire types get the local order.
+	remote = handshake(newmodels.Context, oldmodels.Context)
+	buf = ngen.NewBuffer(make([]byte, msg.Length(remote)))
+	msg.Serialize(remote, buf)
+	if vm := newmodels.DeserializeVersionedMessage(handshake(newmodels.Context, newmodels.Context), ngen.NewBuffer(buf.Buf)); vm != msg {
+		t.Fatalf("Expected %+v, got %+v", msg, vm)
+	}
+}
+
+func TestVersionsDefaults(t *testing.T) {
+	// A sent zero value is kept, the default is only for missing fields.
+	remote := handshake(newmodels.Context, newmodels.Context)
+	buf := serialize(newmodels.VersionedMessage{Message: "hi"}, newmodels.Message{})
+	if vm := newmodels.DeserializeVersionedMessage(remote, buf); vm.NewHotness != 0 || !vm.HasNewHotness(remote) {
+		t.Fatalf("Expected the sent zero value, got %+v", vm)
+	}
+
+	// The first delta from an old remote has no baseline to take NewHotness from.
+	remote = handshake(newmodels.Context, oldmodels.Context)
+	msg := oldmodels.VersionedMessage{Message: "hi"}
+	buf = ngen.NewBuffer(make([]byte, msg.DeltaLength(nil, nil)))
+	msg.SerializeDelta(nil, nil, buf)
+	var applied newmodels.VersionedMessage
+	if err := applied.ApplyDelta(remote, nil, ngen.NewBuffer(buf.Buf)); err != nil || applied.NewHotness != 1.5 {
+		t.Fatalf("Expected default in delta without baseline, got %+v, %v", applied, err)
+	}
+}
+
+func TestVersionsRequired(t *testing.T) {
+	if err := newmodels.Context.CheckRequired(handshake(newmodels.Context, oldmodels.Context)); err != nil {
+		t.Fatalf("Old remote has the required field: %v", err)
+	}
+	remote := handshake(newmodels.Context, oldmodels.Context)
+	remote.FieldVersions[newmodels.VersionedMessageMsgType] = []byte{2, 3}
+	err := newmodels.Context.CheckRequired(remote)
+	if re, ok := err.(*ngen.RequiredError); !ok || re.Type != newmodels.VersionedMessageMsgType || re.Order != 1 {
+		t.Fatalf("Expected missing required field 1, got %v", err)
+	}
+}
+
+func TestVersionsSkipUnknownDeltaFields(t *testing.T) {
+	remote := handshake(newmodels.Context, oldmodels.Context)
+	base := oldmodels.VersionedMessage{Message: "hi", From: "old"}
+	msg := base
+	msg.From, msg.UselessData = "changed", 7
+
+	buf := ngen.NewBuffer(make([]byte, msg.DeltaLength(nil, &base)+4))
+	msg.SerializeDelta(nil, &base, buf)
+	buf.WriteUint32(1234)
+	buf = ngen.NewBuffer(buf.Buf)
+
+	var applied newmodels.VersionedMessage
+	err := applied.ApplyDelta(remote, &newmodels.VersionedMessage{Message: "hi", From: "old"}, buf)
+	if err != nil || applied.Message != "hi" || applied.From != "changed" || buf.ReadUint32() != 1234 {
+		t.Fatalf("Delta applied wrong: %+v, %v", applied, err)
+	}
+}
+
+func TestVersionsSkipNestedMessages(t *testing.T) {
+	// A remote whose Snapshot has an extra []Player field at the end.
+	remote := handshake(models.Context, models.Context)
+	extra := byte(99)
+	remote.FieldVersions[models.SnapshotMsgType] = append(remote.FieldVersions[models.SnapshotMsgType], extra)
+	player := []byte{ngen.WireArray, ngen.WireMessage, 0, 0, 0, 0}
+	ngen.PutUint32(player[2:], models.PlayerMsgType)
+	remote.WireTypes[models.SnapshotMsgType] = append(remote.WireTypes[models.SnapshotMsgType], player)
+
+	snap := snapshot()
+	players := []models.Player{{ID: 3, Name: "three"}, {ID: 4, Name: "four"}}
+	buf := ngen.NewBuffer(make([]byte, snap.Length(nil)+4+players[0].Length(nil)+players[1].Length(nil)+4))
+	snap.Serialize(nil, buf)
+	buf.WriteUint32(uint32(len(players)))
+	for _, p := range players {
+		p.Serialize(nil, buf)
+	}
+	buf.WriteUint32(1234)
+	buf = ngen.NewBuffer(buf.Buf)
+
+	got := models.DeserializeSnapshot(remote, buf)
+	if buf.Err != nil || got.Map != snap.Map || buf.ReadUint32() != 1234 {
+		t.Fatalf("Nested unknown field not skipped: %+v, %v", got, buf.Err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lologarithm/netgen/generate"
+)
+
+// compat runs `netgen compat`, which reports the changes between two versions of a package that
+// break communication between them. Returns the exit code, 1 if anything breaks.
+func compat(args []string) int {
+	flags := flag.NewFlagSet("compat", flag.ExitOnError)
+	oldDir := flags.String("old", "", "Directory or schema file of the old version of the package")
+	newDir := flags.String("new", "", "Directory of the new version of the package")
+	flags.BoolVar(namespace, "namespace", false, flag.CommandLine.Lookup("namespace").Usage)
+	flags.Parse(args)
+	if *oldDir == "" || *newDir == "" {
+		fmt.Fprintln(os.Stderr, "usage: netgen compat [--namespace] --old <dir|schema> --new <dir>")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	old, new := rootPkg(*oldDir), rootPkg(*newDir)
+	breaking := false
+	for _, c := range generate.Compat(old, new) {
+		fmt.Println(c)
+		breaking = breaking || c.Breaking
+	}
+	if breaking {
+		return 1
+	}
+	return 0
+}
+
+// rootPkg parses dir, or reads it if it is a schema file, and returns the package in it.
+func rootPkg(dir string) *generate.ParsedPkg {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		root, _ := readSchema(dir)
+		return root
+	}
+	bpkg, pkgs := parse(dir)
+	return pkgs[bpkg.Name]
+}
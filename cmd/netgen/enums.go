@@ -0,0 +1,48 @@
+package main
+
+import (
+	"go/constant"
+	"go/types"
+	"sort"
+
+	"github.com/lologarithm/netgen/generate"
+)
+
+// findEnumValues sets the underlying type and the exported constants of every enum of the parsed packages,
+// the constants in the order they are declared.
+func findEnumValues(order []string, pkgs map[string]*generate.ParsedPkg, typed map[string]*types.Package) {
+	for _, name := range order {
+		pkg, tp := pkgs[name], typed[name]
+		if tp == nil {
+			continue
+		}
+		for i, enum := range pkg.Enums {
+			obj, ok := tp.Scope().Lookup(enum.Name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			basic, ok := obj.Type().Underlying().(*types.Basic)
+			if !ok || basic.Info()&types.IsInteger == 0 {
+				logger.Warn("enum isn't an integer type", "enum", name+"."+enum.Name, "type", obj.Type().Underlying())
+				continue
+			}
+			enum.Type = basic.Name()
+
+			var consts []*types.Const
+			for _, n := range tp.Scope().Names() {
+				c, ok := tp.Scope().Lookup(n).(*types.Const)
+				if ok && c.Exported() && types.Identical(c.Type(), obj.Type()) {
+					consts = append(consts, c)
+				}
+			}
+			sort.Slice(consts, func(i, j int) bool { return consts[i].Pos() < consts[j].Pos() })
+			enum.Values = nil
+			for _, c := range consts {
+				v, _ := constant.Int64Val(constant.ToInt(c.Val()))
+				enum.Values = append(enum.Values, generate.EnumValue{Name: c.Name(), Value: int(v)})
+			}
+			pkg.Enums[i] = enum
+			pkg.EnumMap[enum.Name] = enum
+		}
+	}
+}
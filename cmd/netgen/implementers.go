@@ -0,0 +1,128 @@
+package main
+
+import (
+	"go/importer"
+	"go/token"
+	"go/types"
+	"log"
+
+	"github.com/lologarithm/netgen/generate"
+)
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// typeCheck type checks the parsed packages, in order so imports come first, and returns them by package name, and ngen by its import path.
+func typeCheck(fset *token.FileSet, order []string, pkgs map[string]*generate.ParsedPkg) map[string]*types.Package {
+	checked := map[string]*types.Package{} // by import path
+	typed := map[string]*types.Package{}   // by package name
+	source := importer.ForCompiler(fset, "source", nil)
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if tp, ok := checked[path]; ok {
+				return tp, nil
+			}
+			return source.Import(path)
+		}),
+		// The generated code isn't checked, so uses of it are errors.
+		Error: func(err error) { logger.Debug("type error", "err", err) },
+	}
+	ngenPkg, err := conf.Importer.Import(ngenPath)
+	if err != nil {
+		log.Fatalf("Failed to import %s: %s", ngenPath, err)
+	}
+	typed[ngenPath] = ngenPkg
+
+	for _, name := range order {
+		pkg := pkgs[name]
+		tp, _ := conf.Check(pkg.Pkg.ImportPath, fset, pkg.Files, nil)
+		checked[pkg.Pkg.ImportPath] = tp
+		typed[name] = tp
+	}
+	return typed
+}
+
+// findImplementers marks fields whose type is an interface and finds the messages of all packages implementing it,
+// see generate.ParsedPkg.Interfaces.
+func findImplementers(order []string, pkgs map[string]*generate.ParsedPkg, typed map[string]*types.Package) {
+	message := typed[ngenPath].Scope().Lookup("Message").Type().Underlying().(*types.Interface)
+
+	for _, name := range order {
+		for _, msg := range pkgs[name].Messages {
+			for i, f := range msg.Fields {
+				owner := name
+				if f.RemotePackage != "" {
+					owner = f.RemotePackage
+				}
+				tp, ok := typed[owner]
+				if !ok {
+					continue
+				}
+				obj, ok := tp.Scope().Lookup(f.Type).(*types.TypeName)
+				if !ok {
+					continue
+				}
+				iface, ok := obj.Type().Underlying().(*types.Interface)
+				if !ok {
+					continue
+				}
+				msg.Fields[i].Interface = true
+				if _, ok := pkgs[owner].Interfaces[f.Type]; !ok {
+					pkgs[owner].Interfaces[f.Type] = implementers(f.Type, iface, message, tp, order, pkgs, typed)
+				}
+			}
+		}
+	}
+}
+
+// implementers returns the messages of pkgs that implement iface, named name and declared in owner.
+// Messages of packages importing owner can't be read by the reader generated into it, they are only read
+// through an ngen.Registry and a warning is logged for each of them.
+func implementers(name string, iface, message *types.Interface, owner *types.Package, order []string, pkgs map[string]*generate.ParsedPkg, typed map[string]*types.Package) []generate.Message {
+	// Messages get the methods of ngen.Message from the generated code.
+	var methods []*types.Func
+	for i := 0; i < iface.NumMethods(); i++ {
+		m := iface.Method(i)
+		if obj, _, _ := types.LookupFieldOrMethod(message, false, nil, m.Name()); obj != nil && types.Identical(obj.Type(), m.Type()) {
+			continue
+		}
+		methods = append(methods, m)
+	}
+	rest := types.NewInterfaceType(methods, nil).Complete()
+
+	var impls []generate.Message
+	for _, pkgName := range order {
+		tp := typed[pkgName]
+		importsOwner := tp != owner && imports(tp, owner.Path(), map[string]bool{})
+		for _, msg := range pkgs[pkgName].Messages {
+			obj, ok := tp.Scope().Lookup(msg.Name).(*types.TypeName)
+			if !ok || !types.Implements(types.NewPointer(obj.Type()), rest) {
+				continue
+			}
+			if importsOwner {
+				logger.Warn("implementer is in a package importing the interface, it is only read through an ngen.Registry of both packages",
+					"msg", pkgName+"."+msg.Name, "interface", owner.Name()+"."+name)
+				continue
+			}
+			impls = append(impls, msg)
+		}
+	}
+	return impls
+}
+
+// imports reports whether tp imports the package at path, directly or not.
+func imports(tp *types.Package, path string, seen map[string]bool) bool {
+	for _, imp := range tp.Imports() {
+		if imp.Path() == path {
+			return true
+		}
+		if !seen[imp.Path()] {
+			seen[imp.Path()] = true
+			if imports(imp, path, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
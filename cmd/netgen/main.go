@@ -14,22 +14,33 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
-	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/lologarithm/netgen/generate"
+	"github.com/lologarithm/netgen/lib/ngservice"
 	"golang.org/x/tools/go/buildutil"
 )
 
-var genlist = flag.String("gen", "go", "list of languages to generate bindings for, separated by commas")
+var genlist = flag.String("gen", "go", "list of languages to generate bindings for, separated by commas. 'schema' writes "+generate.SchemaFile+", 'types' the Go types of a --schema")
 var dir = flag.String("dir", "", "Input directory to transpile")
+var schema = flag.String("schema", "", "Input schema file to generate from instead of a directory, only its first package is generated")
 var outdir = flag.String("out", "", "Output directory for deserializer package")
 var version = flag.Bool("version", false, "Prints the version")
+var verbose = flag.Bool("v", false, "Prints debug output")
+var namespace = flag.Bool("namespace", false, "Message ids include the package path, so messages of the same name in different packages don't collide")
+
+var logger ngservice.Logger = ngservice.NopLogger{}
+
+// ngenPath is the import path of the runtime package of the generated code.
+const ngenPath = "github.com/lologarithm/netgen/lib/ngen"
 
 var verNum = "1.0.0"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compat" {
+		os.Exit(compat(os.Args[2:]))
+	}
 	flag.Parse()
 
 	if *version {
@@ -37,10 +48,102 @@ func main() {
 		os.Exit(0)
 	}
 
+	level := ngservice.LevelInfo
+	if *verbose {
+		level = ngservice.LevelDebug
+	}
+	logger = ngservice.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), level)
+
+	wd, _ := os.Getwd()
+	var pkgs map[string]*generate.ParsedPkg
+	if *schema != "" {
+		if *outdir == "" {
+			log.Fatalf("--out is required to generate from a schema")
+		}
+		root, _ := readSchema(*schema)
+		pkgs = map[string]*generate.ParsedPkg{root.Name: root}
+	} else {
+		_, pkgs = parse(*dir)
+	}
+
+	write(pkgs, *genlist, wd)
+}
+
+// write generates each of the comma separated langs for pkgs, into --out or the directory of each package.
+func write(pkgs map[string]*generate.ParsedPkg, langs string, wd string) {
+	for _, l := range strings.Split(langs, ",") {
+		for name, pkg := range pkgs {
+			if pkg.Pkg == nil {
+				continue
+			}
+			pkgdir := *outdir
+			if pkgdir == "" {
+				pkgdir = pkg.Pkg.Dir
+			} else if pkgdir[0] == '.' {
+				pkgdir = filepath.Join(wd, pkgdir)
+			}
+			logger.Info("writing package", "name", name, "dir", pkgdir)
+			switch l {
+			case "go":
+				buf := &bytes.Buffer{}
+				buf.WriteString(generate.GoLibHeader(pkg))
+
+				for _, msg := range pkg.Messages {
+					logger.Debug("writing deserializers", "msg", pkg.Name+"."+msg.Name)
+					buf.WriteString(generate.GoDeserializers(msg))
+				}
+
+				// log.Printf("Contents: %s", string(buf.Bytes()))
+				ioutil.WriteFile(filepath.Join(pkgdir, "ngenDeserial.go"), buf.Bytes(), 0644)
+				buf.Reset()
+				buf.WriteString(fmt.Sprintf("%s\npackage %s\n\nimport \"github.com/lologarithm/netgen/lib/ngen\"", generate.HeaderComment(), pkg.Name))
+				for _, msg := range pkg.Messages {
+					buf.WriteString(generate.GoSerializers(msg))
+				}
+				ioutil.WriteFile(filepath.Join(pkgdir, "ngenSerial.go"), buf.Bytes(), 0644)
+				ioutil.WriteFile(filepath.Join(pkgdir, "ngenRouter.go"), []byte(generate.GoRouter(pkg)), 0644)
+				if generate.HasVersioned(pkg) {
+					ioutil.WriteFile(filepath.Join(pkgdir, "ngenDelta.go"), []byte(generate.GoDelta(pkg)), 0644)
+				}
+				if generate.HasTagged(pkg) {
+					ioutil.WriteFile(filepath.Join(pkgdir, "ngenTagged.go"), []byte(generate.GoTagged(pkg)), 0644)
+				}
+				if len(pkg.Services) > 0 {
+					ioutil.WriteFile(filepath.Join(pkgdir, "ngenService.go"), []byte(generate.GoServices(pkg)), 0644)
+				}
+			case "types":
+				if *schema == "" {
+					log.Fatalf("Go types are only generated from a --schema")
+				}
+				types, err := generate.GoTypes(pkg)
+				if err != nil {
+					log.Fatalf("Failed to generate types: %s", err)
+				}
+				ioutil.WriteFile(filepath.Join(pkgdir, generate.TypesFile), []byte(types), 0644)
+			case "schema":
+				data, err := generate.WriteSchema(pkgs, name)
+				if err != nil {
+					log.Fatalf("Failed to write schema: %s", err)
+				}
+				ioutil.WriteFile(filepath.Join(pkgdir, generate.SchemaFile), append(data, '\n'), 0644)
+			case "js":
+				jsfile := generate.WriteJSConverter(pkg)
+				logger.Info("writing file", "path", path.Join(pkgdir, "ngen_js.go"))
+				ioutil.WriteFile(path.Join(pkgdir, "ngen_js.go"), jsfile, 0666)
+			case "cs":
+				// generate.WriteCS(messages, messageMap)
+			}
+		}
+	}
+}
+
+// parse reads the package in dir and the packages it imports, keyed by package name.
+// Fields are linked to their message and enum types and the messages are validated.
+func parse(dir string) (*build.Package, map[string]*generate.ParsedPkg) {
 	// 1. search given package for all public types
 	fset := token.NewFileSet()
 	wd, _ := os.Getwd()
-	pkgpath := filepath.Join(wd, *dir)
+	pkgpath := filepath.Join(wd, dir)
 
 	bc := &build.Context{
 		GOROOT:      build.Default.GOROOT,
@@ -57,7 +160,7 @@ func main() {
 		panic(err)
 	}
 
-	pkgs := map[string]*generate.ParsedPkg{"github.com/lologarithm/netgen/lib/ngen": &generate.ParsedPkg{}}
+	pkgs := map[string]*generate.ParsedPkg{ngenPath: &generate.ParsedPkg{}}
 
 	var parseFile func(f *ast.File, pkg *generate.ParsedPkg)
 	parseFile = func(f *ast.File, pkg *generate.ParsedPkg) {
@@ -66,6 +169,11 @@ func main() {
 			case *ast.GenDecl:
 				switch d.Tok {
 				case token.TYPE:
+					// The doc of `type T struct` is on the declaration, in a `type (...)` group on each spec.
+					declDoc := d.Doc
+					if d.Lparen.IsValid() {
+						declDoc = nil
+					}
 					for _, s := range d.Specs {
 						ts := s.(*ast.TypeSpec)
 						if !ts.Name.IsExported() {
@@ -76,6 +184,22 @@ func main() {
 							msg := generate.Message{
 								Name:    ts.Name.Name,
 								Package: pkg.Name,
+								Tagged:  hasDirective(generate.TaggedDirective, declDoc, ts.Doc),
+							}
+							if v, ok := directiveValue(generate.IDDirective, declDoc, ts.Doc); ok {
+								if v == "" {
+									log.Fatalf("%s on %s is missing the id", generate.IDDirective, ts.Name.Name)
+								}
+								id, err := strconv.ParseUint(v, 10, 32)
+								if err == nil {
+									err = generate.CheckID(uint32(id))
+								}
+								if err != nil {
+									log.Fatalf("Invalid %s on %s: %s", generate.IDDirective, ts.Name.Name, err)
+								}
+								msg.ID = uint32(id)
+							} else if *namespace {
+								msg.ID = generate.NamespacedID(pkgPath(pkg), msg.Name)
 							}
 							var fields []generate.MessageField
 							for _, tfi := range tsType.Fields.List {
@@ -90,6 +214,7 @@ func main() {
 								}
 
 								customOrder := -1
+								defaultValue, required := "", false
 								if tfi.Tag != nil && len(tfi.Tag.Value) > 0 {
 									doSkip := false
 									tag := reflect.StructTag(tfi.Tag.Value[1 : len(tfi.Tag.Value)-1])
@@ -100,6 +225,10 @@ func main() {
 											if t == "-" {
 												doSkip = true
 												break
+											} else if t == "required" {
+												required = true
+											} else if strings.HasPrefix(t, "default=") {
+												defaultValue = strings.TrimPrefix(t, "default=")
 											} else {
 												// This is therefore a verioning tag
 												customOrder, err = strconv.Atoi(t)
@@ -153,6 +282,8 @@ func main() {
 									Size:          size,
 									Embedded:      emb,
 									Interface:     isInterface,
+									Default:       defaultValue,
+									Required:      required,
 								})
 							}
 							msg.Fields = fields
@@ -160,7 +291,12 @@ func main() {
 							pkg.MessageMap[msg.Name] = msg
 							// fmt.Printf("Added message type %s\n", msg.Name)
 						case *ast.InterfaceType:
-							// skip - no need to handle this i think
+							// Interfaces with only rpc style methods are services.
+							// Other interfaces are only used as field types.
+							if svc, ok := parseService(ts.Name.Name, pkg.Name, importName(f, "context"), tsType); ok {
+								pkg.Services = append(pkg.Services, svc)
+								logger.Debug("added service", "name", svc.Name)
+							}
 						case *ast.Ident:
 							// this is a const type
 							if tsType.Name == "string" {
@@ -168,57 +304,31 @@ func main() {
 							}
 							enum := generate.Enum{Name: ts.Name.Name}
 							pkg.Enums = append(pkg.Enums, enum)
-							fmt.Printf("Added enum type %s\n", ts.Name.Name)
+							logger.Debug("added enum type", "name", ts.Name.Name)
 							pkg.EnumMap[ts.Name.Name] = enum
 						default:
-							fmt.Printf("Unknown type lib declaration: %s, %v\n", reflect.TypeOf(ts.Type), ts.Type)
+							logger.Warn("unknown type declaration", "name", ts.Name.Name, "type", reflect.TypeOf(ts.Type))
 						}
 					}
 				case token.CONST:
-					// fmt.Printf("found const: %#v\n", d.Specs)
-					// for _, s := range d.Specs {
-					// 	switch ts := s.(type) {
-					// 	case *ast.TypeSpec:
-					// 	case *ast.ValueSpec:
-					// 		for ni, val := range ts.Names {
-					// 			fmt.Printf("  value spec name (%T): %#v\n", val, val)
-					// 			enum, ok := enumMap[val.Name]
-					// 			if !ok {
-					// 				continue // no enum of this type
-					// 			}
-					// 			bl := ts.Values[ni].(*ast.BasicLit)
-					// 			intval, _ := strconv.Atoi(bl.Value)
-					// 			enum.Values = append(enum.Values, generate.EnumValue{
-					// 				Name:  val.Name,
-					// 				Value: intval,
-					// 			})
-					//
-					// 		}
-					// 		for _, val := range ts.Values {
-					// 			fmt.Printf("  value spec value (%T): %#v\n", val, val)
-					// 			// switch vt := val.(type) {
-					// 			// case *ast.BasicLit:
-					// 			// 	vt.Value
-					// 			// }
-					// 		}
-					// 	}
-					// }
+					// Enum values are read from the type checked package, see findEnumValues.
 				}
 			case *ast.FuncDecl:
 				// skip, we don't care about functions
 			default:
-				fmt.Printf("Other declaration in file? %T, %#v\n", d, d)
+				logger.Warn("unknown declaration in file", "type", fmt.Sprintf("%T", d))
 			}
 		}
 	}
 
+	var order []string // parsed packages, imports first
 	var parsePkg func(pkg *build.Package)
 	parsePkg = func(pkg *build.Package) {
 		if _, ok := pkgs[pkg.Name]; ok {
 			return
 		}
 
-		log.Printf("Parsing Package: %s", pkg.Name)
+		logger.Info("parsing package", "name", pkg.Name)
 
 		pkgs[pkg.Name] = &generate.ParsedPkg{
 			Name:       pkg.Name,
@@ -228,10 +338,37 @@ func main() {
 			Enums:      []generate.Enum{},
 			MessageMap: map[string]generate.Message{},
 			EnumMap:    map[string]generate.Enum{},
+			Interfaces: map[string][]generate.Message{},
+		}
+
+		// Read this package's files, skipping our own output from previous runs.
+		// Imports are taken from the remaining files so generated code can't pull in other packages.
+		files := []*ast.File{}
+		imports := []string{}
+		for _, fname := range pkg.GoFiles {
+			if !filepath.IsAbs(fname) { // name might be absolute if specified directly. E.g., `gopherjs build /abs/file.go`.
+				fname = filepath.Join(pkg.Dir, fname)
+			}
+			r, err := buildutil.OpenFile(bc, fname)
+			if err != nil {
+				panic(err)
+			}
+			file, err := parser.ParseFile(fset, fname, r, parser.ParseComments)
+			if err != nil {
+				panic(err)
+			}
+			r.Close()
+			if isGenerated(file) {
+				continue
+			}
+			files = append(files, file)
+			for _, impt := range file.Imports {
+				imports = append(imports, strings.Trim(impt.Path.Value, "\""))
+			}
 		}
 
 		// Parse imports first
-		for _, impt := range pkg.Imports {
+		for _, impt := range imports {
 			if _, ok := pkgs[impt]; ok {
 				continue
 			}
@@ -247,112 +384,83 @@ func main() {
 		}
 
 		// Now parse this package's files
-		for _, fname := range pkg.GoFiles {
-			if !filepath.IsAbs(fname) { // name might be absolute if specified directly. E.g., `gopherjs build /abs/file.go`.
-				fname = filepath.Join(pkg.Dir, fname)
-			}
-			r, err := buildutil.OpenFile(bc, fname)
-			if err != nil {
-				panic(err)
-			}
-			file, err := parser.ParseFile(fset, fname, r, parser.ParseComments)
-			if err != nil {
-				panic(err)
-			}
-			r.Close()
+		pkgs[pkg.Name].Files = files
+		for _, file := range files {
 			parseFile(file, pkgs[pkg.Name])
 		}
+		order = append(order, pkg.Name)
 	}
 
 	parsePkg(pkg)
+	typed := typeCheck(fset, order, pkgs)
+	findImplementers(order, pkgs, typed)
+	findEnumValues(order, pkgs, typed)
 
-	// Validates strut field versions and connects message type pointers.
-	for _, pkg := range pkgs {
-		for _, msg := range pkg.Messages {
-			if msg.Versioned {
-				sort.Slice(msg.Fields, func(i int, j int) bool {
-					return msg.Fields[i].Order < msg.Fields[j].Order
-				})
-				seen := map[int]bool{}
-				for _, f := range msg.Fields {
-					if ok := seen[f.Order]; ok {
-						log.Fatalf("Duplicate Field IDs on versioned struct: %s", msg.Name)
-					}
-					seen[f.Order] = true
-				}
-			}
-			for i, mf := range msg.Fields {
-				fieldPkg := mf.RemotePackage
-				if fieldPkg == "" {
-					fieldPkg = msg.Package
-				}
-				opkg := pkgs[fieldPkg]
-				if mf.RemotePackage != "" {
-					if opkg == nil {
-						// Hopefully its just a system package.
-						pkg.Imports[mf.RemotePackage] = struct{}{}
-					} else {
-						// Only include remote packages.
-						pkg.Imports[opkg.Pkg.ImportPath] = struct{}{}
-					}
-				}
-				if opkg != nil {
-					omsg, hasMessage := opkg.MessageMap[mf.Type]
-					if hasMessage {
-						msg.Fields[i].MsgType = &omsg
-						continue
-					}
-					fmt.Printf("PostProcess, Msg: %s, Field: %s, Type: %s\n", msg.Name, mf.Name, mf.Type)
-					oen, ok := opkg.EnumMap[mf.Type]
-					if ok {
-						msg.Fields[i].EnumType = &oen
-						continue
-					}
-					fmt.Printf("\tCouldn't link %s to an enum or msg type...\n", mf.Name)
-				}
-			}
-		}
+	if err := generate.Link(pkgs); err != nil {
+		log.Fatalf("Invalid package %s: %s", pkg.Name, err)
 	}
+	return pkg, pkgs
+}
 
-	for _, l := range strings.Split(*genlist, ",") {
-		for name, pkg := range pkgs {
-			if pkg.Pkg == nil {
-				continue
-			}
-			pkgdir := *outdir
-			if pkgdir == "" {
-				pkgdir = pkg.Pkg.Dir
-			} else if pkgdir[0] == '.' {
-				pkgdir = filepath.Join(wd, pkgdir)
+// readSchema reads the schema file at path, see generate.ReadSchema.
+func readSchema(path string) (*generate.ParsedPkg, map[string]*generate.ParsedPkg) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read schema: %s", err)
+	}
+	root, pkgs, err := generate.ReadSchema(data)
+	if err != nil {
+		log.Fatalf("Invalid schema %s: %s", path, err)
+	}
+	return root, pkgs
+}
+
+// isGenerated checks if the file was written by netgen.
+func isGenerated(f *ast.File) bool {
+	if len(f.Comments) == 0 || f.Comments[0].Pos() > f.Package {
+		return false
+	}
+	return strings.HasPrefix(f.Comments[0].Text(), "Code generated by netgen tool")
+}
+
+// directiveValue returns the rest of the line of a directive in one of the doc comments,
+// empty if the directive has no value.
+func directiveValue(directive string, docs ...*ast.CommentGroup) (string, bool) {
+	for _, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		for _, c := range doc.List {
+			text := strings.TrimSpace(c.Text)
+			if text == directive || strings.HasPrefix(text, directive+" ") || strings.HasPrefix(text, directive+"\t") {
+				return strings.TrimSpace(strings.TrimPrefix(text, directive)), true
 			}
-			log.Printf("Now writing package: '%s' at '%s'", name, pkgdir)
-			switch l {
-			case "go":
-				buf := &bytes.Buffer{}
-				buf.WriteString(generate.GoLibHeader(pkg))
+		}
+	}
+	return "", false
+}
 
-				for _, msg := range pkg.Messages {
-					fmt.Printf("Writing deserializers for %s.%s\n", pkg.Name, msg.Name)
-					buf.WriteString(generate.GoDeserializers(msg))
-				}
+// pkgPath is the import path ids are namespaced with, the package name for packages outside of GOPATH.
+func pkgPath(pkg *generate.ParsedPkg) string {
+	if pkg.Pkg.ImportPath == "" || pkg.Pkg.ImportPath == "." {
+		return pkg.Name
+	}
+	return pkg.Pkg.ImportPath
+}
 
-				// log.Printf("Contents: %s", string(buf.Bytes()))
-				ioutil.WriteFile(filepath.Join(pkgdir, "ngenDeserial.go"), buf.Bytes(), 0644)
-				buf.Reset()
-				buf.WriteString(fmt.Sprintf("%s\npackage %s\n\nimport \"github.com/lologarithm/netgen/lib/ngen\"", generate.HeaderComment(), pkg.Name))
-				for _, msg := range pkg.Messages {
-					buf.WriteString(generate.GoSerializers(msg))
-				}
-				ioutil.WriteFile(filepath.Join(pkgdir, "ngenSerial.go"), buf.Bytes(), 0644)
-			case "js":
-				jsfile := generate.WriteJSConverter(pkg)
-				log.Printf("Now writing %s", path.Join(pkgdir, "ngen_js.go"))
-				ioutil.WriteFile(path.Join(pkgdir, "ngen_js.go"), jsfile, 0666)
-			case "cs":
-				// generate.WriteCS(messages, messageMap)
+// hasDirective checks if one of the doc comments has the directive on a line of its own.
+func hasDirective(directive string, docs ...*ast.CommentGroup) bool {
+	for _, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		for _, c := range doc.List {
+			if strings.TrimSpace(c.Text) == directive {
+				return true
 			}
 		}
 	}
+	return false
 }
 
 // return is:
@@ -371,7 +479,97 @@ func getidenttype(e ast.Expr, isArray bool, isPointer bool) (*ast.Ident, *ast.Id
 		_, xv, _, _ := getidenttype(itf.X, false, false)
 		return xv, itf.Sel, isArray, isPointer
 	default:
-		fmt.Printf("failed to handle a field type! %T, %#v\n", itf, itf)
+		logger.Warn("failed to handle a field type", "type", fmt.Sprintf("%T", itf))
 	}
 	return nil, nil, false, false
 }
+
+// parseService checks if the interface is an rpc service definition.
+// Every method must look like `Method(context.Context, *Req) (*Resp, error)`, contextPkg is the name
+// the file imports the context package as.
+func parseService(name string, pkg string, contextPkg string, it *ast.InterfaceType) (generate.Service, bool) {
+	svc := generate.Service{Name: name, Package: pkg}
+	if it.Methods == nil || len(it.Methods.List) == 0 {
+		return svc, false
+	}
+	for _, m := range it.Methods.List {
+		ft, ok := m.Type.(*ast.FuncType)
+		if !ok || len(m.Names) == 0 {
+			return svc, false // embedded interface
+		}
+		params := fieldTypes(ft.Params)
+		results := fieldTypes(ft.Results)
+		if len(params) != 2 || len(results) != 2 {
+			return svc, false
+		}
+		sel, ok := params[0].(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Context" {
+			return svc, false
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || contextPkg == "" || x.Name != contextPkg {
+			return svc, false
+		}
+		if errIdent, ok := results[1].(*ast.Ident); !ok || errIdent.Name != "error" {
+			return svc, false
+		}
+		req, ok := messagePointer(params[1])
+		if !ok {
+			return svc, false
+		}
+		resp, ok := messagePointer(results[0])
+		if !ok {
+			return svc, false
+		}
+		svc.Methods = append(svc.Methods, generate.ServiceMethod{
+			Name:     m.Names[0].Name,
+			Request:  req,
+			Response: resp,
+		})
+	}
+	return svc, true
+}
+
+// importName returns the name the file imports the package path as, or "" if it doesn't import it.
+func importName(f *ast.File, path string) string {
+	for _, imp := range f.Imports {
+		if strings.Trim(imp.Path.Value, "`\"") != path {
+			continue
+		}
+		if imp.Name != nil {
+			return imp.Name.Name
+		}
+		return path[strings.LastIndex(path, "/")+1:]
+	}
+	return ""
+}
+
+// fieldTypes expands a field list so grouped names like `(a, b *T)` produce one entry each.
+func fieldTypes(fl *ast.FieldList) []ast.Expr {
+	if fl == nil {
+		return nil
+	}
+	types := []ast.Expr{}
+	for _, f := range fl.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			types = append(types, f.Type)
+		}
+	}
+	return types
+}
+
+// messagePointer returns the name of the type if e is a pointer to a type in the same package.
+func messagePointer(e ast.Expr) (string, bool) {
+	star, ok := e.(*ast.StarExpr)
+	if !ok {
+		return "", false
+	}
+	ident, ok := star.X.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	return ident.Name, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"go/ast"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lologarithm/netgen/generate"
+)
+
+func TestTypesThenGo(t *testing.T) {
+	// Inside the module, so the generated package can import ngen.
+	dir, err := ioutil.TempDir(".", "testtypes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(o, s string) { *outdir, *schema = o, s }(*outdir, *schema)
+
+	root, _, err := generate.ReadSchema([]byte(`{"packages": [{"name": "game", "messages": [
+		{"name": "Vec", "fields": [{"name": "X", "type": "float32"}, {"name": "Y", "type": "float32"}]},
+		{"name": "Player", "versioned": true, "tagged": true, "fields": [
+			{"name": "Name", "type": "string", "order": 1, "required": true},
+			{"name": "Pos", "type": "Vec", "order": 2, "pointer": true},
+			{"name": "Kind", "type": "Kind", "order": 3}
+		]}],
+		"enums": [{"name": "Kind", "type": "uint16", "values": [{"name": "Human", "value": 0}, {"name": "Robot", "value": 7}]}]
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	*outdir, *schema = dir, "game.json"
+	write(map[string]*generate.ParsedPkg{root.Name: root}, "types", wd)
+
+	*outdir, *schema = "", ""
+	_, pkgs := parse(dir)
+	if _, ok := pkgs["game"].MessageMap["Player"]; !ok {
+		t.Fatalf("expected the generated types to be parsed, got %v", pkgs["game"].Messages)
+	}
+	if kind := pkgs["game"].EnumMap["Kind"]; !reflect.DeepEqual(kind, root.EnumMap["Kind"]) {
+		t.Errorf("expected the enum of the schema, got %+v", kind)
+	}
+	write(pkgs, "go", wd)
+
+	serial, err := ioutil.ReadFile(filepath.Join(dir, "ngenSerial.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(serial), "func (m Player) Serialize(") {
+		t.Errorf("expected a Player serializer:\n%s", serial)
+	}
+	if out, err := exec.Command("go", "build", "./"+dir).CombinedOutput(); err != nil {
+		t.Errorf("generated package doesn't build: %s\n%s", err, out)
+	}
+}
+
+func TestDirectiveValue(t *testing.T) {
+	doc := func(lines ...string) *ast.CommentGroup {
+		cg := &ast.CommentGroup{}
+		for _, l := range lines {
+			cg.List = append(cg.List, &ast.Comment{Text: l})
+		}
+		return cg
+	}
+	for i, tc := range []struct {
+		doc   *ast.CommentGroup
+		value string
+		ok    bool
+	}{
+		{doc("// Vec is a vector.", "//ngen:id 4242"), "4242", true},
+		{doc("//ngen:id"), "", true},
+		{doc("//ngen:id\t7 "), "7", true},
+		{doc("//ngen:identity 4242"), "", false},
+		{nil, "", false},
+	} {
+		if v, ok := directiveValue(generate.IDDirective, tc.doc); v != tc.value || ok != tc.ok {
+			t.Errorf("case %d: expected %q %v, got %q %v", i, tc.value, tc.ok, v, ok)
+		}
+	}
+}
+
+func TestSchemaEnumValues(t *testing.T) {
+	_, pkgs := parse("../../benchmark/models")
+	data, err := generate.WriteSchema(pkgs, "models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := generate.ReadSchema(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := generate.Enum{Name: "Enumy", Type: "int32", Values: []generate.EnumValue{{Name: "A", Value: 0}, {Name: "B", Value: 1}, {Name: "C", Value: 2}}}
+	if e := root.EnumMap["Enumy"]; !reflect.DeepEqual(e, expected) {
+		t.Errorf("expected enum %+v in the schema, got %+v", expected, e)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 
 	"github.com/lologarithm/netgen/example/newmodels"
+	"github.com/lologarithm/netgen/lib/ngen"
 	"github.com/lologarithm/netgen/lib/ngservice/client"
 	"github.com/lologarithm/netgen/lib/ngservice/client/ngwebsocket"
 )
@@ -67,18 +70,33 @@ func (ce *Events) OnConnected(cb func(bool)) {
 // }
 
 func (c *Client) Dial(url string) {
-	var err error
-	c.Client, err = ngwebsocket.New(url, "", func() {
-		print("Connection active. starting client now.\n")
+	connected := func() {
 		if c.CEvents != nil && c.CEvents.connected != nil {
 			c.CEvents.connected(true)
 		}
-		client.ManageClient(newmodels.Context, c.Client)
-		go runClient(c)
+	}
+	cl, err := ngwebsocket.New(url, "", func() {
+		print("Connection active.\n")
+		connected()
 	})
 	if err != nil {
-		fmt.Printf("Failed to connect: %s\n", err.Error())
-		c.CEvents.connected(false)
-		return
+		fmt.Printf("Failed to connect: %s, retrying.\n", err.Error())
+		cl = &client.Client{
+			Outgoing: make(chan ngen.Message, 10),
+			Incoming: make(chan ngen.Message, 10),
+			Dial: func(ctx context.Context) (io.ReadWriteCloser, error) {
+				return ngwebsocket.Dial(ctx, url, "")
+			},
+		}
+	}
+	cl.OnDisconnected = func(err error) {
+		fmt.Printf("Disconnected: %s\n", err.Error())
+	}
+	cl.OnReconnected = func(resumed bool) {
+		print("Reconnected.\n")
+		connected()
 	}
+	c.Client = cl
+	client.ManageClient(newmodels.Context, c.Client)
+	go runClient(c)
 }
@@ -1,6 +1,9 @@
 package models
 
-import "github.com/lologarithm/netgen/example/models/secret"
+import (
+	"github.com/lologarithm/netgen/example/models/secret"
+	"github.com/lologarithm/netgen/lib/ngen"
+)
 
 type Message struct {
 	Message string
@@ -17,3 +20,14 @@ type SuperMessage struct {
 	Normal string
 	Secret *secret.Msg
 }
+
+// Envelope carries a message of any package implementing Payload.
+type Envelope struct {
+	Payload Payload
+}
+
+// Payload is a message that can be printed, like secret.Msg.
+type Payload interface {
+	ngen.Message
+	String() string
+}
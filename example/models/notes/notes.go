@@ -0,0 +1,14 @@
+package notes
+
+import "github.com/lologarithm/netgen/example/models"
+
+// Note implements models.Payload in a package that imports models, so models.ReadPayload only reads it
+// through a Context of an ngen.Registry with this package.
+type Note struct {
+	Text string
+	Re   *models.Message
+}
+
+func (n Note) String() string {
+	return "N: " + n.Text
+}
@@ -5,8 +5,8 @@ type Message struct {
 }
 
 type VersionedMessage struct {
-	Message string `ngen:"1"`
+	Message string `ngen:"1,required"`
 	From    string `ngen:"2"`
 	// UselessData int    `ngen:"3"` Don't need useless data anymore
-	NewHotness float64 `ngen:"4"`
+	NewHotness float64 `ngen:"4,default=1.5"`
 }
@@ -15,8 +15,9 @@ import (
 
 func main() {
 	server := &server{
-		mut:   &sync.Mutex{},
-		conns: []*client.Client{},
+		mut:    &sync.Mutex{},
+		conns:  []*client.Client{},
+		router: newRouter(),
 	}
 
 	http.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
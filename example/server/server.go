@@ -1,38 +1,51 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/lologarithm/netgen/example/models"
+	"github.com/lologarithm/netgen/lib/ngen"
 	"github.com/lologarithm/netgen/lib/ngservice/client"
 )
 
 type server struct {
-	mut   *sync.Mutex
-	conns []*client.Client
+	mut    *sync.Mutex
+	conns  []*client.Client
+	router *models.Router
+}
+
+func newRouter() *models.Router {
+	r := models.NewRouter()
+	r.Use(func(next client.Handler) client.Handler {
+		return func(c *client.Client, msg ngen.Message) {
+			fmt.Printf("%s: handling message type %d\n", c.Name, msg.MsgType())
+			next(c, msg)
+		}
+	})
+	r.OnMessage(func(c *client.Client, msg *models.Message) {
+		fmt.Printf(" Got message: %s\n", msg.Message)
+		c.Outgoing <- msg // ECHO
+	})
+	r.OnVersionedMessage(func(c *client.Client, msg *models.VersionedMessage) {
+		fmt.Printf(" Got versioned message: %#v\n", msg)
+		c.Outgoing <- &models.VersionedMessage{Message: msg.Message + "(ECHO)", From: "The Server", UselessData: 7}
+	})
+	r.Unhandled(func(c *client.Client, msg ngen.Message) {
+		fmt.Printf("Got a message from the client: %#v\n", msg)
+	})
+	return r
 }
 
 // runClient is the server client closure.
 // It holds references to the outbound/incoming
 func runClient(c *client.Client, ss *server) {
-	client.ManageClient(models.Context, c)
-	for msg := range c.Incoming {
-		if msg == nil {
-			fmt.Printf("%s: Nil packet, starting shutdown of client conn.\n", c.Name)
-			break
-		}
-		switch tmsg := msg.(type) {
-		case *models.Message:
-			fmt.Printf(" Got message: %s\n", tmsg.Message)
-			c.Outgoing <- msg // ECHO
-		case *models.VersionedMessage:
-			fmt.Printf(" Got versioned message: %#v\n", tmsg)
-			c.Outgoing <- &models.VersionedMessage{Message: tmsg.Message + "(ECHO)", From: "The Server", UselessData: 7}
-		default:
-			fmt.Printf("Got a message from the client: %#v\n", msg)
-		}
-	}
-
-	fmt.Printf("%s: Socket closed, shutting down parser.\n", c.Name)
+	c.Settings = models.Context
+	// Drop half-open connections after a minute without hearing from the client.
+	c.Heartbeat = client.HeartbeatOptions{Interval: 20 * time.Second, WriteTimeout: 10 * time.Second}
+	go ss.router.Serve(c)
+	err := c.Run(context.Background())
+	fmt.Printf("%s: Socket closed (%s), shutting down parser.\n", c.Name, err)
 }
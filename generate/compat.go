@@ -0,0 +1,166 @@
+package generate
+
+import (
+	"fmt"
+)
+
+// Change is a difference between two versions of a package's messages.
+type Change struct {
+	Message  string // name of the message or enum
+	Field    string // field or enum value, empty for changes of the whole message
+	Breaking bool
+	Reason   string
+}
+
+func (c Change) String() string {
+	kind := "compatible"
+	if c.Breaking {
+		kind = "BREAKING"
+	}
+	name := c.Message
+	if c.Field != "" {
+		name += "." + c.Field
+	}
+	return fmt.Sprintf("%s: %s: %s", kind, name, c.Reason)
+}
+
+// Compat returns the changes from the old to the new version of a package that matter to remotes running
+// the other version. Breaking changes stop the two from exchanging a message or fail their handshake:
+// removed messages, changed and colliding message ids, layout changes of unversioned messages and, in versioned ones,
+// reused orders, type changes and added or removed required fields. Removed and renumbered enum values break too.
+func Compat(old, new *ParsedPkg) []Change {
+	var changes []Change
+	breaking := func(msg, field, reason string, args ...interface{}) {
+		changes = append(changes, Change{Message: msg, Field: field, Breaking: true, Reason: fmt.Sprintf(reason, args...)})
+	}
+	compatible := func(msg, field, reason string, args ...interface{}) {
+		changes = append(changes, Change{Message: msg, Field: field, Reason: fmt.Sprintf(reason, args...)})
+	}
+
+	ids := map[uint32]string{}
+	for _, m := range new.Messages {
+		id := MessageID(m)
+		if other, ok := ids[id]; ok {
+			breaking(m.Name, "", "message id %d collides with %s", id, other)
+		} else if err := CheckID(id); err != nil {
+			breaking(m.Name, "", "%s", err)
+		}
+		ids[id] = m.Name
+	}
+
+	for _, o := range old.Messages {
+		n, ok := new.MessageMap[o.Name]
+		if !ok {
+			breaking(o.Name, "", "removed, remotes of the old version still send it")
+			continue
+		}
+		if MessageID(o) != MessageID(n) {
+			breaking(o.Name, "", "message id changed from %d to %d", MessageID(o), MessageID(n))
+		}
+		switch {
+		case o.Versioned != n.Versioned:
+			breaking(o.Name, "", "versioning changed, field orders must stay the same as before")
+		case !o.Versioned:
+			if Fingerprint(o) != Fingerprint(n) {
+				breaking(o.Name, "", "fields changed without versioning")
+			}
+		default:
+			compatFields(o, n, breaking, compatible)
+		}
+	}
+	for _, n := range new.Messages {
+		if _, ok := old.MessageMap[n.Name]; ok {
+			continue
+		}
+		id := MessageID(n)
+		for _, o := range old.Messages {
+			if _, kept := new.MessageMap[o.Name]; !kept && MessageID(o) == id {
+				breaking(n.Name, "", "message id %d was used by %s in the old version", id, o.Name)
+			}
+		}
+		compatible(n.Name, "", "added")
+	}
+	compatEnums(old, new, breaking, compatible)
+	return changes
+}
+
+// compatEnums compares the values of the enums in both packages by name.
+func compatEnums(old, new *ParsedPkg, breaking, compatible func(msg, field, reason string, args ...interface{})) {
+	newEnums := map[string]Enum{}
+	for _, e := range new.Enums {
+		newEnums[e.Name] = e
+	}
+	for _, o := range old.Enums {
+		n, ok := newEnums[o.Name]
+		if !ok {
+			continue // fields using it changed type
+		}
+		newValues := map[string]int{}
+		for _, v := range n.Values {
+			newValues[v.Name] = v.Value
+		}
+		oldValues := map[string]bool{}
+		for _, ov := range o.Values {
+			oldValues[ov.Name] = true
+			nv, ok := newValues[ov.Name]
+			switch {
+			case !ok:
+				breaking(o.Name, ov.Name, "value %d removed, remotes of the old version still send it", ov.Value)
+			case nv != ov.Value:
+				breaking(o.Name, ov.Name, "value changed from %d to %d", ov.Value, nv)
+			}
+		}
+		for _, nv := range n.Values {
+			if !oldValues[nv.Name] {
+				compatible(n.Name, nv.Name, "value %d added", nv.Value)
+			}
+		}
+	}
+}
+
+// compatFields compares the fields of a versioned message by order.
+func compatFields(o, n Message, breaking, compatible func(msg, field, reason string, args ...interface{})) {
+	newFields := map[int]MessageField{}
+	for _, f := range n.Fields {
+		newFields[f.Order] = f
+	}
+	oldFields := map[int]MessageField{}
+	for _, of := range o.Fields {
+		oldFields[of.Order] = of
+		nf, ok := newFields[of.Order]
+		switch {
+		case !ok && of.Required:
+			breaking(o.Name, of.Name, "required field %d removed, remotes of the old version require it", of.Order)
+		case !ok:
+			compatible(o.Name, of.Name, "field %d removed", of.Order)
+		case fieldTypeString(nf) != fieldTypeString(of) && nf.Name != of.Name:
+			breaking(o.Name, nf.Name, "order %d reused, it was %s", of.Order, of.Name)
+		case fieldTypeString(nf) != fieldTypeString(of):
+			breaking(o.Name, nf.Name, "type changed from %s to %s", fieldTypeString(of), fieldTypeString(nf))
+		case nf.Name != of.Name:
+			compatible(o.Name, nf.Name, "field %d renamed from %s", of.Order, of.Name)
+		}
+	}
+	for _, nf := range n.Fields {
+		if _, ok := oldFields[nf.Order]; ok {
+			continue
+		}
+		if nf.Required {
+			breaking(n.Name, nf.Name, "required field %d added, remotes of the old version don't have it", nf.Order)
+		} else {
+			compatible(n.Name, nf.Name, "field %d added", nf.Order)
+		}
+	}
+}
+
+// fieldTypeString is the Go type of f.
+func fieldTypeString(f MessageField) string {
+	t := goFieldName(f)
+	if f.Pointer {
+		t = "*" + t
+	}
+	if f.Array {
+		t = "[]" + t
+	}
+	return t
+}
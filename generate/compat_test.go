@@ -0,0 +1,88 @@
+package generate
+
+import (
+	"testing"
+)
+
+func compatPkg(msgs ...Message) *ParsedPkg {
+	pkg := &ParsedPkg{MessageMap: map[string]Message{}}
+	for _, m := range msgs {
+		pkg.Messages = append(pkg.Messages, m)
+		pkg.MessageMap[m.Name] = m
+	}
+	return pkg
+}
+
+func TestCompat(t *testing.T) {
+	old := compatPkg(
+		Message{Name: "Kept", Versioned: true, Fields: []MessageField{
+			{Name: "A", Type: IntType, Order: 1},
+			{Name: "B", Type: StringType, Order: 2, Required: true},
+			{Name: "C", Type: IntType, Order: 3},
+			{Name: "D", Type: IntType, Order: 4},
+			{Name: "E", Type: IntType, Order: 5},
+			{Name: "H", Type: IntType, Order: 8},
+		}},
+		Message{Name: "Fixed", Fields: []MessageField{{Name: "A", Type: IntType}}},
+		Message{Name: "Gone"},
+	)
+	new := compatPkg(
+		Message{Name: "Kept", Versioned: true, Fields: []MessageField{
+			{Name: "A", Type: IntType, Order: 1},
+			{Name: "Other", Type: StringType, Order: 3},
+			{Name: "D", Type: Int64Type, Order: 4},
+			{Name: "F", Type: IntType, Order: 6, Required: true},
+			{Name: "G", Type: IntType, Order: 7},
+			{Name: "Renamed", Type: IntType, Order: 8},
+		}},
+		Message{Name: "Fixed", Fields: []MessageField{{Name: "A", Type: Int64Type}}},
+		Message{Name: "Added"},
+	)
+
+	expected := []Change{
+		{Message: "Kept", Field: "B", Breaking: true, Reason: "required field 2 removed, remotes of the old version require it"},
+		{Message: "Kept", Field: "Other", Breaking: true, Reason: "order 3 reused, it was C"},
+		{Message: "Kept", Field: "D", Breaking: true, Reason: "type changed from int to int64"},
+		{Message: "Kept", Field: "E", Reason: "field 5 removed"},
+		{Message: "Kept", Field: "Renamed", Reason: "field 8 renamed from H"},
+		{Message: "Kept", Field: "F", Breaking: true, Reason: "required field 6 added, remotes of the old version don't have it"},
+		{Message: "Kept", Field: "G", Reason: "field 7 added"},
+		{Message: "Fixed", Breaking: true, Reason: "fields changed without versioning"},
+		{Message: "Gone", Breaking: true, Reason: "removed, remotes of the old version still send it"},
+		{Message: "Added", Reason: "added"},
+	}
+	changes := Compat(old, new)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+	for i, c := range changes {
+		if c != expected[i] {
+			t.Errorf("change %d: expected %q, got %q", i, expected[i], c)
+		}
+	}
+
+	if changes := Compat(new, new); len(changes) != 0 {
+		t.Errorf("expected no changes to the same package, got %v", changes)
+	}
+}
+
+func TestCompatEnums(t *testing.T) {
+	old, new := compatPkg(), compatPkg()
+	old.Enums = []Enum{{Name: "Kind", Values: []EnumValue{{Name: "Human", Value: 0}, {Name: "Robot", Value: 1}, {Name: "Alien", Value: 2}}}}
+	new.Enums = []Enum{{Name: "Kind", Values: []EnumValue{{Name: "Human", Value: 0}, {Name: "Robot", Value: 3}, {Name: "Ghost", Value: 4}}}}
+
+	expected := []Change{
+		{Message: "Kind", Field: "Robot", Breaking: true, Reason: "value changed from 1 to 3"},
+		{Message: "Kind", Field: "Alien", Breaking: true, Reason: "value 2 removed, remotes of the old version still send it"},
+		{Message: "Kind", Field: "Ghost", Reason: "value 4 added"},
+	}
+	changes := Compat(old, new)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+	for i, c := range changes {
+		if c != expected[i] {
+			t.Errorf("change %d: expected %q, got %q", i, expected[i], c)
+		}
+	}
+}
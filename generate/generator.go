@@ -1,9 +1,14 @@
 package generate
 
 import (
+	"fmt"
 	"go/ast"
 	"go/build"
 	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/lologarithm/netgen/lib/ngen"
 )
 
 type ParsedPkg struct {
@@ -13,8 +18,12 @@ type ParsedPkg struct {
 	Imports    map[string]struct{} // Set of imports in parsed messages
 	Messages   []Message
 	Enums      []Enum
+	Services   []Service
 	MessageMap map[string]Message
 	EnumMap    map[string]Enum
+	// Interfaces lists the messages of all parsed packages implementing each interface of the package
+	// that is the type of a field, see GoInterfaceReaders.
+	Interfaces map[string][]Message
 }
 
 // Message is a message that can be serialized across network.
@@ -23,18 +32,113 @@ type Message struct {
 	Package   string         // Source package
 	Fields    []MessageField // list of fields on the message
 	Versioned bool           // If this message contains versioning tags
+	Tagged    bool           // If this message also has the tagged encoding, see GoTagged
+	ID        uint32         // message type set with IDDirective or by namespacing, see MessageID
 	SelfSize  int            // size of message not counting sub objects
 }
 
+// IDDirective followed by a number sets the message type of a struct when put in its doc comment.
+const IDDirective = "//ngen:id"
+
+// MessageID is the message type of m on the wire, its ID if it has one and a hash of its name otherwise.
 func MessageID(m Message) uint32 {
+	if m.ID != 0 {
+		return m.ID
+	}
+	return nameID(m.Name)
+}
+
+// NamespacedID is the message type of the message called name in the package at path, so messages with
+// the same name in different packages don't collide.
+func NamespacedID(path string, name string) uint32 {
+	return nameID(path + "." + name)
+}
+
+func nameID(name string) uint32 {
+	v := crc32.NewIEEE()
+	v.Write([]byte(name))
+	return v.Sum32()
+}
+
+// CheckID returns why id can't be the message type of a message, if it can't.
+func CheckID(id uint32) error {
+	switch {
+	case ngen.MessageType(id) <= ngen.MaxReservedMessageType:
+		return fmt.Errorf("message id %d is reserved, ids up to %d are netgen's own", id, ngen.MaxReservedMessageType)
+	}
+	return nil
+}
+
+// CheckMessageIDs returns an error if a message of pkgs, keyed by package name, has an invalid id
+// or one that collides with another message.
+func CheckMessageIDs(pkgs map[string]*ParsedPkg) error {
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := map[uint32]string{}
+	for _, name := range names {
+		for _, msg := range pkgs[name].Messages {
+			id := MessageID(msg)
+			if err := CheckID(id); err != nil {
+				return fmt.Errorf("%s.%s: %s", name, msg.Name, err)
+			}
+			if other, ok := ids[id]; ok {
+				return fmt.Errorf("message id %d of %s.%s collides with %s, set one with %s or namespace the ids", id, name, msg.Name, other, IDDirective)
+			}
+			ids[id] = name + "." + msg.Name
+		}
+	}
+	return nil
+}
+
+// Fingerprint hashes the names, types and orders of the fields of m, so remotes with a different layout can be found.
+// Unversioned structs in fields are part of it, changes to versioned ones are handled by versioning.
+func Fingerprint(m Message) uint32 {
+	h := crc32.NewIEEE()
+	fingerprint(h, m, map[string]bool{})
+	return h.Sum32()
+}
+
+func fingerprint(w io.Writer, m Message, seen map[string]bool) {
+	seen[m.Package+"."+m.Name] = true
+	for _, f := range m.Fields {
+		fmt.Fprintf(w, "%d %s %t %t %s.%s;", f.Order, f.Name, f.Array, f.Pointer, f.RemotePackage, f.Type)
+		if f.MsgType != nil && !f.MsgType.Versioned && !seen[f.MsgType.Package+"."+f.MsgType.Name] {
+			io.WriteString(w, "{")
+			fingerprint(w, *f.MsgType, seen)
+			io.WriteString(w, "}")
+		}
+	}
+}
+
+// Service is an interface of RPC methods that each take and return a message.
+type Service struct {
+	Name    string          // name of the interface
+	Package string          // Source package
+	Methods []ServiceMethod // list of methods on the interface
+}
+
+// ServiceMethod is a single RPC method of a service.
+// The Go signature is `Name(context.Context, *Request) (*Response, error)`.
+type ServiceMethod struct {
+	Name     string
+	Request  string // Message name of the request
+	Response string // Message name of the response
+}
+
+// MethodID is the id sent in rpc frames to select the method to call.
+func MethodID(s Service, m ServiceMethod) uint32 {
 	v := crc32.NewIEEE()
-	v.Write([]byte(m.Name))
+	v.Write([]byte(s.Name + "." + m.Name))
 	return v.Sum32()
 }
 
 // Enum represents a list of values with a shared type
 type Enum struct {
 	Name   string      // name of enum
+	Type   string      // underlying integer type, int32 if empty
 	Values []EnumValue // list of enum values
 }
 
@@ -56,7 +160,9 @@ type MessageField struct {
 	Order         int
 	Size          int
 	Embedded      bool
-	Interface     bool // used only for generating from existing interfaces
+	Interface     bool   // used only for generating from existing interfaces
+	Default       string // value of a missing versioned field, from the `default=` tag option
+	Required      bool   // remotes must have this versioned field, from the `required` tag option
 }
 
 // Allowed types to generate from
@@ -0,0 +1,55 @@
+package generate
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestCheckMessageIDs(t *testing.T) {
+	pkgs := map[string]*ParsedPkg{
+		"models":    compatPkg(Message{Name: "Message", Package: "models"}),
+		"newmodels": compatPkg(Message{Name: "Message", Package: "newmodels"}),
+	}
+	if err := CheckMessageIDs(pkgs); err == nil || !strings.Contains(err.Error(), "newmodels.Message collides with models.Message") {
+		t.Errorf("expected messages of the same name to collide, got %v", err)
+	}
+
+	pkgs["newmodels"].Messages[0].ID = NamespacedID("example.com/newmodels", "Message")
+	if err := CheckMessageIDs(pkgs); err != nil {
+		t.Errorf("expected a namespaced id not to collide, got %v", err)
+	}
+
+	for _, id := range []uint32{1, 15} {
+		pkgs["newmodels"].Messages[0].ID = id
+		if err := CheckMessageIDs(pkgs); err == nil {
+			t.Errorf("expected id %d to be invalid", id)
+		}
+	}
+}
+
+func TestCheckInterfaceReaders(t *testing.T) {
+	pkg := compatPkg(Message{Name: "Message", Package: "models"})
+	pkg.Name = "models"
+	pkg.Interfaces = map[string][]Message{"Payload": nil}
+	if err := CheckInterfaceReaders(pkg); err != nil {
+		t.Errorf("expected no collision, got %v", err)
+	}
+
+	pkg.Interfaces["Delta"] = nil
+	if err := CheckInterfaceReaders(pkg); err == nil || !strings.Contains(err.Error(), "collides with models.ReadDelta") {
+		t.Errorf("expected the reader of Delta to collide with ReadDelta, got %v", err)
+	}
+	delete(pkg.Interfaces, "Delta")
+
+	f, err := parser.ParseFile(token.NewFileSet(), "models.go", "package models\n\nfunc ReadPayload() {}\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg.Files = []*ast.File{f}
+	if err := CheckInterfaceReaders(pkg); err == nil || !strings.Contains(err.Error(), "collides with models.ReadPayload") {
+		t.Errorf("expected the reader of Payload to collide with the declared ReadPayload, got %v", err)
+	}
+}
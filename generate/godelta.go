@@ -0,0 +1,340 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// GoDelta returns the generated delta serialization of all versioned messages in the package.
+// Fields are identified by their version order, nested versioned structs and slices of them
+// only send their own changes. Like full messages, deltas are written in the local field order
+// and applied in the order of the sender's field versions.
+func GoDelta(pkg *ParsedPkg) string {
+	gobuf := &bytes.Buffer{}
+	gobuf.WriteString(fmt.Sprintf("%s\npackage %s\n\nimport (\n\t\"github.com/lologarithm/netgen/lib/ngen\"", HeaderComment(), pkg.Name))
+	for _, imp := range fieldImports(pkg, func(msg Message) bool { return msg.Versioned }) {
+		gobuf.WriteString(fmt.Sprintf("\n\t\"%s\"", imp))
+	}
+	gobuf.WriteString("\n)\n\n")
+
+	cases := &bytes.Buffer{}
+	for _, msg := range pkg.Messages {
+		if msg.Versioned {
+			cases.WriteString(fmt.Sprintf(`	case %[1]sMsgType:
+		msg := &%[1]s{}
+		return msg, msg.ApplyDelta(ctx, base, content)
+`, msg.Name))
+		}
+	}
+	gobuf.WriteString(fmt.Sprintf(`// ReadDelta applies a delta read from content to base and returns the new message.
+func ReadDelta(ctx *ngen.Context, msgType ngen.MessageType, base ngen.Message, content *ngen.Buffer) (ngen.Message, error) {
+	switch msgType {
+%s	default:
+		return nil, ngen.ErrNoDelta
+	}
+}
+`, cases.String()))
+
+	for _, msg := range pkg.Messages {
+		if msg.Versioned {
+			writeGoDelta(msg, gobuf)
+		}
+	}
+	return gobuf.String()
+}
+
+// fieldImports returns the imports used by fields of the messages that are included.
+func fieldImports(pkg *ParsedPkg, include func(Message) bool) []string {
+	used := map[string]bool{}
+	for _, msg := range pkg.Messages {
+		if !include(msg) {
+			continue
+		}
+		for _, f := range msg.Fields {
+			if f.RemotePackage != "" {
+				used[f.RemotePackage] = true
+			}
+		}
+	}
+	imports := []string{}
+	for imp := range pkg.Imports {
+		if used[path.Base(imp)] {
+			imports = append(imports, imp)
+		}
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// HasVersioned reports whether any message of the package has versioned fields.
+func HasVersioned(pkg *ParsedPkg) bool {
+	for _, msg := range pkg.Messages {
+		if msg.Versioned {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaNested reports whether a field is a versioned struct that can be sent as a delta itself.
+func deltaNested(f MessageField) bool {
+	return f.MsgType != nil && f.MsgType.Versioned && !f.Interface && !(f.Array && f.Pointer)
+}
+
+func fieldTypeName(f MessageField) string {
+	if f.RemotePackage != "" {
+		return f.RemotePackage + "." + f.Type
+	}
+	return f.Type
+}
+
+// deltaFields writes the output of each for the local fields that changed.
+func deltaFields(msg Message, buf *bytes.Buffer, each func(f MessageField, buf *bytes.Buffer)) {
+	for _, f := range msg.Fields {
+		buf.WriteString(fmt.Sprintf("\tif mask.Has(%d) {\n", f.Order))
+		each(f, buf)
+		buf.WriteString("\t}\n")
+	}
+}
+
+// deltaSwitch writes a loop over the sender's field versions that runs the output of each for changed fields
+// and skips changed fields that aren't known locally.
+func deltaSwitch(msg Message, buf *bytes.Buffer, each func(f MessageField, buf *bytes.Buffer)) {
+	buf.WriteString(fmt.Sprintf("\tfor i, fld := range ctx.FieldVersions[%d] {\n\t\tif !mask.Has(fld) {\n\t\t\tcontinue\n\t\t}\n\t\tswitch fld {\n", MessageID(msg)))
+	for _, f := range msg.Fields {
+		buf.WriteString(fmt.Sprintf("\t\tcase %d:\n", f.Order))
+		each(f, buf)
+	}
+	buf.WriteString(fmt.Sprintf("\t\tdefault:\n\t\t\tctx.SkipDeltaField(%d, i, buffer)\n\t\t}\n\t}\n", MessageID(msg)))
+}
+
+func writeGoDelta(msg Message, buf *bytes.Buffer) {
+	name := msg.Name
+	buf.WriteString(fmt.Sprintf(`
+// deltaBase%[1]s returns the baseline of a %[1]s delta, nil stands for the zero value.
+func deltaBase%[1]s(base ngen.Message) *%[1]s {
+	switch b := base.(type) {
+	case *%[1]s:
+		return b
+	case %[1]s:
+		return &b
+	}
+	return nil
+}
+
+// DeltaMask returns the fields of m that differ from base.
+func (m %[1]s) DeltaMask(ctx *ngen.Context, base ngen.Message) (mask ngen.FieldMask) {
+	b := deltaBase%[1]s(base)
+	if b == nil {
+		b = &%[1]s{}
+	}
+`, name))
+	for _, f := range msg.Fields {
+		writeDeltaChanged(f, buf)
+	}
+	buf.WriteString("\treturn mask\n}\n")
+
+	buf.WriteString(fmt.Sprintf(`
+// SerializeDelta writes the fields of m that differ from base.
+func (m %[1]s) SerializeDelta(ctx *ngen.Context, base ngen.Message, buffer *ngen.Buffer) error {
+	mask := m.DeltaMask(ctx, base)
+%[2]s	mask.Serialize(buffer)
+`, name, nestedBase(msg)))
+	deltaFields(msg, buf, writeDeltaSerialize)
+	buf.WriteString("\treturn buffer.Err\n}\n")
+
+	buf.WriteString(fmt.Sprintf(`
+// DeltaLength returns the length of the delta from base to m.
+func (m %[1]s) DeltaLength(ctx *ngen.Context, base ngen.Message) int {
+	mask := m.DeltaMask(ctx, base)
+%[2]s	mylen := mask.Length()
+`, name, nestedBase(msg)))
+	deltaFields(msg, buf, writeDeltaLen)
+	buf.WriteString("\treturn mylen\n}\n")
+
+	buf.WriteString(fmt.Sprintf(`
+// ApplyDelta sets m to base with the changes read from buffer. base is left unchanged,
+// but m shares the slices and pointers of unchanged fields with it.
+func (m *%[1]s) ApplyDelta(ctx *ngen.Context, base ngen.Message, buffer *ngen.Buffer) error {
+	b := deltaBase%[1]s(base)
+	if b == nil {
+		b = &%[1]s{}%[2]s
+	}
+	*m = *b
+	mask := ngen.DeserializeFieldMask(buffer)
+`, name, zeroDefaults(msg)))
+	deltaSwitch(msg, buf, writeDeltaApply)
+	buf.WriteString("\treturn buffer.Err\n}\n")
+}
+
+// zeroDefaults sets the defaults of the zero baseline, fields the sender doesn't have are never in its deltas.
+func zeroDefaults(msg Message) string {
+	if hasDefaults(msg) {
+		return fmt.Sprintf("\n\t\tb.setDefaults(ctx.Present(%sMsgType))", msg.Name)
+	}
+	return ""
+}
+
+// nestedBase returns the baseline lookup for SerializeDelta and DeltaLength, only needed by nested deltas.
+func nestedBase(msg Message) string {
+	for _, f := range msg.Fields {
+		if deltaNested(f) {
+			return fmt.Sprintf("\tb := deltaBase%[1]s(base)\n\tif b == nil {\n\t\tb = &%[1]s{}\n\t}\n", msg.Name)
+		}
+	}
+	return ""
+}
+
+// writeDeltaChanged writes the check setting the mask bit of a field that differs from the baseline b.
+// Fields that can't be compared, like interfaces and structs without versions, are always sent.
+func writeDeltaChanged(f MessageField, buf *bytes.Buffer) {
+	n, bn := "m."+f.Name, "b."+f.Name
+	set := fmt.Sprintf("mask.Set(%d)", f.Order)
+	isTime := f.RemotePackage == "time" && f.Type == "Time"
+	comparable := f.MsgType == nil && !f.Interface && (f.EnumType != nil || isTime || isPrimitive(f.Type))
+
+	switch {
+	case deltaNested(f) && f.Array:
+		buf.WriteString(fmt.Sprintf(`			if len(%[1]s) != len(%[2]s) {
+				%[3]s
+			} else {
+				for i := range %[1]s {
+					if !%[1]s[i].DeltaMask(ctx, &%[2]s[i]).Empty() {
+						%[3]s
+						break
+					}
+				}
+			}
+`, n, bn, set))
+	case deltaNested(f) && f.Pointer:
+		buf.WriteString(fmt.Sprintf(`			if (%[1]s == nil) != (%[2]s == nil) || (%[1]s != nil && !%[1]s.DeltaMask(ctx, %[2]s).Empty()) {
+				%[3]s
+			}
+`, n, bn, set))
+	case deltaNested(f):
+		buf.WriteString(fmt.Sprintf("\t\t\tif !%s.DeltaMask(ctx, &%s).Empty() {\n\t\t\t\t%s\n\t\t\t}\n", n, bn, set))
+	case !comparable:
+		buf.WriteString(fmt.Sprintf("\t\t\t%s // %s can't be compared, always sent\n", set, fieldTypeName(f)))
+	case f.Array && f.Type == ByteType:
+		buf.WriteString(fmt.Sprintf("\t\t\tif string(%s) != string(%s) {\n\t\t\t\t%s\n\t\t\t}\n", n, bn, set))
+	case f.Array:
+		differ := fmt.Sprintf("%s[i] != %s[i]", n, bn)
+		if isTime {
+			differ = fmt.Sprintf("!%s[i].Equal(%s[i])", n, bn)
+		}
+		buf.WriteString(fmt.Sprintf(`			if len(%[1]s) != len(%[2]s) {
+				%[3]s
+			} else {
+				for i := range %[1]s {
+					if %[4]s {
+						%[3]s
+						break
+					}
+				}
+			}
+`, n, bn, set, differ))
+	case isTime:
+		buf.WriteString(fmt.Sprintf("\t\t\tif !%s.Equal(%s) {\n\t\t\t\t%s\n\t\t\t}\n", n, bn, set))
+	default:
+		buf.WriteString(fmt.Sprintf("\t\t\tif %s != %s {\n\t\t\t\t%s\n\t\t\t}\n", n, bn, set))
+	}
+}
+
+func writeDeltaSerialize(f MessageField, buf *bytes.Buffer) {
+	n, bn := "m."+f.Name, "b."+f.Name
+	switch {
+	case deltaNested(f) && f.Array:
+		buf.WriteString(fmt.Sprintf(`			buffer.WriteUint32(uint32(len(%[1]s)))
+			for i := range %[1]s {
+				var eb ngen.Message
+				if i < len(%[2]s) {
+					eb = &%[2]s[i]
+				}
+				%[1]s[i].SerializeDelta(ctx, eb, buffer)
+			}
+`, n, bn))
+	case deltaNested(f) && f.Pointer:
+		buf.WriteString(fmt.Sprintf(`			if %[1]s != nil {
+				buffer.WriteBool(true)
+				%[1]s.SerializeDelta(ctx, %[2]s, buffer)
+			} else {
+				buffer.WriteBool(false)
+			}
+`, n, bn))
+	case deltaNested(f):
+		buf.WriteString(fmt.Sprintf("\t\t\t%s.SerializeDelta(ctx, &%s, buffer)\n", n, bn))
+	default:
+		WriteGoSerializeField(f, 1, buf)
+	}
+}
+
+func writeDeltaLen(f MessageField, buf *bytes.Buffer) {
+	n, bn := "m."+f.Name, "b."+f.Name
+	switch {
+	case deltaNested(f) && f.Array:
+		buf.WriteString(fmt.Sprintf(`			mylen += 4
+			for i := range %[1]s {
+				var eb ngen.Message
+				if i < len(%[2]s) {
+					eb = &%[2]s[i]
+				}
+				mylen += %[1]s[i].DeltaLength(ctx, eb)
+			}
+`, n, bn))
+	case deltaNested(f) && f.Pointer:
+		buf.WriteString(fmt.Sprintf(`			mylen++ // nil check
+			if %[1]s != nil {
+				mylen += %[1]s.DeltaLength(ctx, %[2]s)
+			}
+`, n, bn))
+	case deltaNested(f):
+		buf.WriteString(fmt.Sprintf("\t\t\tmylen += %s.DeltaLength(ctx, &%s)\n", n, bn))
+	default:
+		WriteGoLen(f, 1, buf)
+	}
+}
+
+func writeDeltaApply(f MessageField, buf *bytes.Buffer) {
+	n, bn := "m."+f.Name, "b."+f.Name
+	switch {
+	case deltaNested(f) && f.Array:
+		buf.WriteString(fmt.Sprintf(`			base%[3]d := %[2]s
+			%[1]s = make([]%[4]s, buffer.ReadUint32())
+			for i := range %[1]s {
+				var eb ngen.Message
+				if i < len(base%[3]d) {
+					eb = &base%[3]d[i]
+				}
+				%[1]s[i].ApplyDelta(ctx, eb, buffer)
+			}
+`, n, bn, f.Order, fieldTypeName(f)))
+	case deltaNested(f) && f.Pointer:
+		buf.WriteString(fmt.Sprintf(`			if buffer.ReadBool() {
+				sub := &%[3]s{}
+				sub.ApplyDelta(ctx, %[2]s, buffer)
+				%[1]s = sub
+			} else {
+				%[1]s = nil
+			}
+`, n, bn, fieldTypeName(f)))
+	case deltaNested(f):
+		buf.WriteString(fmt.Sprintf("\t\t\t%s.ApplyDelta(ctx, &%s, buffer)\n", n, bn))
+	default:
+		if (f.Pointer || f.Interface) && !f.Array {
+			// Only set when present, don't keep the baseline's value.
+			buf.WriteString(fmt.Sprintf("\t\t\t%s = nil\n", n))
+		}
+		WriteGoDeserialField(f, true, 1, buf)
+	}
+}
+
+func isPrimitive(t string) bool {
+	switch t {
+	case IntType, RuneType, BoolType, StringType, ByteType, Int16Type, Uint16Type,
+		Int32Type, Uint32Type, Int64Type, Uint64Type, Float32Type, Float64Type:
+		return true
+	}
+	return false
+}
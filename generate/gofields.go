@@ -0,0 +1,121 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// CheckFieldOptions returns why the default and required options of msg's fields can't be used, if they can't.
+// Both only apply to versioned fields, defaults can be set on fields of basic and enum types.
+func CheckFieldOptions(msg Message) error {
+	for _, f := range msg.Fields {
+		if (f.Default != "" || f.Required) && !msg.Versioned {
+			return fmt.Errorf("field %s.%s has default or required options without being versioned", msg.Name, f.Name)
+		}
+		if f.Default != "" {
+			if _, err := DefaultValue(f); err != nil {
+				return fmt.Errorf("field %s.%s: %s", msg.Name, f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultValue returns the Go expression of the default value of f.
+func DefaultValue(f MessageField) (string, error) {
+	v := f.Default
+	if f.Array || f.Pointer || f.MsgType != nil || f.Interface {
+		return "", fmt.Errorf("default %q not supported for type %s", v, goFieldName(f))
+	}
+	var err error
+	switch f.Type {
+	case BoolType:
+		_, err = strconv.ParseBool(v)
+	case StringType:
+		return strconv.Quote(v), nil
+	case IntType, RuneType, Int32Type:
+		_, err = strconv.ParseInt(v, 0, 32)
+	case Int16Type:
+		_, err = strconv.ParseInt(v, 0, 16)
+	case Int64Type:
+		_, err = strconv.ParseInt(v, 0, 64)
+	case ByteType:
+		_, err = strconv.ParseUint(v, 0, 8)
+	case Uint16Type:
+		_, err = strconv.ParseUint(v, 0, 16)
+	case Uint32Type:
+		_, err = strconv.ParseUint(v, 0, 32)
+	case Uint64Type:
+		_, err = strconv.ParseUint(v, 0, 64)
+	case Float32Type, Float64Type:
+		bits := 64
+		if f.Type == Float32Type {
+			bits = 32
+		}
+		var fv float64
+		if fv, err = strconv.ParseFloat(v, bits); err == nil && (math.IsInf(fv, 0) || math.IsNaN(fv)) {
+			err = fmt.Errorf("%q is not a finite number", v)
+		}
+	default:
+		if f.EnumType == nil {
+			return "", fmt.Errorf("default %q not supported for type %s", v, goFieldName(f))
+		}
+		if _, err = strconv.ParseInt(v, 0, 32); err == nil {
+			return fmt.Sprintf("%s(%s)", goFieldName(f), v), nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid default %q for type %s", v, f.Type)
+	}
+	return v, nil
+}
+
+func hasDefaults(msg Message) bool {
+	for _, f := range msg.Fields {
+		if f.Default != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredFields returns the orders of the required fields of msg.
+func requiredFields(msg Message) []int {
+	var orders []int
+	for _, f := range msg.Fields {
+		if f.Required {
+			orders = append(orders, f.Order)
+		}
+	}
+	return orders
+}
+
+// writeGoPresence writes the HasX accessors of a versioned message and, if it has defaults,
+// setDefaults to fill in the fields the sender doesn't have.
+func writeGoPresence(msg Message, buf *bytes.Buffer) {
+	for _, f := range msg.Fields {
+		buf.WriteString(fmt.Sprintf(`
+// Has%[2]s reports whether a sender with the Context ctx writes %[2]s.
+func (m %[1]s) Has%[2]s(ctx *ngen.Context) bool {
+	return ctx.Present(%[1]sMsgType).Has(%[3]d)
+}
+`, msg.Name, f.Name, f.Order))
+	}
+	if !hasDefaults(msg) {
+		return
+	}
+	buf.WriteString(fmt.Sprintf(`
+// setDefaults sets the fields with defaults that aren't present.
+func (m *%[1]s) setDefaults(present ngen.FieldMask) {
+`, msg.Name))
+	for _, f := range msg.Fields {
+		if f.Default == "" {
+			continue
+		}
+		v, _ := DefaultValue(f)
+		buf.WriteString(fmt.Sprintf("\tif !present.Has(%d) {\n\t\tm.%s = %s\n\t}\n", f.Order, f.Name, v))
+	}
+	buf.WriteString("}\n")
+}
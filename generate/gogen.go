@@ -3,11 +3,14 @@ package generate
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/lologarithm/netgen/lib/ngen"
 )
 
 var goTime = time.Now()
@@ -52,14 +55,58 @@ func GoLibHeader(pkg *ParsedPkg) string {
 		}
 	}
 
+	// Packages with versioned messages also get delta serialization, see GoDelta,
+	// and describe their fields so remotes can skip the ones they don't know.
+	readers := "Read: Read"
+	wirebuf := &bytes.Buffer{}
+	if HasVersioned(pkg) {
+		readers = "Read: Read, ReadDelta: ReadDelta"
+		wirebuf.WriteString("WireTypes: map[ngen.MessageType][][]byte{\n")
+		for _, msg := range pkg.Messages {
+			wirebuf.WriteString(fmt.Sprintf("\t\t\t%d: {", MessageID(msg)))
+			for _, f := range msg.Fields {
+				wirebuf.WriteString("{")
+				for _, b := range wireType(f) {
+					wirebuf.WriteString(fmt.Sprintf("%d,", b))
+				}
+				wirebuf.WriteString("},")
+			}
+			wirebuf.WriteString("},\n")
+		}
+		wirebuf.WriteString("\t\t},\n\t\t")
+	}
+
+	// Remotes without the required fields fail the handshake, see ngen.Context.CheckRequired.
+	requiredbuf := &bytes.Buffer{}
+	for _, msg := range pkg.Messages {
+		if orders := requiredFields(msg); len(orders) > 0 {
+			requiredbuf.WriteString(fmt.Sprintf("\t\t\t%d: {", MessageID(msg)))
+			for _, o := range orders {
+				requiredbuf.WriteString(fmt.Sprintf("%d,", o))
+			}
+			requiredbuf.WriteString("},\n")
+		}
+	}
+	if requiredbuf.Len() > 0 {
+		wirebuf.WriteString(fmt.Sprintf("Required: map[ngen.MessageType][]byte{\n%s\t\t},\n\t\t", requiredbuf.String()))
+	}
+
+	// Remotes compare the layout of every message, see ngen.Context.CompareSchemas.
+	schemabuf := &bytes.Buffer{}
+	for _, msg := range pkg.Messages {
+		schemabuf.WriteString(fmt.Sprintf("\t\t\t%d: %d,\n", MessageID(msg), Fingerprint(msg)))
+	}
+
 	// TODO: Add the Read/Write/Length functions attached to the settings
 	gobuf.WriteString(fmt.Sprintf(`var Context = &ngen.Context {
 		FieldVersions: map[ngen.MessageType][]byte{
 			%s
 		},
-		Read: Read,
+		Schemas: map[ngen.MessageType]uint32{
+%s		},
+		%s%s,
 	}
-`, fldbuf.String()))
+`, fldbuf.String(), schemabuf.String(), wirebuf.String(), readers))
 
 	// 1. List type values!
 	gobuf.WriteString("const (\n")
@@ -76,7 +123,7 @@ func GoLibHeader(pkg *ParsedPkg) string {
 func Read(ctx *ngen.Context, msgType ngen.MessageType, content *ngen.Buffer) ngen.Message {
 	switch msgType {
 		case ngen.MessageTypeContext:
-			return ngen.DeserializeContext(&ngen.Context{Read: Read}, content)
+			return ngen.DeserializeContext(&ngen.Context{%s}, content)
 %s
 		default:
 			return nil
@@ -91,54 +138,98 @@ func Read(ctx *ngen.Context, msgType ngen.MessageType, content *ngen.Buffer) nge
 	for _, t := range pkg.Messages {
 		caseBuffer.WriteString(fmt.Sprintf(caseTemplate, t.Name, t.Name))
 	}
-	gobuf.WriteString(fmt.Sprintf(readFunc, caseBuffer.String()))
+	gobuf.WriteString(fmt.Sprintf(readFunc, readers, caseBuffer.String()))
+	gobuf.WriteString(GoInterfaceReaders(pkg))
+
+	return gobuf.String()
+}
 
+// GoInterfaceReaders returns a Read<Interface> function for each interface of pkg used by a field, that reads
+// the messages implementing it from any parsed package. Other message types are read with the Context, which
+// knows the messages of every package registered in an ngen.Registry, and set ngen.ErrUnknownType if they
+// don't implement the interface.
+func GoInterfaceReaders(pkg *ParsedPkg) string {
+	names := make([]string, 0, len(pkg.Interfaces))
+	for name := range pkg.Interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	gobuf := &bytes.Buffer{}
+	for _, name := range names {
+		cases := &bytes.Buffer{}
+		for _, impl := range pkg.Interfaces[name] {
+			qual := ""
+			if impl.Package != pkg.Name {
+				qual = impl.Package + "."
+			}
+			cases.WriteString(fmt.Sprintf("\tcase %[1]s%[2]sMsgType:\n\t\tmsg := %[1]sDeserialize%[2]s(ctx, content)\n\t\treturn &msg\n", qual, impl.Name))
+		}
+		gobuf.WriteString(fmt.Sprintf(`
+// Read%[1]s reads a message of msgType implementing %[1]s.
+func Read%[1]s(ctx *ngen.Context, msgType ngen.MessageType, content *ngen.Buffer) %[1]s {
+	switch msgType {
+%[2]s	}
+	if ctx != nil && ctx.Read != nil {
+		if msg, ok := ctx.Read(ctx, msgType, content).(%[1]s); ok {
+			return msg
+		}
+	}
+	content.Err = ngen.ErrUnknownType
+	return nil
+}
+`, name, cases.String()))
+	}
 	return gobuf.String()
 }
 
-// GoSerializers returns the generated code of Serialize, Len, and MessageType for the input msg
+// GoSerializers returns the generated code of Serialize, Len, and MessageType for the input msg.
+// Versioned messages are written with the local fields in order, the remote reads them
+// with the field versions it got in the handshake. Remotes without wire types get the fields
+// in the order of their field versions instead, see ngen.Context.LegacyFields.
 func GoSerializers(msg Message) string {
 	gobuf := &bytes.Buffer{}
 	gobuf.WriteString(fmt.Sprintf("\n\nfunc (m %s) Serialize(ctx *ngen.Context, buffer *ngen.Buffer) error {\n", msg.Name))
 	if msg.Versioned {
-		// If versioned we need to switch on the field indexes
 		fldSwitch := &bytes.Buffer{}
 		for _, f := range msg.Fields {
 			fldSwitch.WriteString(fmt.Sprintf("\t\t\tcase %d:\n", f.Order))
 			WriteGoSerializeField(f, 1, fldSwitch)
 		}
 		gobuf.WriteString(fmt.Sprintf(
-			`	for _, fld := range ctx.FieldVersions[%d] {
-		switch fld {
-%s		}
+			`	if versions, ok := ctx.LegacyFields(%d); ok {
+		for _, fld := range versions {
+			switch fld {
+%s			}
 		}
+		return buffer.Err
+	}
 `, MessageID(msg), fldSwitch.String()))
-	} else {
-		for _, f := range msg.Fields {
-			WriteGoSerializeField(f, 1, gobuf)
-		}
+	}
+	for _, f := range msg.Fields {
+		WriteGoSerializeField(f, 1, gobuf)
 	}
 
 	gobuf.WriteString("\n\treturn buffer.Err\n}\n")
 	// TODO: Write the router Len function.
 	gobuf.WriteString(fmt.Sprintf("\nfunc (m %s) Length(ctx *ngen.Context) int {\n\tmylen := 0\n", msg.Name))
 	if msg.Versioned {
-		// If versioned we need to switch on the field indexes
 		fldSwitch := &bytes.Buffer{}
 		for _, f := range msg.Fields {
 			fldSwitch.WriteString(fmt.Sprintf("\t\t\tcase %d:\n", f.Order))
 			WriteGoLen(f, 1, fldSwitch)
 		}
 		gobuf.WriteString(fmt.Sprintf(
-			`	for _, fld := range ctx.FieldVersions[%d] {
+			`	if versions, ok := ctx.LegacyFields(%d); ok {
+		for _, fld := range versions {
 			switch fld {
-	%s		}
-			}
-	`, MessageID(msg), fldSwitch.String()))
-	} else {
-		for _, f := range msg.Fields {
-			WriteGoLen(f, 1, gobuf)
+%s			}
 		}
+		return mylen
+	}
+`, MessageID(msg), fldSwitch.String()))
+	}
+	for _, f := range msg.Fields {
+		WriteGoLen(f, 1, gobuf)
 	}
 	gobuf.WriteString("\treturn mylen\n}\n\n")
 
@@ -150,7 +241,9 @@ func GoSerializers(msg Message) string {
 	return gobuf.String()
 }
 
-// GoDeserializers returns the generated code of Deserialize
+// GoDeserializers returns the generated code of Deserialize.
+// Versioned messages read the fields in the order of the sender's field versions and skip
+// the ones that aren't known locally.
 func GoDeserializers(msg Message) string {
 	gobuf := &bytes.Buffer{}
 	gobuf.WriteString(fmt.Sprintf("\nfunc Deserialize%s(ctx *ngen.Context, buffer *ngen.Buffer) (m %s) {\n", msg.Name, msg.Name))
@@ -162,17 +255,25 @@ func GoDeserializers(msg Message) string {
 			WriteGoDeserialField(f, true, 4, fldSwitch)
 		}
 		gobuf.WriteString(fmt.Sprintf(
-			`	for _, fld := range ctx.FieldVersions[%d] {
+			`	for i, fld := range ctx.FieldVersions[%[1]d] {
 		switch fld {
-%s		}
+%[2]s		default:
+			ctx.SkipField(%[1]d, i, buffer)
+		}
 		}
 `, MessageID(msg), fldSwitch.String()))
+		if hasDefaults(msg) {
+			gobuf.WriteString(fmt.Sprintf("\tm.setDefaults(ctx.Present(%sMsgType))\n", msg.Name))
+		}
 	} else {
 		for _, f := range msg.Fields {
 			WriteGoDeserialField(f, true, 1, gobuf)
 		}
 	}
 	gobuf.WriteString("\treturn m\n}\n")
+	if msg.Versioned {
+		writeGoPresence(msg, gobuf)
+	}
 	return gobuf.String()
 }
 
@@ -187,7 +288,12 @@ func WriteGoLen(f MessageField, scopeDepth int, buf *bytes.Buffer) {
 	if f.Array && f.Type != ByteType { // array handling for non-byte type
 		buf.WriteString("mylen += 4\n\t")
 		fn := "v" + strconv.Itoa(scopeDepth+1)
-		buf.WriteString(fmt.Sprintf("for _, %s := range %s {\n", fn, n))
+		if fixedLen(f) {
+			// Element length doesn't depend on the value.
+			buf.WriteString(fmt.Sprintf("for range %s {\n", n))
+		} else {
+			buf.WriteString(fmt.Sprintf("for _, %s := range %s {\n", fn, n))
+		}
 		mf := f
 		mf.Array = false
 		mf.Name = fn
@@ -243,6 +349,59 @@ func WriteGoLen(f MessageField, scopeDepth int, buf *bytes.Buffer) {
 	buf.WriteString(fmt.Sprintf(" // %s, Type: %s\n", n, goFieldName(f)))
 }
 
+// fixedLen reports whether the serialized length of a field is the same for every value.
+func fixedLen(f MessageField) bool {
+	switch f.Type {
+	case BoolType, ByteType, Uint16Type, Int16Type, Uint32Type, Int32Type, RuneType, IntType, Float32Type,
+		Uint64Type, Int64Type, Float64Type:
+		return true
+	}
+	return f.EnumType != nil || (f.RemotePackage == "time" && f.Type == "Time")
+}
+
+// wireType describes how f is encoded for the remote to skip it, see ngen.WireFixed8.
+// Fields of types from other packages aren't described.
+func wireType(f MessageField) []byte {
+	var w []byte
+	if f.Array && f.Type != ByteType {
+		w = append(w, ngen.WireArray)
+	}
+	if f.Interface {
+		return append(w, ngen.WireInterface)
+	}
+	if f.Pointer {
+		w = append(w, ngen.WireOptional)
+	}
+	switch f.Type {
+	case ByteType:
+		if f.Array {
+			return append(w, ngen.WireBytes)
+		}
+		return append(w, ngen.WireFixed8)
+	case BoolType:
+		return append(w, ngen.WireFixed8)
+	case Uint16Type, Int16Type:
+		return append(w, ngen.WireFixed16)
+	case Uint32Type, Int32Type, RuneType, IntType, Float32Type:
+		return append(w, ngen.WireFixed32)
+	case Uint64Type, Int64Type, Float64Type:
+		return append(w, ngen.WireFixed64)
+	case StringType:
+		return append(w, ngen.WireBytes)
+	}
+	switch {
+	case f.RemotePackage == "time" && f.Type == "Time":
+		return append(w, ngen.WireFixed64)
+	case f.EnumType != nil:
+		return append(w, ngen.WireFixed32)
+	case f.MsgType != nil && f.RemotePackage == "":
+		id := make([]byte, 4)
+		ngen.PutUint32(id, MessageID(*f.MsgType))
+		return append(append(w, ngen.WireMessage), id...)
+	}
+	return nil
+}
+
 func writeArrayLen(f MessageField, scopeDepth int, buf *bytes.Buffer) {
 	name := f.Name
 	if scopeDepth == 1 {
@@ -367,7 +526,7 @@ func WriteGoDeserialField(f MessageField, includeM bool, scopeDepth int, buf *by
 		buf.WriteString(lname)
 		buf.WriteString("; i++ {\n")
 		fn := ""
-		if scopeDepth == 1 {
+		if includeM {
 			fn += "m."
 		}
 		fn += f.Name + "[i]"
@@ -459,7 +618,11 @@ func writeInterDeserial(buf *bytes.Buffer, f MessageField, scopeDepth int) {
 		buf.WriteString("m.")
 	}
 	buf.WriteString(f.Name)
-	buf.WriteString(fmt.Sprintf(" = Read(ctx, ngen.MessageType(%s), buffer).(%s)\n", mt, f.Type))
+	pkg := ""
+	if f.RemotePackage != "" {
+		pkg = f.RemotePackage + "."
+	}
+	buf.WriteString(fmt.Sprintf(" = %sRead%s(ctx, ngen.MessageType(%s), buffer)\n", pkg, f.Type, mt))
 	writeTabScope(buf, scopeDepth)
 	buf.WriteString("}\n")
 }
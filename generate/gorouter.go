@@ -0,0 +1,48 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// GoRouter returns the generated code of a typed Router for all messages in the package.
+// The Router wraps client.Mux so handlers can be registered with their concrete message types.
+// It is in a file of its own, ngenRouter.go, so it is the only generated code importing the client package.
+func GoRouter(pkg *ParsedPkg) string {
+	gobuf := &bytes.Buffer{}
+	gobuf.WriteString(fmt.Sprintf(`%s
+package %s
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+)
+
+// Router dispatches incoming messages to typed handlers by message type.
+type Router struct {
+	*client.Mux
+}
+
+// NewRouter creates a Router with no handlers registered.
+func NewRouter() *Router {
+	return &Router{Mux: client.NewMux()}
+}
+`, HeaderComment(), pkg.Name))
+
+	for _, msg := range pkg.Messages {
+		gobuf.WriteString(fmt.Sprintf(`
+// On%[1]s registers the handler for %[1]s messages.
+func (r *Router) On%[1]s(h func(*client.Client, *%[1]s)) {
+	r.Handle(%[1]sMsgType, func(c *client.Client, msg ngen.Message) {
+		switch m := msg.(type) {
+		case *%[1]s:
+			h(c, m)
+		case %[1]s:
+			h(c, &m)
+		}
+	})
+}
+`, msg.Name))
+	}
+	return gobuf.String()
+}
@@ -0,0 +1,86 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// GoServices returns the generated rpc client stubs and dispatchers for all services in the package.
+func GoServices(pkg *ParsedPkg) string {
+	gobuf := &bytes.Buffer{}
+	gobuf.WriteString(fmt.Sprintf(`%s
+package %s
+
+import (
+	"context"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice/rpc"
+)
+`, HeaderComment(), pkg.Name))
+
+	for _, svc := range pkg.Services {
+		gobuf.WriteString("\nconst (\n")
+		for _, m := range svc.Methods {
+			gobuf.WriteString(fmt.Sprintf("\t%s%sMethod uint32 = %d\n", svc.Name, m.Name, MethodID(svc, m)))
+		}
+		gobuf.WriteString(")\n")
+
+		gobuf.WriteString(fmt.Sprintf(`
+// %[1]sClient calls %[1]s methods on the remote side of a rpc.Conn.
+type %[1]sClient struct {
+	conn *rpc.Conn
+}
+
+// New%[1]sClient creates a client for %[1]s using the given conn.
+func New%[1]sClient(conn *rpc.Conn) *%[1]sClient {
+	return &%[1]sClient{conn: conn}
+}
+`, svc.Name))
+
+		for _, m := range svc.Methods {
+			gobuf.WriteString(fmt.Sprintf(`
+// %[2]s calls %[1]s.%[2]s on the remote.
+func (s *%[1]sClient) %[2]s(ctx context.Context, req *%[3]s) (*%[4]s, error) {
+	resp, err := s.conn.Call(ctx, %[1]s%[2]sMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	switch m := resp.(type) {
+	case *%[4]s:
+		return m, nil
+	case %[4]s:
+		return &m, nil
+	}
+	return nil, rpc.ErrUnexpectedMessage
+}
+`, svc.Name, m.Name, m.Request, m.Response))
+		}
+
+		gobuf.WriteString(fmt.Sprintf(`
+// Register%[1]s serves calls to %[1]s arriving on conn using impl.
+func Register%[1]s(conn *rpc.Conn, impl %[1]s) {
+`, svc.Name))
+		for _, m := range svc.Methods {
+			gobuf.WriteString(fmt.Sprintf(`	conn.Register(%[1]s%[2]sMethod, func(ctx context.Context, msg ngen.Message) (ngen.Message, error) {
+		var req *%[3]s
+		switch m := msg.(type) {
+		case *%[3]s:
+			req = m
+		case %[3]s:
+			req = &m
+		default:
+			return nil, rpc.ErrUnexpectedMessage
+		}
+		resp, err := impl.%[2]s(ctx, req)
+		if err != nil || resp == nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+`, svc.Name, m.Name, m.Request))
+		}
+		gobuf.WriteString("}\n")
+	}
+	return gobuf.String()
+}
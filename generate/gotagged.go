@@ -0,0 +1,302 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// TaggedDirective marks a struct to also get the tagged encoding when put in its doc comment.
+const TaggedDirective = "//ngen:tagged"
+
+var wireNames = map[byte]string{
+	ngen.WireFixed8:  "ngen.WireFixed8",
+	ngen.WireFixed16: "ngen.WireFixed16",
+	ngen.WireFixed32: "ngen.WireFixed32",
+	ngen.WireFixed64: "ngen.WireFixed64",
+	ngen.WireBytes:   "ngen.WireBytes",
+}
+
+// HasTagged reports whether any message of the package is tagged.
+func HasTagged(pkg *ParsedPkg) bool {
+	for _, msg := range pkg.Messages {
+		if msg.Tagged {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTagged returns why msg can't be tagged, if it can't. Tagged messages are read without a Context,
+// so their fields are identified by the version orders and nested structs must be tagged too
+// unless they and everything in them is unversioned.
+func CheckTagged(msg Message) error {
+	if !msg.Versioned {
+		return fmt.Errorf("tagged struct %s must have versioned fields", msg.Name)
+	}
+	return checkTaggedFields(msg, map[string]bool{})
+}
+
+func checkTaggedFields(msg Message, seen map[string]bool) error {
+	seen[msg.Package+"."+msg.Name] = true
+	for _, f := range msg.Fields {
+		switch {
+		case f.Interface:
+			return fmt.Errorf("interface field %s.%s can't be in a tagged struct", msg.Name, f.Name)
+		case f.MsgType == nil || f.MsgType.Tagged || seen[f.MsgType.Package+"."+f.MsgType.Name]:
+		case f.MsgType.Versioned:
+			return fmt.Errorf("field %s.%s of a tagged struct is versioned struct %s which must be tagged too", msg.Name, f.Name, f.MsgType.Name)
+		default:
+			if err := checkTaggedFields(*f.MsgType, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GoTagged returns the generated tagged serialization of all tagged messages in the package, see ngen.TaggedMessage.
+func GoTagged(pkg *ParsedPkg) string {
+	gobuf := &bytes.Buffer{}
+	gobuf.WriteString(fmt.Sprintf("%s\npackage %s\n\nimport (\n\t\"github.com/lologarithm/netgen/lib/ngen\"", HeaderComment(), pkg.Name))
+	for _, imp := range fieldImports(pkg, func(msg Message) bool { return msg.Tagged }) {
+		gobuf.WriteString(fmt.Sprintf("\n\t\"%s\"", imp))
+	}
+	gobuf.WriteString("\n)\n\n")
+
+	cases := &bytes.Buffer{}
+	for _, msg := range pkg.Messages {
+		if msg.Tagged {
+			cases.WriteString(fmt.Sprintf(`	case %[1]sMsgType:
+		msg := DeserializeTagged%[1]s(content)
+		return &msg
+`, msg.Name))
+		}
+	}
+	gobuf.WriteString(fmt.Sprintf(`// ReadTagged reads a message of msgType written by SerializeTagged.
+func ReadTagged(msgType ngen.MessageType, content *ngen.Buffer) ngen.Message {
+	switch msgType {
+%s	default:
+		return nil
+	}
+}
+`, cases.String()))
+
+	for _, msg := range pkg.Messages {
+		if msg.Tagged {
+			writeGoTagged(msg, gobuf)
+		}
+	}
+	return gobuf.String()
+}
+
+// taggedWire returns the wire type the value of f is tagged with.
+func taggedWire(f MessageField) byte {
+	if !f.Array && !f.Pointer && fixedLen(f) {
+		return wireType(f)[0]
+	}
+	return ngen.WireBytes
+}
+
+// selfLength reports whether a WireBytes value already starts with its length.
+func selfLength(f MessageField) bool {
+	return f.Type == StringType && !f.Array || f.Type == ByteType && f.Array
+}
+
+func writeGoTagged(msg Message, buf *bytes.Buffer) {
+	buf.WriteString(fmt.Sprintf(`
+// SerializeTagged writes m with the tagged encoding.
+func (m %s) SerializeTagged(buffer *ngen.Buffer) error {
+	start := buffer.BeginLength()
+`, msg.Name))
+	for _, f := range msg.Fields {
+		wire := taggedWire(f)
+		buf.WriteString(fmt.Sprintf("\tbuffer.WriteTag(%d, %s)\n", f.Order, wireNames[wire]))
+		if wire != ngen.WireBytes || selfLength(f) {
+			writeTaggedSerialize(f, buf)
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("\tf%d := buffer.BeginLength()\n", f.Order))
+		writeTaggedSerialize(f, buf)
+		buf.WriteString(fmt.Sprintf("\tbuffer.EndLength(f%d)\n", f.Order))
+	}
+	buf.WriteString("\tbuffer.EndLength(start)\n\treturn buffer.Err\n}\n")
+
+	buf.WriteString(fmt.Sprintf(`
+// TaggedLength returns the length of m with the tagged encoding.
+func (m %s) TaggedLength() int {
+	mylen := 4
+`, msg.Name))
+	for _, f := range msg.Fields {
+		if taggedWire(f) == ngen.WireBytes && !selfLength(f) {
+			buf.WriteString("\tmylen += 2 + 4 // tag and length\n")
+		} else {
+			buf.WriteString("\tmylen += 2 // tag\n")
+		}
+		writeTaggedLen(f, buf)
+	}
+	buf.WriteString("\treturn mylen\n}\n")
+
+	// Missing fields get their defaults like with a sender that doesn't have them, required ones fail.
+	presence := ""
+	if hasDefaults(msg) || len(requiredFields(msg)) > 0 {
+		presence = "\tvar present ngen.FieldMask\n"
+	}
+	buf.WriteString(fmt.Sprintf(`
+// DeserializeTagged%[1]s reads a %[1]s written by SerializeTagged.
+// Fields that aren't known or changed their wire type are skipped.
+func DeserializeTagged%[1]s(buffer *ngen.Buffer) (m %[1]s) {
+	end := buffer.ReadLength()
+%[2]s	for {
+		fld, wire, ok := buffer.NextTag(end)
+		if !ok {
+			break
+		}
+		switch {
+`, msg.Name, presence))
+	for _, f := range msg.Fields {
+		wire := taggedWire(f)
+		buf.WriteString(fmt.Sprintf("\t\tcase fld == %d && wire == %s:\n", f.Order, wireNames[wire]))
+		if presence != "" {
+			buf.WriteString(fmt.Sprintf("\t\t\tpresent.Set(%d)\n", f.Order))
+		}
+		if wire != ngen.WireBytes || selfLength(f) {
+			writeTaggedDeserialize(f, buf)
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("\t\t\tend%d := buffer.ReadLength()\n", f.Order))
+		writeTaggedDeserialize(f, buf)
+		buf.WriteString(fmt.Sprintf("\t\t\tbuffer.SkipTo(end%d)\n", f.Order))
+	}
+	buf.WriteString("\t\tdefault:\n\t\t\tbuffer.SkipTag(wire)\n\t\t}\n\t}\n")
+	if hasDefaults(msg) {
+		buf.WriteString("\tm.setDefaults(present)\n")
+	}
+	for _, order := range requiredFields(msg) {
+		buf.WriteString(fmt.Sprintf("\tif !present.Has(%[1]d) && buffer.Err == nil {\n\t\tbuffer.Err = &ngen.RequiredError{Type: %[2]sMsgType, Order: %[1]d}\n\t}\n", order, msg.Name))
+	}
+	buf.WriteString("\treturn m\n}\n")
+}
+
+// taggedCalls returns the serialize, length and deserialize calls of a nested message:
+// its tagged encoding if it has one, the positional one without a Context otherwise.
+func taggedCalls(f MessageField) (serialize, length, deserialize string) {
+	pkg := ""
+	if f.RemotePackage != "" {
+		pkg = f.RemotePackage + "."
+	}
+	if f.MsgType.Tagged {
+		return "SerializeTagged(buffer)", "TaggedLength()", fmt.Sprintf("%sDeserializeTagged%s(buffer)", pkg, f.Type)
+	}
+	return "Serialize(nil, buffer)", "Length(nil)", fmt.Sprintf("%sDeserialize%s(nil, buffer)", pkg, f.Type)
+}
+
+// minTaggedSize is the fewest bytes a value of f takes in a tagged message.
+func minTaggedSize(f MessageField) int {
+	switch {
+	case f.Array:
+		return 4 // count or length
+	case f.Pointer, f.Interface:
+		return 1 // nil check
+	case f.MsgType != nil && f.MsgType.Tagged:
+		return 4 // length
+	case f.MsgType != nil:
+		size := 0
+		for _, sub := range f.MsgType.Fields {
+			size += minTaggedSize(sub)
+		}
+		return size
+	}
+	switch w := wireType(f); {
+	case len(w) == 0:
+		return 0
+	case w[0] == ngen.WireFixed8:
+		return 1
+	case w[0] == ngen.WireFixed16:
+		return 2
+	case w[0] == ngen.WireFixed64:
+		return 8
+	default:
+		return 4
+	}
+}
+
+func writeTaggedSerialize(f MessageField, buf *bytes.Buffer) {
+	if f.MsgType == nil {
+		WriteGoSerializeField(f, 1, buf)
+		return
+	}
+	serialize, _, _ := taggedCalls(f)
+	n := "m." + f.Name
+	tabs := "\t"
+	if f.Array {
+		buf.WriteString(fmt.Sprintf("\tbuffer.WriteUint32(uint32(len(%s)))\n\tfor _, v := range %s {\n", n, n))
+		n, tabs = "v", "\t\t"
+	}
+	one := fmt.Sprintf("%s.%s", n, serialize)
+	if f.Pointer {
+		buf.WriteString(fmt.Sprintf("%[1]sif %[2]s != nil {\n%[1]s\tbuffer.WriteBool(true)\n%[1]s\t%[3]s\n%[1]s} else {\n%[1]s\tbuffer.WriteBool(false)\n%[1]s}\n", tabs, n, one))
+	} else {
+		buf.WriteString(fmt.Sprintf("%s%s\n", tabs, one))
+	}
+	if f.Array {
+		buf.WriteString("\t}\n")
+	}
+}
+
+func writeTaggedLen(f MessageField, buf *bytes.Buffer) {
+	if f.MsgType == nil {
+		WriteGoLen(f, 1, buf)
+		return
+	}
+	_, length, _ := taggedCalls(f)
+	n := "m." + f.Name
+	tabs := "\t"
+	if f.Array {
+		buf.WriteString(fmt.Sprintf("\tmylen += 4\n\tfor _, v := range %s {\n", n))
+		n, tabs = "v", "\t\t"
+	}
+	if f.Pointer {
+		buf.WriteString(fmt.Sprintf("%[1]smylen++ // nil check\n%[1]sif %[2]s != nil {\n%[1]s\tmylen += %[2]s.%[3]s\n%[1]s}\n", tabs, n, length))
+	} else {
+		buf.WriteString(fmt.Sprintf("%smylen += %s.%s\n", tabs, n, length))
+	}
+	if f.Array {
+		buf.WriteString("\t}\n")
+	}
+}
+
+func writeTaggedDeserialize(f MessageField, buf *bytes.Buffer) {
+	n, tabs := "m."+f.Name, "\t\t\t"
+	if f.Array && f.Type != ByteType {
+		// Tagged data comes from anywhere, only allocate elements the buffer can hold.
+		ptr := ""
+		if f.Pointer {
+			ptr = "*"
+		}
+		elem := f
+		elem.Array = false
+		buf.WriteString(fmt.Sprintf("\t\t\t%s = make([]%s%s, buffer.ReadCount(%d))\n\t\t\tfor i := range %s {\n", n, ptr, fieldTypeName(f), minTaggedSize(elem), n))
+		n, tabs = n+"[i]", "\t\t\t\t"
+		if f.MsgType == nil {
+			elem.Name = n
+			WriteGoDeserialField(elem, false, 4, buf)
+			buf.WriteString("\t\t\t}\n")
+			return
+		}
+	}
+	if f.MsgType == nil {
+		WriteGoDeserialField(f, true, 3, buf)
+		return
+	}
+	_, _, deserialize := taggedCalls(f)
+	if f.Pointer {
+		buf.WriteString(fmt.Sprintf("%[1]sif buffer.ReadBool() {\n%[1]s\tv := %[2]s\n%[1]s\t%[3]s = &v\n%[1]s}\n", tabs, deserialize, n))
+	} else {
+		buf.WriteString(fmt.Sprintf("%s%s = %s\n", tabs, n, deserialize))
+	}
+	if f.Array {
+		buf.WriteString("\t\t\t}\n")
+	}
+}
@@ -0,0 +1,122 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+)
+
+// TypesFile is the name of the Go type definitions generated from a schema.
+const TypesFile = "ngenTypes.go"
+
+// GoTypes returns the Go definitions of the messages, enums and services of a package read from a schema,
+// so the rest of the generated code has types to work on. Interfaces used by fields become interfaces
+// of ngen.Message.
+func GoTypes(pkg *ParsedPkg) (string, error) {
+	interfaces := map[string]bool{}
+	for name := range pkg.Interfaces {
+		interfaces[name] = true
+	}
+	for _, msg := range pkg.Messages {
+		for _, f := range msg.Fields {
+			switch {
+			case f.Interface && f.RemotePackage == "":
+				interfaces[f.Type] = true
+			case f.Interface, f.RemotePackage != "", f.MsgType != nil, f.EnumType != nil, isPrimitive(f.Type):
+			default:
+				return "", fmt.Errorf("field %s.%s has unknown type %s", msg.Name, f.Name, f.Type)
+			}
+		}
+	}
+
+	gobuf := &bytes.Buffer{}
+	// Not HeaderComment, the parser skips files with it and these types are its input when generating the serializers.
+	gobuf.WriteString(fmt.Sprintf("// Code generated from a schema by netgen --gen=types on %s. DO NOT EDIT\npackage %s\n\nimport (\n",
+		goTime.Format("Jan 2 2006 15:04 MST"), pkg.Name))
+	if len(pkg.Services) > 0 {
+		gobuf.WriteString("\t\"context\"\n")
+	}
+	if len(interfaces) > 0 {
+		gobuf.WriteString("\t\"github.com/lologarithm/netgen/lib/ngen\"\n")
+	}
+	for _, imp := range fieldImports(pkg, func(Message) bool { return true }) {
+		gobuf.WriteString(fmt.Sprintf("\t\"%s\"\n", imp))
+	}
+	gobuf.WriteString(")\n")
+
+	for _, enum := range pkg.Enums {
+		typ := enum.Type
+		if typ == "" {
+			typ = Int32Type
+		}
+		gobuf.WriteString(fmt.Sprintf("\ntype %s %s\n", enum.Name, typ))
+		if len(enum.Values) == 0 {
+			continue
+		}
+		gobuf.WriteString("\nconst (\n")
+		for _, v := range enum.Values {
+			gobuf.WriteString(fmt.Sprintf("\t%s %s = %d\n", v.Name, enum.Name, v.Value))
+		}
+		gobuf.WriteString(")\n")
+	}
+
+	names := make([]string, 0, len(interfaces))
+	for name := range interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gobuf.WriteString(fmt.Sprintf("\ntype %s interface {\n\tngen.Message\n}\n", name))
+	}
+
+	for _, msg := range pkg.Messages {
+		gobuf.WriteString("\n")
+		if msg.Tagged {
+			gobuf.WriteString(TaggedDirective + "\n")
+		}
+		if msg.ID != 0 && msg.ID != nameID(msg.Name) {
+			gobuf.WriteString(fmt.Sprintf("%s %d\n", IDDirective, msg.ID))
+		}
+		gobuf.WriteString(fmt.Sprintf("type %s struct {\n", msg.Name))
+		for _, f := range msg.Fields {
+			if f.Embedded {
+				gobuf.WriteString(fmt.Sprintf("\t%s", fieldTypeString(f)))
+			} else {
+				gobuf.WriteString(fmt.Sprintf("\t%s %s", f.Name, fieldTypeString(f)))
+			}
+			if msg.Versioned {
+				gobuf.WriteString(fmt.Sprintf(" `ngen:\"%s\"`", fieldTag(f)))
+			}
+			gobuf.WriteString("\n")
+		}
+		gobuf.WriteString("}\n")
+	}
+
+	for _, svc := range pkg.Services {
+		gobuf.WriteString(fmt.Sprintf("\ntype %s interface {\n", svc.Name))
+		for _, m := range svc.Methods {
+			gobuf.WriteString(fmt.Sprintf("\t%s(ctx context.Context, req *%s) (*%s, error)\n", m.Name, m.Request, m.Response))
+		}
+		gobuf.WriteString("}\n")
+	}
+
+	src, err := format.Source(gobuf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("invalid Go types: %s", err)
+	}
+	return string(src), nil
+}
+
+// fieldTag is the value of the ngen tag of a versioned field.
+func fieldTag(f MessageField) string {
+	tag := []string{fmt.Sprint(f.Order)}
+	if f.Required {
+		tag = append(tag, "required")
+	}
+	if f.Default != "" {
+		tag = append(tag, "default="+f.Default)
+	}
+	return strings.Join(tag, ",")
+}
@@ -0,0 +1,49 @@
+package generate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoTypes(t *testing.T) {
+	root, _, err := ReadSchema([]byte(`{"packages": [{"name": "game", "messages": [
+		{"name": "Vec", "fields": [{"name": "X", "type": "float32"}, {"name": "Y", "type": "float32"}]},
+		{"name": "Player", "versioned": true, "tagged": true, "fields": [
+			{"name": "Name", "type": "string", "order": 1, "required": true},
+			{"name": "Pos", "type": "Vec", "order": 2, "pointer": true},
+			{"name": "Speed", "type": "float64", "order": 3, "default": "1.5"},
+			{"name": "Kind", "type": "Kind", "order": 4},
+			{"name": "Seen", "type": "Time", "package": "time", "order": 5, "array": true}
+		]}],
+		"enums": [{"name": "Kind", "type": "uint8", "values": [{"name": "Human", "value": 0}, {"name": "Robot", "value": 1}]}]
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := GoTypes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"package game\n",
+		"\t\"time\"\n",
+		"type Kind uint8\n",
+		"\tRobot Kind = 1\n",
+		"type Vec struct {\n\tX float32\n\tY float32\n}\n",
+		"//ngen:tagged\ntype Player struct {\n",
+		"\tName  string      `ngen:\"1,required\"`\n",
+		"\tPos   *Vec        `ngen:\"2\"`\n",
+		"\tSpeed float64     `ngen:\"3,default=1.5\"`\n",
+		"\tKind  Kind        `ngen:\"4\"`\n",
+		"\tSeen  []time.Time `ngen:\"5\"`\n",
+	} {
+		if !strings.Contains(types, expected) {
+			t.Errorf("expected %q in the types:\n%s", expected, types)
+		}
+	}
+
+	root.Messages[0].Fields[0].Type = "Vector"
+	if _, err := GoTypes(root); err == nil {
+		t.Errorf("expected an error for a field of unknown type")
+	}
+}
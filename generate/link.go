@@ -0,0 +1,171 @@
+package generate
+
+import (
+	"fmt"
+	"go/ast"
+	"sort"
+)
+
+// Link connects the fields of all messages in pkgs, keyed by package name, to their message and enum types,
+// collects the imports they need and validates the messages and services.
+func Link(pkgs map[string]*ParsedPkg) error {
+	// Validates strut field versions and connects message type pointers.
+	for _, pkg := range pkgs {
+		for _, msg := range pkg.Messages {
+			if msg.Versioned {
+				sort.Slice(msg.Fields, func(i int, j int) bool {
+					return msg.Fields[i].Order < msg.Fields[j].Order
+				})
+				seen := map[int]bool{}
+				for _, f := range msg.Fields {
+					if ok := seen[f.Order]; ok {
+						return fmt.Errorf("duplicate field IDs on versioned struct: %s", msg.Name)
+					}
+					seen[f.Order] = true
+				}
+			}
+			for i, mf := range msg.Fields {
+				fieldPkg := mf.RemotePackage
+				if fieldPkg == "" {
+					fieldPkg = msg.Package
+				}
+				opkg := pkgs[fieldPkg]
+				if mf.RemotePackage != "" {
+					if opkg == nil {
+						// Hopefully its just a system package.
+						pkg.Imports[mf.RemotePackage] = struct{}{}
+					} else {
+						// Only include remote packages.
+						pkg.Imports[opkg.Pkg.ImportPath] = struct{}{}
+					}
+				}
+				if opkg != nil {
+					omsg, hasMessage := opkg.MessageMap[mf.Type]
+					if hasMessage {
+						msg.Fields[i].MsgType = &omsg
+						continue
+					}
+					oen, ok := opkg.EnumMap[mf.Type]
+					if ok {
+						msg.Fields[i].EnumType = &oen
+						continue
+					}
+				}
+			}
+		}
+	}
+
+	// Interfaces of fields get a reader, that reads nothing if no implementers are known.
+	for _, pkg := range pkgs {
+		for _, msg := range pkg.Messages {
+			for _, f := range msg.Fields {
+				owner := pkgs[msg.Package]
+				if f.RemotePackage != "" {
+					owner = pkgs[f.RemotePackage]
+				}
+				if !f.Interface || owner == nil {
+					continue
+				}
+				if owner.Interfaces == nil {
+					owner.Interfaces = map[string][]Message{}
+				}
+				if _, ok := owner.Interfaces[f.Type]; !ok {
+					owner.Interfaces[f.Type] = nil
+				}
+			}
+		}
+	}
+	for _, pkg := range pkgs {
+		for _, impls := range pkg.Interfaces {
+			for _, impl := range impls {
+				if opkg := pkgs[impl.Package]; impl.Package != pkg.Name && opkg != nil {
+					pkg.Imports[opkg.Pkg.ImportPath] = struct{}{}
+				}
+			}
+		}
+	}
+
+	for _, pkg := range pkgs {
+		if err := CheckInterfaceReaders(pkg); err != nil {
+			return err
+		}
+	}
+
+	if err := CheckMessageIDs(pkgs); err != nil {
+		return err
+	}
+
+	for _, pkg := range pkgs {
+		for _, msg := range pkg.Messages {
+			if err := CheckFieldOptions(msg); err != nil {
+				return fmt.Errorf("invalid ngen field tag: %s", err)
+			}
+			if !msg.Tagged {
+				continue
+			}
+			if err := CheckTagged(msg); err != nil {
+				return fmt.Errorf("invalid tagged struct: %s", err)
+			}
+		}
+	}
+
+	for _, pkg := range pkgs {
+		for _, svc := range pkg.Services {
+			for _, m := range svc.Methods {
+				for _, name := range []string{m.Request, m.Response} {
+					if _, ok := pkg.MessageMap[name]; !ok {
+						return fmt.Errorf("service %s.%s uses %s which is not a message in package %s", svc.Name, m.Name, name, pkg.Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckInterfaceReaders checks that the Read<Interface> functions generated for the interfaces of pkg don't
+// collide with the other generated code or a declaration of the package.
+func CheckInterfaceReaders(pkg *ParsedPkg) error {
+	declared := map[string]bool{"Read": true, "ReadDelta": true, "ReadTagged": true, "Context": true}
+	for _, msg := range pkg.Messages {
+		declared[msg.Name] = true
+		declared[msg.Name+"MsgType"] = true
+		declared["Deserialize"+msg.Name] = true
+	}
+	for _, enum := range pkg.Enums {
+		declared[enum.Name] = true
+	}
+	for _, f := range pkg.Files {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					declared[d.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, s := range d.Specs {
+					switch s := s.(type) {
+					case *ast.TypeSpec:
+						declared[s.Name.Name] = true
+					case *ast.ValueSpec:
+						for _, n := range s.Names {
+							declared[n.Name] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(pkg.Interfaces))
+	for name := range pkg.Interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if declared["Read"+name] {
+			return fmt.Errorf("the reader of interface %s.%s collides with %s.Read%s", pkg.Name, name, pkg.Name, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package generate
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// SchemaFile is the name of the schema written next to the generated code with `--gen=schema`.
+const SchemaFile = "ngenSchema.json"
+
+// Schema describes the messages of a package and of the packages it uses, so code can be generated
+// without the Go source. It is the JSON written by WriteSchema.
+type Schema struct {
+	Packages []SchemaPackage `json:"packages"` // the described package first
+}
+
+// SchemaPackage is a package in a Schema.
+type SchemaPackage struct {
+	Name     string          `json:"name"`
+	Path     string          `json:"path,omitempty"` // import path
+	Messages []SchemaMessage `json:"messages"`
+	Enums    []SchemaEnum    `json:"enums,omitempty"`
+	Services []SchemaService `json:"services,omitempty"`
+	// Interfaces lists the messages implementing each interface of the package used by fields.
+	Interfaces []SchemaInterface `json:"interfaces,omitempty"`
+}
+
+// SchemaMessage is a Message in a Schema.
+type SchemaMessage struct {
+	Name      string        `json:"name"`
+	ID        uint32        `json:"id,omitempty"` // message type on the wire, see MessageID and Message.ID
+	Versioned bool          `json:"versioned,omitempty"`
+	Tagged    bool          `json:"tagged,omitempty"`
+	Fields    []SchemaField `json:"fields"`
+}
+
+// SchemaField is a MessageField in a Schema. Type is a Go basic type, time.Time, or a message or
+// enum of the package, or of Package if it is set.
+type SchemaField struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Package   string `json:"package,omitempty"`
+	Order     int    `json:"order"`
+	Array     bool   `json:"array,omitempty"`
+	Pointer   bool   `json:"pointer,omitempty"`
+	Embedded  bool   `json:"embedded,omitempty"`
+	Interface bool   `json:"interface,omitempty"`
+	Default   string `json:"default,omitempty"`
+	Required  bool   `json:"required,omitempty"`
+}
+
+// SchemaInterface is an interface in a Schema, see ParsedPkg.Interfaces. Implementers of other packages
+// are qualified with the package name.
+type SchemaInterface struct {
+	Name         string   `json:"name"`
+	Implementers []string `json:"implementers"`
+}
+
+// SchemaEnum is an Enum in a Schema.
+type SchemaEnum struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type,omitempty"` // underlying integer type, int32 if empty
+	Values []SchemaEnumValue `json:"values,omitempty"`
+}
+
+// SchemaEnumValue is an EnumValue in a Schema.
+type SchemaEnumValue struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// SchemaService is a Service in a Schema.
+type SchemaService struct {
+	Name    string         `json:"name"`
+	Methods []SchemaMethod `json:"methods"`
+}
+
+// SchemaMethod is a ServiceMethod in a Schema.
+type SchemaMethod struct {
+	Name     string `json:"name"`
+	ID       uint32 `json:"id,omitempty"` // see MethodID
+	Request  string `json:"request"`
+	Response string `json:"response"`
+}
+
+// WriteSchema returns the schema of the package called name in pkgs, with the other parsed packages.
+func WriteSchema(pkgs map[string]*ParsedPkg, name string) ([]byte, error) {
+	root, ok := pkgs[name]
+	if !ok {
+		return nil, fmt.Errorf("no package %s", name)
+	}
+	schema := Schema{Packages: []SchemaPackage{schemaPackage(root)}}
+	names := []string{}
+	for n, pkg := range pkgs {
+		if n != name && pkg.Pkg != nil {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		schema.Packages = append(schema.Packages, schemaPackage(pkgs[n]))
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func schemaPackage(pkg *ParsedPkg) SchemaPackage {
+	sp := SchemaPackage{Name: pkg.Name, Path: pkg.Pkg.ImportPath, Messages: []SchemaMessage{}}
+	if sp.Path == "." {
+		sp.Path = "" // outside of GOPATH
+	}
+	for _, msg := range pkg.Messages {
+		sm := SchemaMessage{
+			Name:      msg.Name,
+			ID:        MessageID(msg),
+			Versioned: msg.Versioned,
+			Tagged:    msg.Tagged,
+			Fields:    []SchemaField{},
+		}
+		for _, f := range msg.Fields {
+			sm.Fields = append(sm.Fields, SchemaField{
+				Name:      f.Name,
+				Type:      f.Type,
+				Package:   f.RemotePackage,
+				Order:     f.Order,
+				Array:     f.Array,
+				Pointer:   f.Pointer,
+				Embedded:  f.Embedded,
+				Interface: f.Interface,
+				Default:   f.Default,
+				Required:  f.Required,
+			})
+		}
+		sp.Messages = append(sp.Messages, sm)
+	}
+	for _, enum := range pkg.Enums {
+		se := SchemaEnum{Name: enum.Name, Type: enum.Type}
+		for _, v := range enum.Values {
+			se.Values = append(se.Values, SchemaEnumValue{Name: v.Name, Value: v.Value})
+		}
+		sp.Enums = append(sp.Enums, se)
+	}
+	for _, svc := range pkg.Services {
+		ss := SchemaService{Name: svc.Name}
+		for _, m := range svc.Methods {
+			ss.Methods = append(ss.Methods, SchemaMethod{Name: m.Name, ID: MethodID(svc, m), Request: m.Request, Response: m.Response})
+		}
+		sp.Services = append(sp.Services, ss)
+	}
+	names := make([]string, 0, len(pkg.Interfaces))
+	for name := range pkg.Interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		si := SchemaInterface{Name: name, Implementers: []string{}}
+		for _, impl := range pkg.Interfaces[name] {
+			if impl.Package != pkg.Name {
+				si.Implementers = append(si.Implementers, impl.Package+"."+impl.Name)
+			} else {
+				si.Implementers = append(si.Implementers, impl.Name)
+			}
+		}
+		sp.Interfaces = append(sp.Interfaces, si)
+	}
+	return sp
+}
+
+// ReadSchema reads a schema written by WriteSchema. Like parsing the Go source it returns the described
+// package and all packages keyed by name, linked with Link.
+// Message ids in the schema are kept, without one a message gets the id of its name.
+// Method ids are optional, if set they must be the ones netgen gives the methods.
+func ReadSchema(data []byte) (*ParsedPkg, map[string]*ParsedPkg, error) {
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, nil, err
+	}
+	if len(schema.Packages) == 0 {
+		return nil, nil, fmt.Errorf("schema has no packages")
+	}
+	pkgs := map[string]*ParsedPkg{}
+	for _, sp := range schema.Packages {
+		if _, ok := pkgs[sp.Name]; ok {
+			return nil, nil, fmt.Errorf("package %s is in the schema twice", sp.Name)
+		}
+		pkg := &ParsedPkg{
+			Name:       sp.Name,
+			Pkg:        &build.Package{Name: sp.Name, ImportPath: sp.Path},
+			Imports:    map[string]struct{}{},
+			Messages:   []Message{},
+			Enums:      []Enum{},
+			MessageMap: map[string]Message{},
+			EnumMap:    map[string]Enum{},
+			Interfaces: map[string][]Message{},
+		}
+		for _, sm := range sp.Messages {
+			if !exported(sm.Name) {
+				return nil, nil, fmt.Errorf("message %s.%s must have an exported Go name", sp.Name, sm.Name)
+			}
+			msg := Message{Name: sm.Name, Package: sp.Name, Versioned: sm.Versioned, Tagged: sm.Tagged, ID: sm.ID}
+			for i, sf := range sm.Fields {
+				if !sf.Embedded && !exported(sf.Name) {
+					return nil, nil, fmt.Errorf("field %s.%s must have an exported Go name", sm.Name, sf.Name)
+				}
+				if !sm.Versioned {
+					sf.Order = i // fields of unversioned messages are in the order they are listed
+				}
+				msg.Fields = append(msg.Fields, MessageField{
+					Name:          sf.Name,
+					Type:          sf.Type,
+					RemotePackage: sf.Package,
+					Order:         sf.Order,
+					Array:         sf.Array,
+					Pointer:       sf.Pointer,
+					Embedded:      sf.Embedded,
+					Interface:     sf.Interface,
+					Default:       sf.Default,
+					Required:      sf.Required,
+				})
+			}
+			pkg.Messages = append(pkg.Messages, msg)
+			pkg.MessageMap[msg.Name] = msg
+		}
+		for _, se := range sp.Enums {
+			if !exported(se.Name) {
+				return nil, nil, fmt.Errorf("enum %s.%s must have an exported Go name", sp.Name, se.Name)
+			}
+			if !isEnumType(se.Type) {
+				return nil, nil, fmt.Errorf("enum %s.%s has type %s, it must be an integer type", sp.Name, se.Name, se.Type)
+			}
+			enum := Enum{Name: se.Name, Type: se.Type}
+			for _, v := range se.Values {
+				enum.Values = append(enum.Values, EnumValue{Name: v.Name, Value: v.Value})
+			}
+			pkg.Enums = append(pkg.Enums, enum)
+			pkg.EnumMap[enum.Name] = enum
+		}
+		for _, ss := range sp.Services {
+			if !exported(ss.Name) {
+				return nil, nil, fmt.Errorf("service %s.%s must have an exported Go name", sp.Name, ss.Name)
+			}
+			svc := Service{Name: ss.Name, Package: sp.Name}
+			for _, sm := range ss.Methods {
+				if !exported(sm.Name) {
+					return nil, nil, fmt.Errorf("method %s.%s must have an exported Go name", ss.Name, sm.Name)
+				}
+				m := ServiceMethod{Name: sm.Name, Request: sm.Request, Response: sm.Response}
+				if id := MethodID(svc, m); sm.ID != 0 && sm.ID != id {
+					return nil, nil, fmt.Errorf("method %s.%s has id %d, netgen gives it %d", ss.Name, sm.Name, sm.ID, id)
+				}
+				svc.Methods = append(svc.Methods, m)
+			}
+			pkg.Services = append(pkg.Services, svc)
+		}
+		pkgs[pkg.Name] = pkg
+	}
+	for _, sp := range schema.Packages {
+		for _, si := range sp.Interfaces {
+			impls := []Message{}
+			for _, name := range si.Implementers {
+				pkgName, msgName := sp.Name, name
+				if i := strings.LastIndex(name, "."); i >= 0 {
+					pkgName, msgName = name[:i], name[i+1:]
+				}
+				var msg Message
+				ok := false
+				if pkg := pkgs[pkgName]; pkg != nil {
+					msg, ok = pkg.MessageMap[msgName]
+				}
+				if !ok {
+					return nil, nil, fmt.Errorf("implementer %s of interface %s.%s isn't a message", name, sp.Name, si.Name)
+				}
+				impls = append(impls, msg)
+			}
+			pkgs[sp.Name].Interfaces[si.Name] = impls
+		}
+	}
+	if err := Link(pkgs); err != nil {
+		return nil, nil, err
+	}
+	return pkgs[schema.Packages[0].Name], pkgs, nil
+}
+
+// exported reports whether name can be the name of an exported Go declaration.
+func exported(name string) bool {
+	return token.IsIdentifier(name) && token.IsExported(name)
+}
+
+// isEnumType checks t is an integer type enums can have, empty for the default int32.
+func isEnumType(t string) bool {
+	switch t {
+	case "", IntType, RuneType, ByteType, "int8", "uint", "uint8", Int16Type, Uint16Type, Int32Type, Uint32Type, Int64Type, Uint64Type:
+		return true
+	}
+	return false
+}
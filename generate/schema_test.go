@@ -0,0 +1,94 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaRoundTrip(t *testing.T) {
+	vec := Message{Name: "Vec", Package: "models", Fields: []MessageField{
+		{Name: "X", Type: Float32Type, Order: 0},
+		{Name: "Y", Type: Float32Type, Order: 1},
+	}}
+	player := Message{Name: "Player", Package: "models", Versioned: true, Tagged: true, Fields: []MessageField{
+		{Name: "Name", Type: StringType, Order: 1, Required: true},
+		{Name: "Pos", Type: "Vec", Order: 2},
+		{Name: "Hits", Type: IntType, Order: 3, Array: true},
+		{Name: "Speed", Type: Float64Type, Order: 4, Default: "1.5"},
+		{Name: "Seen", Type: "Time", RemotePackage: "time", Order: 5},
+	}}
+	box := Message{Name: "Box", Package: "models", Fields: []MessageField{{Name: "Item", Type: "Thing", Interface: true}}}
+	pkg := compatPkg(vec, player, box)
+	pkg.Interfaces = map[string][]Message{"Thing": {vec, player}}
+	pkg.Name = "models"
+	pkg.Pkg = &build.Package{Name: "models", ImportPath: "example.com/models"}
+	pkg.Imports = map[string]struct{}{}
+	kind := Enum{Name: "Kind", Type: "uint8", Values: []EnumValue{{Name: "Human", Value: 0}, {Name: "Robot", Value: 2}}}
+	pkg.Enums = []Enum{kind}
+	pkg.EnumMap = map[string]Enum{"Kind": kind}
+	pkg.Services = []Service{{Name: "Game", Package: "models", Methods: []ServiceMethod{{Name: "Join", Request: "Player", Response: "Vec"}}}}
+	pkgs := map[string]*ParsedPkg{"models": pkg}
+	if err := Link(pkgs); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := WriteSchema(pkgs, "models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, read, err := ReadSchema(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != read["models"] || root.Pkg.ImportPath != "example.com/models" {
+		t.Fatalf("expected the models package first, got %#v", root.Pkg)
+	}
+	if changes := Compat(pkg, root); len(changes) != 0 {
+		t.Errorf("expected the same messages after reading the schema, got %v", changes)
+	}
+	for _, msg := range pkg.Messages {
+		if Fingerprint(msg) != Fingerprint(root.MessageMap[msg.Name]) {
+			t.Errorf("fingerprint of %s changed", msg.Name)
+		}
+	}
+	if p := root.MessageMap["Player"]; p.Fields[1].MsgType == nil || p.Fields[1].MsgType.Name != "Vec" {
+		t.Errorf("expected Player.Pos to be linked to Vec, got %#v", p.Fields[1])
+	}
+	if e := root.EnumMap["Kind"]; !reflect.DeepEqual(e, kind) || len(root.Enums) != 1 {
+		t.Errorf("expected enum %+v, got %+v", kind, e)
+	}
+	if impls := root.Interfaces["Thing"]; len(impls) != 2 || impls[0].Name != "Vec" || impls[1].Name != "Player" {
+		t.Errorf("expected the implementers of Thing, got %v", impls)
+	}
+	if GoLibHeader(pkg) != GoLibHeader(root) || GoServices(pkg) != GoServices(root) {
+		t.Errorf("expected the same generated code from the schema")
+	}
+
+	renamed := bytes.Replace(data, []byte(`"type": "Vec"`), []byte(`"type": "Vector"`), 1)
+	renamed = bytes.Replace(renamed, []byte(`"name": "Vec"`), []byte(`"name": "Vector"`), 1)
+	renamed = bytes.Replace(renamed, []byte(`"response": "Vec"`), []byte(`"response": "Vector"`), 1)
+	renamed = bytes.Replace(renamed, []byte(`"Vec",`), []byte(`"Vector",`), 1)
+	root, _, err = ReadSchema(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := MessageID(root.MessageMap["Vector"]); id != MessageID(vec) {
+		t.Errorf("expected the renamed message to keep its id %d, got %d", MessageID(vec), id)
+	}
+
+	collision := bytes.Replace(data, []byte(fmt.Sprintf(`"id": %d`, MessageID(vec))), []byte(fmt.Sprintf(`"id": %d`, MessageID(player))), 1)
+	if _, _, err := ReadSchema(collision); err == nil || !strings.Contains(err.Error(), "collides") {
+		t.Errorf("expected an error for colliding message ids, got %v", err)
+	}
+}
+
+func TestReadSchemaEnumType(t *testing.T) {
+	_, _, err := ReadSchema([]byte(`{"packages": [{"name": "game", "enums": [{"name": "Kind", "type": "float32"}]}]}`))
+	if err == nil || !strings.Contains(err.Error(), "must be an integer type") {
+		t.Errorf("expected an error for an enum of float type, got %v", err)
+	}
+}
@@ -26,6 +26,22 @@ func (b *Buffer) Reset() {
 	b.Err = nil
 }
 
+// Grow makes sure there are at least n bytes after Loc to write into.
+// Buf is reallocated if needed, keeping everything before Loc.
+func (b *Buffer) Grow(n int) {
+	need := int(b.Loc) + n
+	if need <= len(b.Buf) {
+		return
+	}
+	if need <= cap(b.Buf) {
+		b.Buf = b.Buf[:cap(b.Buf)]
+		return
+	}
+	buf := make([]byte, need*2)
+	copy(buf, b.Buf[:b.Loc])
+	b.Buf = buf
+}
+
 // READ FUNCS
 
 // ReadBool will read next byte from buffer and increment read location
@@ -162,6 +178,17 @@ func (b *Buffer) ReadFloat64() float64 {
 	return v
 }
 
+// ReadCount reads the uint32 count of an array whose elements take at least size bytes each.
+// A count the rest of the buffer can't hold sets io.EOF and reads as zero, so it isn't allocated.
+func (b *Buffer) ReadCount(size uint32) uint32 {
+	n := b.ReadUint32()
+	if b.Err == nil && uint64(n)*uint64(size) > uint64(len(b.Buf)-int(b.Loc)) {
+		b.Err = io.EOF
+		return 0
+	}
+	return n
+}
+
 func (b *Buffer) ReadString() string {
 	if b.Err != nil {
 		return ""
@@ -169,6 +196,7 @@ func (b *Buffer) ReadString() string {
 	l := b.ReadUint32()
 	if len(b.Buf) < int(b.Loc+l) {
 		b.Err = io.EOF
+		return ""
 	}
 	v := string(b.Buf[b.Loc : b.Loc+l])
 	b.Loc += l
@@ -193,6 +221,10 @@ func (b *Buffer) readByteSlice(length uint32) []byte {
 	if length == 0 {
 		return nil
 	}
+	if len(b.Buf) < int(b.Loc+length) {
+		b.Err = io.EOF
+		return nil
+	}
 	v := make([]byte, length)
 	copy(v, b.Buf[b.Loc:b.Loc+length])
 	b.Loc += length
@@ -332,7 +364,16 @@ func (b *Buffer) WriteFloat64(v float64) {
 }
 
 func (b *Buffer) WriteString(v string) {
-	b.WriteByteSlice([]byte(v))
+	b.WriteUint32(uint32(len(v)))
+	if b.Err != nil || len(v) == 0 {
+		return
+	}
+	if len(b.Buf) < int(b.Loc)+len(v) {
+		b.Err = io.EOF
+		return
+	}
+	copy(b.Buf[b.Loc:], v) // copy directly to avoid allocating a []byte
+	b.Loc += uint32(len(v))
 }
 
 func (b *Buffer) WriteByteSlice(v []byte) {
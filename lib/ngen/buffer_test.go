@@ -115,3 +115,46 @@ func TestBasicBuffer(t *testing.T) {
 		t.Fatalf("Failed to read string back out of buffer: %#v, %s", buf, buf.Err)
 	}
 }
+
+func TestBufferGrow(t *testing.T) {
+	buf := NewBuffer(make([]byte, 2, 8))
+	buf.WriteUint16(7)
+	buf.Grow(4)
+	if len(buf.Buf) != 8 {
+		t.Fatalf("Expected Grow to use existing capacity, got len %d", len(buf.Buf))
+	}
+	buf.Grow(10)
+	buf.WriteString("hello")
+	buf.WriteUint32(1)
+	if buf.Err != nil {
+		t.Fatalf("Failed to write to grown buffer: %s", buf.Err)
+	}
+	buf.Reset()
+	if buf.ReadUint16() != 7 || buf.ReadString() != "hello" {
+		t.Fatalf("Grow didn't keep written bytes: %#v, %s", buf, buf.Err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	buf := GetBuffer(10)
+	if len(buf.Buf) < 10 || buf.Loc != 0 || buf.Err != nil {
+		t.Fatalf("Unexpected buffer from pool: len %d, %#v", len(buf.Buf), buf)
+	}
+	buf.WriteUint16(1)
+	PutBuffer(buf)
+
+	big := GetBuffer(DefaultBufferSize * 4)
+	if len(big.Buf) < DefaultBufferSize*4 || big.Loc != 0 {
+		t.Fatalf("Pool returned too small buffer: len %d", len(big.Buf))
+	}
+	PutBuffer(big)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		b := GetBuffer(64)
+		b.WriteString("no allocations")
+		PutBuffer(b)
+	})
+	if allocs != 0 {
+		t.Fatalf("Expected pooled writes to not allocate, got %v allocs", allocs)
+	}
+}
@@ -0,0 +1,76 @@
+package ngen
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNoDelta is returned by a DeltaReader for message types without delta serialization.
+var ErrNoDelta = errors.New("ngen: message type has no delta serialization")
+
+// DeltaMessage is implemented by generated messages with versioned fields.
+// A delta holds only the fields that differ from a baseline message of the same type,
+// base may be the message, a pointer to it or nil for the zero value.
+type DeltaMessage interface {
+	Message
+	DeltaMask(ctx *Context, base Message) FieldMask
+	SerializeDelta(ctx *Context, base Message, buffer *Buffer) error
+	DeltaLength(ctx *Context, base Message) int
+}
+
+// DeltaReader applies a delta of msgType read from buffer to base and returns the new message.
+type DeltaReader func(ctx *Context, msgType MessageType, base Message, buffer *Buffer) (Message, error)
+
+// FieldMask has a bit for each versioned field order. Deltas start with the mask of changed fields.
+type FieldMask [32]byte
+
+// Set marks the field with the given order.
+func (m *FieldMask) Set(order byte) {
+	m[order/8] |= 1 << (order % 8)
+}
+
+// Has reports whether the field with the given order is marked.
+func (m FieldMask) Has(order byte) bool {
+	return m[order/8]&(1<<(order%8)) != 0
+}
+
+// Empty reports whether no field is marked.
+func (m FieldMask) Empty() bool {
+	return m == FieldMask{}
+}
+
+// used returns the number of bytes up to the last marked field.
+func (m FieldMask) used() int {
+	n := len(m)
+	for n > 0 && m[n-1] == 0 {
+		n--
+	}
+	return n
+}
+
+// Length returns the serialized size of the mask.
+func (m FieldMask) Length() int {
+	return 1 + m.used()
+}
+
+// Serialize writes the mask with a length byte, trailing empty bytes are left out.
+func (m FieldMask) Serialize(buf *Buffer) {
+	n := m.used()
+	buf.WriteByte(byte(n))
+	buf.writeByteSlice(m[:n])
+}
+
+// DeserializeFieldMask reads a mask written by FieldMask.Serialize.
+func DeserializeFieldMask(buf *Buffer) (m FieldMask) {
+	n := int(buf.ReadByte())
+	if buf.Err != nil {
+		return m
+	}
+	if n > len(m) || len(buf.Buf) < int(buf.Loc)+n {
+		buf.Err = io.EOF
+		return m
+	}
+	copy(m[:], buf.Buf[buf.Loc:int(buf.Loc)+n])
+	buf.Loc += uint32(n)
+	return m
+}
@@ -0,0 +1,50 @@
+package ngen
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RequiredError is the handshake error for a remote that doesn't have a field marked required locally,
+// and the error of tagged messages read without one.
+type RequiredError struct {
+	Type  MessageType
+	Order byte
+}
+
+func (e *RequiredError) Error() string {
+	return fmt.Sprintf("ngen: remote doesn't have required field %d of message type %d", e.Order, e.Type)
+}
+
+// Present returns the fields a sender with this Context writes in messages of type mt.
+// Versioned fields missing from it are left at their defaults when reading.
+func (c *Context) Present(mt MessageType) (mask FieldMask) {
+	for _, fld := range c.FieldVersions[mt] {
+		mask.Set(fld)
+	}
+	return mask
+}
+
+// CheckRequired returns a *RequiredError if the remote doesn't have one of the local Required fields.
+// Message types the remote doesn't know at all aren't checked, it never sends them.
+func (c *Context) CheckRequired(remote *Context) error {
+	types := make([]MessageType, 0, len(c.Required))
+	for mt := range c.Required {
+		types = append(types, mt)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	for _, mt := range types {
+		_, versioned := remote.FieldVersions[mt]
+		_, known := remote.Schemas[mt]
+		if !versioned && !known {
+			continue
+		}
+		present := remote.Present(mt)
+		for _, fld := range c.Required[mt] {
+			if !present.Has(fld) {
+				return &RequiredError{Type: mt, Order: fld}
+			}
+		}
+	}
+	return nil
+}
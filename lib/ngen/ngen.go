@@ -1,5 +1,7 @@
 package ngen
 
+import "io"
+
 // MessageType is the hash of a message to uniquely identify the type.
 type MessageType uint32
 
@@ -18,8 +20,20 @@ type Reader func(*Context, MessageType, *Buffer) Message
 // The current main use for this is to exchange versions of objects.
 type Context struct {
 	Read Reader
+	// ReadDelta applies deltas of versioned messages, see DeltaMessage.
+	ReadDelta DeltaReader
 
 	FieldVersions map[MessageType][]byte
+	// WireTypes describes the encoding of each field of the package's messages, in field order.
+	// Readers use the remote's to skip fields they don't know, see SkipField.
+	WireTypes map[MessageType][][]byte
+	// Schemas fingerprints the fields of each of the package's messages, see CompareSchemas.
+	Schemas map[MessageType]uint32
+	// Required lists the orders of the required fields of each message type. It is only used locally:
+	// a remote that doesn't have them fails the handshake, see CheckRequired.
+	Required map[MessageType][]byte
+	// Codecs names the compression codecs the sender can decompress, in order of preference.
+	Codecs []string
 
 	// FUTURE IDEA: negociate messages that don't need variable length
 	// then we can remove that value from every message.
@@ -29,11 +43,23 @@ type Context struct {
 // MessageTypeContext is the message type of the context object itself.
 const MessageTypeContext MessageType = 1
 
+// MaxReservedMessageType is the largest message type reserved for netgen's own frames
+// (context, rpc, control frames). Generated message types must be larger than this.
+const MaxReservedMessageType MessageType = 15
+
 // MsgType is to implement the Message interface
 func (v Context) MsgType() MessageType {
 	return MessageTypeContext // Context gets a special message type. It is number one!
 }
 
+// Sections of the context after the field versions, each a tag byte and a uint32 length.
+// Readers skip sections they don't know and older readers ignore them all.
+const (
+	sectionCodecs byte = iota + 1
+	sectionWireTypes
+	sectionSchemas
+)
+
 // Serialize will convert the settings to a byte slice
 func (v Context) Serialize(_ *Context, buf *Buffer) error {
 	buf.WriteUint32(uint32(len(v.FieldVersions)))
@@ -43,6 +69,36 @@ func (v Context) Serialize(_ *Context, buf *Buffer) error {
 		buf.WriteByte(byte(l)) // write len as byte to keep msg small
 		buf.writeByteSlice(fv)
 	}
+	if len(v.Codecs) > 0 {
+		buf.WriteByte(sectionCodecs)
+		buf.WriteUint32(uint32(v.codecsLength()))
+		buf.WriteByte(byte(len(v.Codecs)))
+		for _, name := range v.Codecs {
+			buf.WriteString(name)
+		}
+	}
+	if len(v.WireTypes) > 0 {
+		buf.WriteByte(sectionWireTypes)
+		buf.WriteUint32(uint32(v.wireTypesLength()))
+		buf.WriteUint32(uint32(len(v.WireTypes)))
+		for k, fields := range v.WireTypes {
+			buf.WriteUint32(uint32(k))
+			buf.WriteByte(byte(len(fields)))
+			for _, w := range fields {
+				buf.WriteByte(byte(len(w)))
+				buf.writeByteSlice(w)
+			}
+		}
+	}
+	if len(v.Schemas) > 0 {
+		buf.WriteByte(sectionSchemas)
+		buf.WriteUint32(uint32(v.schemasLength()))
+		buf.WriteUint32(uint32(len(v.Schemas)))
+		for k, fp := range v.Schemas {
+			buf.WriteUint32(uint32(k))
+			buf.WriteUint32(fp)
+		}
+	}
 	return buf.Err
 }
 
@@ -52,9 +108,41 @@ func (v Context) Length(_ *Context) int {
 	for _, fv := range v.FieldVersions {
 		total += 5 + len(fv) // Field key (4) + field length (1) + field values (len of array)
 	}
+	if len(v.Codecs) > 0 {
+		total += 5 + v.codecsLength()
+	}
+	if len(v.WireTypes) > 0 {
+		total += 5 + v.wireTypesLength()
+	}
+	if len(v.Schemas) > 0 {
+		total += 5 + v.schemasLength()
+	}
 	return total
 }
 
+func (v Context) codecsLength() int {
+	total := 1
+	for _, name := range v.Codecs {
+		total += 4 + len(name)
+	}
+	return total
+}
+
+func (v Context) wireTypesLength() int {
+	total := 4
+	for _, fields := range v.WireTypes {
+		total += 5 // Type (4) + field count (1)
+		for _, w := range fields {
+			total += 1 + len(w)
+		}
+	}
+	return total
+}
+
+func (v Context) schemasLength() int {
+	return 4 + 8*len(v.Schemas)
+}
+
 func (c *Context) Deserialize(ctx *Context, buf *Buffer) error {
 	*c = *DeserializeContext(ctx, buf)
 	return buf.Err
@@ -64,7 +152,8 @@ func (c *Context) Deserialize(ctx *Context, buf *Buffer) error {
 // Requires the existing context to clone reader/writer functions.
 func DeserializeContext(ctx *Context, b *Buffer) *Context {
 	s := &Context{
-		Read: ctx.Read,
+		Read:      ctx.Read,
+		ReadDelta: ctx.ReadDelta,
 	}
 	num := b.ReadInt()
 	s.FieldVersions = make(map[MessageType][]byte, num)
@@ -77,5 +166,43 @@ func DeserializeContext(ctx *Context, b *Buffer) *Context {
 		buf := b.readByteSlice(uint32(v))
 		s.FieldVersions[MessageType(k)] = buf
 	}
+	for b.Err == nil && int(b.Loc) < len(b.Buf) {
+		tag := b.ReadByte()
+		l := b.ReadUint32()
+		if b.Err != nil || len(b.Buf)-int(b.Loc) < int(l) {
+			b.Err = io.EOF
+			break
+		}
+		section := NewBuffer(b.Buf[b.Loc : b.Loc+l])
+		b.Loc += l
+		switch tag {
+		case sectionCodecs:
+			n := int(section.ReadByte())
+			for i := 0; i < n && section.Err == nil; i++ {
+				s.Codecs = append(s.Codecs, section.ReadString())
+			}
+		case sectionWireTypes:
+			n := int(section.ReadUint32())
+			s.WireTypes = make(map[MessageType][][]byte)
+			for i := 0; i < n && section.Err == nil; i++ {
+				k := MessageType(section.ReadUint32())
+				fields := make([][]byte, section.ReadByte())
+				for j := range fields {
+					fields[j] = section.readByteSlice(uint32(section.ReadByte()))
+				}
+				s.WireTypes[k] = fields
+			}
+		case sectionSchemas:
+			n := int(section.ReadUint32())
+			s.Schemas = make(map[MessageType]uint32)
+			for i := 0; i < n && section.Err == nil; i++ {
+				k := MessageType(section.ReadUint32())
+				s.Schemas[k] = section.ReadUint32()
+			}
+		}
+		if section.Err != nil {
+			b.Err = section.Err
+		}
+	}
 	return s
 }
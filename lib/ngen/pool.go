@@ -0,0 +1,36 @@
+package ngen
+
+import "sync"
+
+// DefaultBufferSize is the capacity of new pooled buffers.
+const DefaultBufferSize = 4096
+
+// MaxPooledBuffer is the largest buffer PutBuffer will keep.
+// Larger buffers are left for the GC so one huge message doesn't pin memory.
+const MaxPooledBuffer = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &Buffer{Buf: make([]byte, DefaultBufferSize)}
+	},
+}
+
+// GetBuffer returns an empty Buffer from the pool with at least size bytes in Buf.
+// Return it with PutBuffer once the bytes are no longer referenced.
+func GetBuffer(size int) *Buffer {
+	b := bufferPool.Get().(*Buffer)
+	if cap(b.Buf) < size {
+		b.Buf = make([]byte, size)
+	}
+	b.Buf = b.Buf[:cap(b.Buf)]
+	b.Reset()
+	return b
+}
+
+// PutBuffer returns b to the pool. Neither b nor its bytes may be used afterwards.
+func PutBuffer(b *Buffer) {
+	if b == nil || cap(b.Buf) > MaxPooledBuffer {
+		return
+	}
+	bufferPool.Put(b)
+}
@@ -0,0 +1,120 @@
+package ngen
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoMessages is returned when a registered Context has no message types, so nothing would be read with it.
+var ErrNoMessages = errors.New("ngen: registered Context has no message types")
+
+// ConflictError is returned when a registered Context has a message type of another one.
+type ConflictError struct {
+	Type MessageType
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("ngen: message type %d is in more than one registered package", e.Type)
+}
+
+// Registry combines the Contexts of generated packages, so one Context reads the messages of all of them.
+// The message types of a package are the ones in its Context's Schemas and FieldVersions.
+// Interface fields read through the Context too, so they can hold messages of any registered package.
+// Register every package before using the Context, a Registry isn't safe to change while reading.
+type Registry struct {
+	ctx   *Context
+	types map[MessageType]*Context // Context of the package of each message type
+}
+
+// NewRegistry returns a Registry of the given package Contexts, see Add.
+func NewRegistry(contexts ...*Context) (*Registry, error) {
+	r := &Registry{types: map[MessageType]*Context{}}
+	r.ctx = &Context{
+		Read:          r.Read,
+		ReadDelta:     r.ReadDelta,
+		FieldVersions: map[MessageType][]byte{},
+		Schemas:       map[MessageType]uint32{},
+	}
+	for _, c := range contexts {
+		if err := r.Add(c); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Add registers the Context of a package. Returns a *ConflictError without registering anything if the
+// package has a message type that is already registered, and ErrNoMessages if it has none.
+func (r *Registry) Add(c *Context) error {
+	if c == nil || len(c.Schemas) == 0 && len(c.FieldVersions) == 0 {
+		return ErrNoMessages
+	}
+	types := map[MessageType]bool{}
+	for mt := range c.Schemas {
+		types[mt] = true
+	}
+	for mt := range c.FieldVersions {
+		types[mt] = true
+	}
+	for mt := range types {
+		if _, ok := r.types[mt]; ok {
+			return &ConflictError{Type: mt}
+		}
+	}
+	for mt := range types {
+		r.types[mt] = c
+	}
+
+	for mt, fields := range c.FieldVersions {
+		r.ctx.FieldVersions[mt] = fields
+	}
+	for mt, fp := range c.Schemas {
+		r.ctx.Schemas[mt] = fp
+	}
+	for mt, wire := range c.WireTypes {
+		if r.ctx.WireTypes == nil {
+			r.ctx.WireTypes = map[MessageType][][]byte{}
+		}
+		r.ctx.WireTypes[mt] = wire
+	}
+	for mt, orders := range c.Required {
+		if r.ctx.Required == nil {
+			r.ctx.Required = map[MessageType][]byte{}
+		}
+		r.ctx.Required[mt] = orders
+	}
+	for mt, size := range c.FixedSizeMessages {
+		if r.ctx.FixedSizeMessages == nil {
+			r.ctx.FixedSizeMessages = map[MessageType]int{}
+		}
+		r.ctx.FixedSizeMessages[mt] = size
+	}
+	return nil
+}
+
+// Context returns the Context of all registered packages. It reads with the Registry, also the
+// Contexts of remotes that it reads.
+func (r *Registry) Context() *Context {
+	return r.ctx
+}
+
+// Read is the Reader of the registered packages. Returns nil for message types that aren't registered.
+func (r *Registry) Read(ctx *Context, msgType MessageType, content *Buffer) Message {
+	if msgType == MessageTypeContext {
+		return DeserializeContext(r.ctx, content)
+	}
+	c, ok := r.types[msgType]
+	if !ok || c.Read == nil {
+		return nil
+	}
+	return c.Read(ctx, msgType, content)
+}
+
+// ReadDelta is the DeltaReader of the registered packages.
+func (r *Registry) ReadDelta(ctx *Context, msgType MessageType, base Message, content *Buffer) (Message, error) {
+	c, ok := r.types[msgType]
+	if !ok || c.ReadDelta == nil {
+		return nil, ErrNoDelta
+	}
+	return c.ReadDelta(ctx, msgType, base, content)
+}
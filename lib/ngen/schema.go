@@ -0,0 +1,79 @@
+package ngen
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MismatchKind is why a message type can't be exchanged with a remote.
+type MismatchKind byte
+
+const (
+	// MismatchMissingRemote means the remote doesn't know the message type and can't read it.
+	MismatchMissingRemote MismatchKind = iota + 1
+	// MismatchMissingLocal means the remote has a message type this side can't read.
+	MismatchMissingLocal
+	// MismatchLayout means both sides have the message type with different fields and at least
+	// one side doesn't version it, so neither can read the other's.
+	MismatchLayout
+)
+
+func (k MismatchKind) String() string {
+	switch k {
+	case MismatchMissingRemote:
+		return "unknown to remote"
+	case MismatchMissingLocal:
+		return "unknown locally"
+	case MismatchLayout:
+		return "different fields"
+	}
+	return fmt.Sprintf("MismatchKind(%d)", byte(k))
+}
+
+// SchemaMismatch is a message type that can't be exchanged with a remote.
+type SchemaMismatch struct {
+	Type MessageType
+	Kind MismatchKind
+}
+
+func (m SchemaMismatch) String() string {
+	return fmt.Sprintf("message type %d: %s", m.Type, m.Kind)
+}
+
+// Sends reports whether messages of this type can still be sent to the remote.
+func (m SchemaMismatch) Sends() bool {
+	return m.Kind == MismatchMissingLocal
+}
+
+// Receives reports whether messages of this type from the remote can still be read.
+func (m SchemaMismatch) Receives() bool {
+	return m.Kind == MismatchMissingRemote
+}
+
+// CompareSchemas returns the message types that can't be exchanged with the remote, by type.
+// Versioned messages with different fields are fine as long as both sides version them.
+// Nothing is reported if either side has no Schemas, for example a remote built before they existed.
+func (c *Context) CompareSchemas(remote *Context) []SchemaMismatch {
+	if len(c.Schemas) == 0 || len(remote.Schemas) == 0 {
+		return nil
+	}
+	var mismatches []SchemaMismatch
+	for mt, fp := range c.Schemas {
+		rfp, ok := remote.Schemas[mt]
+		_, versioned := c.FieldVersions[mt]
+		_, remoteVersioned := remote.FieldVersions[mt]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, SchemaMismatch{Type: mt, Kind: MismatchMissingRemote})
+		case fp != rfp && !(versioned && remoteVersioned):
+			mismatches = append(mismatches, SchemaMismatch{Type: mt, Kind: MismatchLayout})
+		}
+	}
+	for mt := range remote.Schemas {
+		if _, ok := c.Schemas[mt]; !ok {
+			mismatches = append(mismatches, SchemaMismatch{Type: mt, Kind: MismatchMissingLocal})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Type < mismatches[j].Type })
+	return mismatches
+}
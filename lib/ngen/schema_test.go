@@ -0,0 +1,34 @@
+package ngen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareSchemas(t *testing.T) {
+	local := &Context{
+		FieldVersions: map[MessageType][]byte{20: {1, 2}},
+		Schemas:       map[MessageType]uint32{16: 1, 17: 1, 18: 1, 20: 1},
+	}
+	remote := &Context{
+		FieldVersions: map[MessageType][]byte{20: {1, 3}},
+		Schemas:       map[MessageType]uint32{16: 1, 17: 2, 19: 1, 20: 2},
+	}
+
+	// The remote's Context as it is read in the handshake.
+	buf := NewBuffer(make([]byte, remote.Length(nil)))
+	remote.Serialize(nil, buf)
+	remote = DeserializeContext(local, NewBuffer(buf.Buf))
+
+	expected := []SchemaMismatch{
+		{Type: 17, Kind: MismatchLayout},
+		{Type: 18, Kind: MismatchMissingRemote},
+		{Type: 19, Kind: MismatchMissingLocal},
+	}
+	if m := local.CompareSchemas(remote); !reflect.DeepEqual(m, expected) {
+		t.Fatalf("Expected %v, got %v", expected, m)
+	}
+	if m := local.CompareSchemas(&Context{}); m != nil {
+		t.Fatalf("Expected nothing compared without remote schemas, got %v", m)
+	}
+}
@@ -0,0 +1,98 @@
+package ngen
+
+import "io"
+
+// TaggedMessage is implemented by generated messages marked with //ngen:tagged.
+//
+// The tagged encoding doesn't need a Context to be read: it is a uint32 length followed by the fields,
+// each written as its order byte, its wire type byte and the value. Fixed size values use WireFixed8
+// to WireFixed64, everything else is WireBytes with a uint32 length in front. Readers skip fields
+// they don't know or whose wire type changed, so it can be read by any version of the struct,
+// for example after being written to disk.
+type TaggedMessage interface {
+	Message
+	SerializeTagged(buffer *Buffer) error
+	TaggedLength() int
+}
+
+// TaggedReader reads a message of msgType written by SerializeTagged.
+type TaggedReader func(msgType MessageType, buffer *Buffer) Message
+
+// WriteTag writes the key of a tagged field.
+func (b *Buffer) WriteTag(order byte, wire byte) {
+	b.WriteByte(order)
+	b.WriteByte(wire)
+}
+
+// BeginLength reserves a uint32 length for the value written next and returns its location for EndLength.
+func (b *Buffer) BeginLength() uint32 {
+	start := b.Loc
+	b.WriteUint32(0)
+	return start
+}
+
+// EndLength fills in the length reserved by BeginLength with everything written since.
+func (b *Buffer) EndLength(start uint32) {
+	if b.Err != nil {
+		return
+	}
+	PutUint32(b.Buf[start:], b.Loc-start-4)
+}
+
+// ReadLength reads a uint32 length and returns the location where the value ends.
+func (b *Buffer) ReadLength() uint32 {
+	n := b.ReadUint32()
+	if b.Err != nil {
+		return b.Loc
+	}
+	if n > b.remaining() {
+		b.Err = io.EOF
+		return b.Loc
+	}
+	return b.Loc + n
+}
+
+// NextTag reads the key of the next tagged field before end, ok is false once all fields are read.
+func (b *Buffer) NextTag(end uint32) (order byte, wire byte, ok bool) {
+	if b.Err != nil || b.Loc == end {
+		return 0, 0, false
+	}
+	if b.Loc > end {
+		b.Err = io.ErrUnexpectedEOF // The last field was longer than the message.
+		return 0, 0, false
+	}
+	order, wire = b.ReadByte(), b.ReadByte()
+	return order, wire, b.Err == nil
+}
+
+// SkipTo moves to end, where a value read with ReadLength ends, past anything the reader didn't read.
+func (b *Buffer) SkipTo(end uint32) {
+	if b.Err != nil {
+		return
+	}
+	if b.Loc > end {
+		b.Err = io.ErrUnexpectedEOF
+		return
+	}
+	b.Loc = end
+}
+
+// SkipTag skips the value of a tagged field.
+func (b *Buffer) SkipTag(wire byte) {
+	switch wire {
+	case WireFixed8:
+		b.skip(1)
+	case WireFixed16:
+		b.skip(2)
+	case WireFixed32:
+		b.skip(4)
+	case WireFixed64:
+		b.skip(8)
+	case WireBytes:
+		b.skip(b.ReadUint32())
+	default:
+		if b.Err == nil {
+			b.Err = ErrUnknownField
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ngen
+
+import (
+	"errors"
+	"io"
+)
+
+// Wire types describe how a field is encoded, so readers can skip fields they don't know.
+// A field's description starts with one of these, WireArray and WireOptional are followed
+// by the description of the element and WireMessage by the uint32 type of the message.
+const (
+	WireFixed8    byte = iota + 1 // byte, bool
+	WireFixed16                   // int16, uint16
+	WireFixed32                   // int32, uint32, int, rune, float32, enums
+	WireFixed64                   // int64, uint64, float64, time.Time
+	WireBytes                     // uint32 length and the bytes: string, []byte
+	WireArray                     // uint32 count and the elements
+	WireOptional                  // bool and the value if true: pointers
+	WireMessage                   // a message serialized in place
+	WireInterface                 // bool, the uint32 message type and the message if true
+)
+
+// ErrUnknownField is set on the buffer if a field the reader doesn't know can't be skipped
+// because the remote didn't describe it.
+var ErrUnknownField = errors.New("ngen: can't skip unknown field")
+
+// ErrUnknownType is set on the buffer if an interface field holds a message type that doesn't implement it.
+var ErrUnknownType = errors.New("ngen: unknown message type in interface field")
+
+// SkipField skips the value of field idx of a message of type mt, numbered like in FieldVersions.
+// Used by generated deserializers with the remote's context for fields only the remote knows.
+// Remotes without wire types only write the fields of the reader's field versions, so there is nothing to skip.
+func (c *Context) SkipField(mt MessageType, idx int, b *Buffer) {
+	if len(c.WireTypes) == 0 {
+		return
+	}
+	c.skip(c.wireType(mt, idx), b, false)
+}
+
+// SkipDeltaField is SkipField for fields of a delta, where nested versioned messages are deltas too.
+func (c *Context) SkipDeltaField(mt MessageType, idx int, b *Buffer) {
+	if len(c.WireTypes) == 0 {
+		return
+	}
+	c.skip(c.wireType(mt, idx), b, true)
+}
+
+// LegacyFields returns the field versions of mt if c is the Context of a remote that doesn't describe
+// its wire types. Such remotes predate skipping fields and read versioned messages in the order of
+// their own field versions, so generated serializers write the fields in that order for them.
+func (c *Context) LegacyFields(mt MessageType) ([]byte, bool) {
+	if c == nil || len(c.WireTypes) > 0 {
+		return nil, false
+	}
+	versions, ok := c.FieldVersions[mt]
+	return versions, ok
+}
+
+func (c *Context) wireType(mt MessageType, idx int) []byte {
+	if fields := c.WireTypes[mt]; idx < len(fields) {
+		return fields[idx]
+	}
+	return nil
+}
+
+// skip reads past a value described by wire. In deltas, versioned messages that are
+// in place, optional or array elements are deltas themselves.
+func (c *Context) skip(wire []byte, b *Buffer, delta bool) {
+	if b.Err != nil {
+		return
+	}
+	if len(wire) == 0 {
+		b.Err = ErrUnknownField
+		return
+	}
+	switch wire[0] {
+	case WireFixed8:
+		b.skip(1)
+	case WireFixed16:
+		b.skip(2)
+	case WireFixed32:
+		b.skip(4)
+	case WireFixed64:
+		b.skip(8)
+	case WireBytes:
+		b.skip(b.ReadUint32())
+	case WireArray:
+		elemDelta := delta && len(wire) > 1 && wire[1] == WireMessage
+		n := b.ReadUint32()
+		if n > b.remaining() {
+			b.Err = io.EOF // Elements take at least a byte, except empty messages.
+		}
+		for ; n > 0 && b.Err == nil; n-- {
+			c.skip(wire[1:], b, elemDelta)
+		}
+	case WireOptional:
+		if b.ReadBool() {
+			c.skip(wire[1:], b, delta)
+		}
+	case WireMessage:
+		if len(wire) < 5 {
+			b.Err = ErrUnknownField
+			return
+		}
+		c.skipMessage(MessageType(Uint32(wire[1:])), b, delta)
+	case WireInterface:
+		if b.ReadBool() {
+			c.skipMessage(MessageType(b.ReadUint32()), b, false)
+		}
+	default:
+		b.Err = ErrUnknownField
+	}
+}
+
+func (c *Context) skipMessage(mt MessageType, b *Buffer, delta bool) {
+	fields, ok := c.WireTypes[mt]
+	if !ok {
+		b.Err = ErrUnknownField
+		return
+	}
+	versions, versioned := c.FieldVersions[mt]
+	switch {
+	case versioned && delta:
+		mask := DeserializeFieldMask(b)
+		for i, fld := range versions {
+			if mask.Has(fld) {
+				c.skip(c.wireType(mt, i), b, true)
+			}
+		}
+	case versioned:
+		for i := range versions {
+			c.skip(c.wireType(mt, i), b, false)
+		}
+	default:
+		for _, w := range fields {
+			c.skip(w, b, false)
+		}
+	}
+}
+
+// skip moves past n bytes.
+func (b *Buffer) skip(n uint32) {
+	if b.Err != nil {
+		return
+	}
+	if b.remaining() < n {
+		b.Err = io.EOF
+		return
+	}
+	b.Loc += n
+}
+
+func (b *Buffer) remaining() uint32 {
+	return uint32(len(b.Buf)) - b.Loc
+}
@@ -0,0 +1,134 @@
+package ngservice
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Message types reserved for authentication and closing connections.
+const (
+	MessageTypeClose        ngen.MessageType = 13
+	MessageTypeAuthenticate ngen.MessageType = 14
+)
+
+// CloseReason tells the remote why a connection is closed.
+type CloseReason uint16
+
+const (
+	// CloseNormal is a connection closed on purpose.
+	CloseNormal CloseReason = iota
+	// CloseAuthRequired is sent to remotes that send messages without authenticating first.
+	CloseAuthRequired
+	// CloseAuthFailed is sent to remotes whose credentials were rejected.
+	CloseAuthFailed
+	// CloseIncompatible is sent to remotes without fields this side requires, see ngen.Context.CheckRequired.
+	CloseIncompatible
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseNormal:
+		return "normal"
+	case CloseAuthRequired:
+		return "authentication required"
+	case CloseAuthFailed:
+		return "authentication failed"
+	case CloseIncompatible:
+		return "incompatible messages"
+	}
+	return "reason " + strconv.Itoa(int(r))
+}
+
+// Close is sent before closing a connection to tell the remote why.
+type Close struct {
+	Reason  CloseReason
+	Message string
+}
+
+// MsgType is to implement the Message interface
+func (c Close) MsgType() ngen.MessageType {
+	return MessageTypeClose
+}
+
+// Serialize writes the close frame to the buffer.
+func (c Close) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint16(uint16(c.Reason))
+	buf.WriteString(c.Message)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (c Close) Length(_ *ngen.Context) int {
+	return 6 + len(c.Message)
+}
+
+// CloseError is the error of a connection closed for a reason.
+// Remote is true if the reason came from a Close frame sent by the remote.
+type CloseError struct {
+	Reason  CloseReason
+	Message string
+	Remote  bool
+	Err     error // Local cause, if any
+}
+
+func (e *CloseError) Error() string {
+	msg := "ngservice: connection closed: " + e.Reason.String()
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the local cause.
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// Authenticate carries the credentials a client sends after the version handshake.
+// Credentials is a generated message, for example holding a token.
+type Authenticate struct {
+	Credentials ngen.Message
+}
+
+// MsgType is to implement the Message interface
+func (a Authenticate) MsgType() ngen.MessageType {
+	return MessageTypeAuthenticate
+}
+
+// Serialize writes the authenticate frame to the buffer.
+func (a Authenticate) Serialize(ctx *ngen.Context, buf *ngen.Buffer) error {
+	writeBody(ctx, buf, a.Credentials)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (a Authenticate) Length(ctx *ngen.Context) int {
+	return bodyLength(ctx, a.Credentials)
+}
+
+// Identity is who a remote authenticated as.
+type Identity struct {
+	ID        int32
+	Name      string
+	Principal interface{} // Anything the application wants to keep, like roles or the account
+}
+
+// Authenticator verifies the credentials of remotes before any other message is delivered.
+// Returning a *CloseError picks the reason and message sent to the remote, any other error
+// rejects the remote with CloseAuthFailed.
+type Authenticator interface {
+	Authenticate(ctx context.Context, credentials ngen.Message) (*Identity, error)
+}
+
+// AuthenticatorFunc is a function used as an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, credentials ngen.Message) (*Identity, error)
+
+// Authenticate calls f.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, credentials ngen.Message) (*Identity, error) {
+	return f(ctx, credentials)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// Principal returns what the Authenticator attached to the remote, nil until it authenticated.
+func (c *Client) Principal() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.principal
+}
+
+// Identity returns the ID, Name and Principal of the client. Unlike the fields it is safe while the client runs.
+func (c *Client) Identity() ngservice.Identity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ngservice.Identity{ID: c.ID, Name: c.Name, Principal: c.principal}
+}
+
+// name is Name for logging, authenticate may set it while the client runs.
+func (c *Client) name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Name
+}
+
+// sendCredentials writes the Authenticate frame if the client has Credentials.
+func (c *Client) sendCredentials(ctx *ngen.Context) error {
+	if c.Credentials == nil {
+		return nil
+	}
+	creds, err := c.Credentials()
+	if err != nil {
+		return err
+	}
+	return c.write(ctx, ngservice.Authenticate{Credentials: creds})
+}
+
+// authenticate verifies the first message of the remote, which has to be an Authenticate frame.
+// On success the identity is applied to the client, otherwise a *ngservice.CloseError is returned.
+// If resume continues the session the identity has to be the one the session started with.
+func (c *Client) authenticate(ctx context.Context, msg ngen.Message, resume *ngservice.Resume) error {
+	auth, ok := msg.(*ngservice.Authenticate)
+	if !ok || auth.Credentials == nil {
+		return &ngservice.CloseError{Reason: ngservice.CloseAuthRequired}
+	}
+	id, err := c.Authenticator.Authenticate(ctx, auth.Credentials)
+	if err == nil && id == nil {
+		id = &ngservice.Identity{}
+	}
+	if err != nil {
+		if ce, ok := err.(*ngservice.CloseError); ok {
+			return ce
+		}
+		return &ngservice.CloseError{Reason: ngservice.CloseAuthFailed, Err: err}
+	}
+	c.mu.Lock()
+	if resume != nil && c.continues(resume) && c.identity != nil && (c.identity.ID != id.ID || c.identity.Name != id.Name) {
+		c.mu.Unlock()
+		return &ngservice.CloseError{Reason: ngservice.CloseAuthFailed, Message: "session belongs to another identity"}
+	}
+	c.identity = id
+	c.ID, c.principal = id.ID, id.Principal
+	if id.Name != "" {
+		c.Name = id.Name
+	}
+	c.mu.Unlock()
+	c.Logger.Info("authenticated", "name", id.Name, "id", id.ID)
+	return nil
+}
+
+// closeFrame is the Close frame telling the remote about err.
+func closeFrame(err *ngservice.CloseError) ngservice.Close {
+	return ngservice.Close{Reason: err.Reason, Message: err.Message}
+}
+
+// remoteClosed is the error of a connection the remote closed with a Close frame.
+func remoteClosed(m *ngservice.Close) error {
+	return &ngservice.CloseError{Reason: m.Reason, Message: m.Message, Remote: true}
+}
+
+// rejected reports whether err means reconnecting would be rejected again.
+func rejected(err error) bool {
+	ce, ok := err.(*ngservice.CloseError)
+	if !ok {
+		return false
+	}
+	return ce.Reason == ngservice.CloseIncompatible ||
+		ce.Remote && (ce.Reason == ngservice.CloseAuthFailed || ce.Reason == ngservice.CloseAuthRequired)
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+var errBadToken = errors.New("bad token")
+
+// tokenAuth accepts testMsg credentials holding "secret".
+var tokenAuth = ngservice.AuthenticatorFunc(func(ctx context.Context, creds ngen.Message) (*ngservice.Identity, error) {
+	if m, ok := creds.(*testMsg); !ok || m.V != "secret" {
+		return nil, errBadToken
+	}
+	return &ngservice.Identity{ID: 7, Name: "alice", Principal: "admin"}, nil
+})
+
+func credentials(token string) func() (ngen.Message, error) {
+	return func() (ngen.Message, error) { return testMsg{V: token}, nil }
+}
+
+// closeReason waits for c to stop and returns its close error.
+func closeReason(t *testing.T, c *Client, errs chan error) *ngservice.CloseError {
+	t.Helper()
+	select {
+	case err := <-errs:
+		ce, ok := err.(*ngservice.CloseError)
+		if !ok {
+			t.Fatalf("Expected close error, got %v", err)
+		}
+		return ce
+	case <-time.After(time.Second):
+		t.Fatalf("Client didn't stop")
+	}
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	client, server := newTestClient(a, ctx), newTestClient(b, ctx)
+	client.Credentials = credentials("secret")
+	server.Authenticator = tokenAuth
+	server.Outgoing <- testMsg{V: "welcome"} // Held back until the client authenticated.
+	run(client, context.Background())
+	run(server, context.Background())
+	defer client.Close()
+	defer server.Close()
+
+	if msg := <-client.Incoming; msg.(*testMsg).V != "welcome" {
+		t.Fatalf("Unexpected message %#v", msg)
+	}
+	client.Outgoing <- testMsg{V: "hi"}
+	if msg := <-server.Incoming; msg.(*testMsg).V != "hi" {
+		t.Fatalf("Expected credentials to not be delivered, got %#v", msg)
+	}
+	if id := server.Identity(); id.ID != 7 || id.Name != "alice" || id.Principal != "admin" {
+		t.Fatalf("Identity not applied: %+v", id)
+	}
+}
+
+func TestAuthenticateRejected(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	client, server := newTestClient(a, ctx), newTestClient(b, ctx)
+	client.Credentials = credentials("guess")
+	server.Authenticator = tokenAuth
+	clientErrs, serverErrs := run(client, context.Background()), run(server, context.Background())
+
+	if ce := closeReason(t, client, clientErrs); ce.Reason != ngservice.CloseAuthFailed || !ce.Remote {
+		t.Fatalf("Expected remote %v, got %+v", ngservice.CloseAuthFailed, ce)
+	}
+	if ce := closeReason(t, server, serverErrs); ce.Reason != ngservice.CloseAuthFailed || !errors.Is(ce, errBadToken) {
+		t.Fatalf("Expected %v caused by %v, got %+v", ngservice.CloseAuthFailed, errBadToken, ce)
+	}
+	if server.Principal() != nil {
+		t.Fatalf("Rejected remote got a principal")
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	client, server := newTestClient(a, ctx), newTestClient(b, ctx)
+	server.Authenticator = tokenAuth
+	dials := 0
+	client.Conn = nil
+	client.Dial = func(context.Context) (io.ReadWriteCloser, error) {
+		dials++
+		if dials > 1 {
+			t.Errorf("Rejected client reconnected")
+		}
+		return a, nil
+	}
+	clientErrs, serverErrs := run(client, context.Background()), run(server, context.Background())
+	client.Outgoing <- testMsg{V: "no credentials"}
+
+	if ce := closeReason(t, client, clientErrs); ce.Reason != ngservice.CloseAuthRequired || !ce.Remote {
+		t.Fatalf("Expected remote %v, got %+v", ngservice.CloseAuthRequired, ce)
+	}
+	if ce := closeReason(t, server, serverErrs); ce.Reason != ngservice.CloseAuthRequired {
+		t.Fatalf("Expected %v, got %+v", ngservice.CloseAuthRequired, ce)
+	}
+}
+
+func TestResumeOtherIdentity(t *testing.T) {
+	ctx := &ngen.Context{Read: testRead}
+	sessions := &Sessions{}
+	serverClients := make(chan *Client, 10)
+	server := func(conn net.Conn) {
+		sc := newTestClient(conn, ctx)
+		sc.Authenticator = ngservice.AuthenticatorFunc(func(ctx context.Context, creds ngen.Message) (*ngservice.Identity, error) {
+			return &ngservice.Identity{Name: creds.(*testMsg).V}, nil
+		})
+		if resumed, err := sessions.Accept(sc); resumed || err != nil {
+			return
+		}
+		serverClients <- sc
+		sc.Run(context.Background())
+	}
+	conns := make(chan *lossyConn, 10)
+	c := newTestClient(nil, ctx)
+	c.Reconnect = ReconnectOptions{Resume: true}
+	c.Dial = pipeServer(server, conns)
+	names := make(chan string, 2)
+	names <- "alice"
+	names <- "mallory"
+	c.Credentials = func() (ngen.Message, error) { return testMsg{V: <-names}, nil }
+	errs := run(c, context.Background())
+
+	sc := <-serverClients
+	defer sc.Close()
+	c.Outgoing <- testMsg{V: "1"}
+	expectValues(t, sc.Incoming, "1")
+
+	// The session's token alone doesn't let another identity take it over.
+	(<-conns).Close()
+	if ce := closeReason(t, c, errs); ce.Reason != ngservice.CloseAuthFailed || !ce.Remote {
+		t.Fatalf("Expected remote %v, got %+v", ngservice.CloseAuthFailed, ce)
+	}
+	if id := sc.Identity(); id.Name != "alice" {
+		t.Fatalf("Session identity changed to %+v", id)
+	}
+}
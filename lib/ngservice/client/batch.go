@@ -0,0 +1,152 @@
+package client
+
+import (
+	"io"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// BatchOptions configure packing multiple frames into a single Conn.Write.
+// The reading side must accept more than one frame per read, which the client Reader does.
+type BatchOptions struct {
+	// MaxBytes flushes the batch once it is at least this big. Zero disables batching.
+	MaxBytes int
+	// MaxLatency is how long the first message of a batch may wait for more messages.
+	// Zero only batches messages that are already queued and never waits.
+	MaxLatency time.Duration
+}
+
+// frameLimiter is implemented by conns that limit the size of frames, like datagram transports.
+type frameLimiter interface {
+	MaxFrame(mt ngen.MessageType) int
+}
+
+// nextMessage returns the next control frame or message from the send queue, which Outgoing feeds.
+// Control frames go first, queued messages are returned in order.
+// If block is false it returns immediately, otherwise it waits until a message arrives or timeout fires.
+// A nil message with quit false means nothing was available. quit means the sender should stop.
+func (c *Client) nextMessage(block bool, timeout <-chan time.Time) (m ngen.Message, quit bool) {
+	select {
+	case m = <-c.control:
+		return m, false
+	default:
+	}
+	if !block {
+		return c.pop()
+	}
+	for {
+		select {
+		case m = <-c.control:
+			return m, false
+		case <-c.queue.ready:
+			if m, quit = c.pop(); m != nil || quit {
+				signal(c.queue.ready) // May be more queued
+				return m, quit
+			}
+		case <-timeout:
+			return nil, false
+		case <-c.quit:
+			return nil, true
+		}
+	}
+}
+
+// pop returns the next queued message. quit is true once a nil message sent on Outgoing is reached,
+// which stops the client.
+func (c *Client) pop() (m ngen.Message, quit bool) {
+	if c.queue.closed() {
+		c.shutdown(ErrClosed)
+		return nil, true
+	}
+	return c.queue.pop(), false
+}
+
+// writeBatch writes first and any other messages that are ready together.
+// Returns quit if a nil message was seen while batching.
+func (c *Client) writeBatch(ctx *ngen.Context, first ngen.Message) (quit bool, err error) {
+	buf := ngen.GetBuffer(0)
+	defer ngen.PutBuffer(buf)
+	if c.appendFrame(buf, ctx, first) {
+		c.track(first)
+	}
+
+	var timeout <-chan time.Time
+	if c.Batch.MaxLatency > 0 {
+		t := time.NewTimer(c.Batch.MaxLatency)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for int(buf.Loc) < c.Batch.MaxBytes {
+		m, q := c.nextMessage(timeout != nil, timeout)
+		if q {
+			quit = true
+			break
+		}
+		if m == nil {
+			break
+		}
+		if c.appendFrame(buf, ctx, m) {
+			c.track(m)
+		}
+	}
+	if buf.Loc == 0 {
+		return quit, nil
+	}
+	return quit, c.writeFrames(buf.Bytes())
+}
+
+// appendFrame writes m into buf, leaving buf unchanged and returning false if serializing fails.
+// Messages larger than the Conn can send are dropped.
+func (c *Client) appendFrame(buf *ngen.Buffer, ctx *ngen.Context, m ngen.Message) bool {
+	if l, ok := c.Conn.(frameLimiter); ok {
+		if size := ngservice.HeaderLength + m.Length(ctx); size > l.MaxFrame(m.MsgType()) {
+			c.Logger.Warn("message too large for connection", "name", c.name(), "type", m.MsgType(), "len", size)
+			c.Metrics.MessageDropped(m.MsgType())
+			return false
+		}
+	}
+	if mt := payloadType(m); !c.canSend(mt) {
+		c.Logger.Warn("remote can't read message type", "name", c.name(), "type", mt)
+		c.Metrics.MessageDropped(mt)
+		return false
+	}
+	start := buf.Loc
+	if err := ngservice.WriteMessageTo(buf, ctx, m); err != nil {
+		c.Logger.Warn("failed to serialize message", "name", c.name(), "type", m.MsgType(), "err", err)
+		buf.Loc, buf.Err = start, nil
+		return false
+	}
+	c.compress(buf, start, ctx, m.MsgType())
+	c.Metrics.MessageOut(m.MsgType(), int(buf.Loc-start))
+	return true
+}
+
+// write serializes and writes a single message.
+func (c *Client) write(ctx *ngen.Context, m ngen.Message) error {
+	buf := ngen.GetBuffer(0)
+	defer ngen.PutBuffer(buf)
+	if c.appendFrame(buf, ctx, m) {
+		c.track(m)
+	}
+	if buf.Loc == 0 {
+		return nil
+	}
+	return c.writeFrames(buf.Bytes())
+}
+func (c *Client) writeFrames(frames []byte) error {
+	c.setWriteDeadline()
+	n, err := c.Conn.Write(frames)
+	if err != nil {
+		select {
+		case <-c.quit: // Expected, conn was closed on shutdown.
+		default:
+			c.Logger.Warn("writing failed", "name", c.name(), "err", err)
+		}
+		return err
+	} else if n == 0 {
+		return io.ErrShortWrite
+	}
+	return nil
+}
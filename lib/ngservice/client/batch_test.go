@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// countingConn counts the writes and bytes written to the conn.
+type countingConn struct {
+	net.Conn
+	writes int64
+	bytes  int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.bytes, int64(n))
+	return n, err
+}
+
+func TestBatchWrites(t *testing.T) {
+	a, b := net.Pipe()
+	conn := &countingConn{Conn: a}
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	ca.Conn = conn
+	ca.Batch = BatchOptions{MaxBytes: 64, MaxLatency: 20 * time.Millisecond}
+	ca.Queue = QueueOptions{Size: 100}
+	cb.Incoming = make(chan ngen.Message, 100)
+
+	// Queue everything before starting so the sender finds a backlog.
+	const count = 50
+	for i := 0; i < count; i++ {
+		ca.TrySend(testMsg{V: "batched"}) // 17 byte frames
+	}
+	run(ca, context.Background())
+	run(cb, context.Background())
+	defer cb.Close()
+	defer ca.Close()
+
+	for i := 0; i < count; i++ {
+		if msg := <-cb.Incoming; msg.(*testMsg).V != "batched" {
+			t.Fatalf("Unexpected message %#v", msg)
+		}
+	}
+	// 4 frames (68 bytes) fit before passing MaxBytes.
+	if w := atomic.LoadInt64(&conn.writes); w != 13 {
+		t.Fatalf("Expected 13 writes for %d messages, got %d", count, w)
+	}
+
+	// A single message is flushed after MaxLatency.
+	start := time.Now()
+	ca.Outgoing <- testMsg{V: "late"}
+	if msg := <-cb.Incoming; msg.(*testMsg).V != "late" {
+		t.Fatalf("Unexpected message %#v", msg)
+	}
+	if d := time.Since(start); d < ca.Batch.MaxLatency {
+		t.Fatalf("Message was flushed before MaxLatency: %s", d)
+	}
+}
+
+func benchmarkSend(b *testing.B, batch BatchOptions) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("Can't listen on loopback: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatalf("Failed to dial: %s", err)
+	}
+	cc := &countingConn{Conn: conn}
+	c := newTestClient(nil, &ngen.Context{Read: testRead})
+	c.Conn = cc
+	c.Batch = batch
+	c.Queue = QueueOptions{Size: 1024}
+	run(c, context.Background())
+	defer c.Close()
+
+	msg := testMsg{V: "player moved to 10,12"}
+	expected := int64(b.N) * int64(msg.Length(nil)+6)
+	b.ReportAllocs()
+	b.SetBytes(int64(msg.Length(nil) + 6))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Send(context.Background(), msg)
+	}
+	for atomic.LoadInt64(&cc.bytes) < expected {
+		time.Sleep(10 * time.Microsecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/float64(atomic.LoadInt64(&cc.writes)), "msgs/write")
+}
+
+func BenchmarkSendUnbatched(b *testing.B) {
+	benchmarkSend(b, BatchOptions{})
+}
+
+func BenchmarkSendBatched(b *testing.B) {
+	benchmarkSend(b, BatchOptions{MaxBytes: 16 * 1024})
+}
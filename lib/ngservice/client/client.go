@@ -1,108 +1,581 @@
 package client
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/lologarithm/netgen/lib/ngen"
 	"github.com/lologarithm/netgen/lib/ngservice"
 )
 
+var (
+	// ErrClosed is the terminal error of a client stopped by Close or by sending nil on Outgoing.
+	ErrClosed = errors.New("client: closed")
+	// ErrRunning is returned by Run if the client was already started.
+	ErrRunning = errors.New("client: already running")
+)
+
 type Client struct {
-	ID       int32
-	Name     string
-	Conn     io.ReadWriteCloser
+	ID   int32
+	Name string
+	Conn io.ReadWriteCloser
+	// Outgoing hands messages to the send queue, see Queue. Messages sent on it and with Send and TrySend
+	// are written in the order they are queued. A nil message closes the client once the messages before it
+	// are written.
 	Outgoing chan ngen.Message
 	Incoming chan ngen.Message
+
+	// Queue configures the queue used by Outgoing, Send and TrySend. Must be set before the client is used.
+	Queue QueueOptions
+	// Batch configures combining frames into fewer writes. Batching is off by default.
+	Batch BatchOptions
+	// Heartbeat configures pings, dead peer detection and deadlines. Off by default.
+	Heartbeat HeartbeatOptions
+	// Compression configures compressing large frames. Off by default.
+	Compression CompressionOptions
+
+	// Authenticator, if set, requires the remote to authenticate before any message is exchanged.
+	// ID, Name and Principal are set from the Identity it returns, read them with Identity while running.
+	// A resumed session has to authenticate with the same ID and Name again.
+	Authenticator ngservice.Authenticator
+	// Credentials, if set, returns the message sent to the remote's Authenticator on every connection.
+	Credentials func() (ngen.Message, error)
+
+	// Settings are the local serialization settings (versioning info) used by Run.
+	Settings *ngen.Context
+	// HandshakeTimeout is how long the sender waits for the remote's Context, DefaultHandshakeTimeout if zero.
+	// A remote that sends none by then is treated like one without versioned messages or codecs.
+	HandshakeTimeout time.Duration
+
+	// Dial, if set, connects when Conn is nil and reconnects after the connection is lost.
+	// Incoming and queued messages are kept across connections.
+	Dial func(ctx context.Context) (io.ReadWriteCloser, error)
+	// Reconnect configures backoff and session resumption of clients with Dial.
+	Reconnect ReconnectOptions
+	// OnDisconnected is called by Run when a client with Dial loses its connection.
+	OnDisconnected func(err error)
+	// OnReconnected is called by Run once the handshake is done on a connection Dial made after losing the last one.
+	// resumed is true if the session continued and unacknowledged messages were replayed.
+	OnReconnected func(resumed bool)
+	// OnIncompatible is called by the reading goroutine once the remote's Context is read if some message types
+	// can't be exchanged with it, see ngen.Context.CompareSchemas. Messages of those types are dropped
+	// instead of sent or read.
+	OnIncompatible func(mismatches []ngen.SchemaMismatch)
+
+	// Logger and Metrics receive diagnostics about the connection. Both are optional.
+	Logger  ngservice.Logger
+	Metrics ngservice.Metrics
+
+	initOnce sync.Once
+	queue    *sendQueue
+	control  chan ngen.Message // heartbeat frames, sent ahead of the queue
+	epoch    time.Time         // base of ping timestamps
+	stop     chan struct{}     // closed when shutdown starts
+	done     chan struct{}     // closed when shutdown is finished
+	quit     chan struct{}     // closed when the current connection is shutting down
+
+	mu       sync.Mutex
+	started  bool
+	err      error
+	lastRead time.Time
+	rtt      time.Duration
+	fail     func(error) // stops the current connection
+
+	principal  interface{}
+	identity   *ngservice.Identity                      // of the session, see authenticate
+	remote     *ngen.Context                            // of the current connection, see schema.go
+	mismatched map[ngen.MessageType]ngen.SchemaMismatch // of the current connection, see schema.go
+
+	// Session resumption state, see resume.go.
+	session  uint64
+	token    uint64 // secret of the session, see ngservice.Resume
+	sessions *Sessions
+	sent     uint64
+	received uint64
+	acked    uint64
+	unacked  []ngen.Message
+
+	// Delta baselines by message type, see delta.go.
+	sentDeltas     map[ngen.MessageType]*deltaStream
+	receivedDeltas map[ngen.MessageType]*deltaStream
 }
 
+// ManageClient starts the client with the given settings in the background.
+// Use Done and Err to find out when and why it stopped.
 func ManageClient(ctx *ngen.Context, c *Client) {
-	settingsSync := make(chan *ngen.Context)
-	go Sender(c, ctx, settingsSync)
-	go Reader(c, ctx, settingsSync)
+	c.Settings = ctx
+	go c.Run(context.Background())
+}
+
+// Reader reads messages off c.Conn onto c.Incoming until the connection fails or the client is closed,
+// sending the remote's Context on remote. Incoming is closed when it returns.
+// Reader and Sender only exchange messages and Contexts, the other options of the client need Run.
+//
+// Deprecated: Use Run, which starts reading and writing and cleans up once both are finished.
+func Reader(c *Client, local *ngen.Context, remote chan *ngen.Context) {
+	c.startLegacy()
+	c.shutdown(c.read(context.Background(), local, remote, make(chan bool, 1), make(chan error, 1)))
+	c.finish()
+}
+
+// Sender writes the messages sent on c.Outgoing and queued with Send to c.Conn until a nil message is
+// sent or the client is closed. It first sends local and waits for the remote's Context on remote if there
+// is versioning info to exchange. c.Conn is closed when it returns, which stops Reader.
+//
+// Deprecated: Use Run, which starts reading and writing and cleans up once both are finished.
+func Sender(c *Client, local *ngen.Context, remote chan *ngen.Context) {
+	c.startLegacy()
+	forwarded := make(chan struct{})
+	go c.forward(forwarded)
+	c.shutdown(c.send(local, remote, make(chan bool, 1), make(chan error, 1), make(chan bool, 1)))
+	<-forwarded
+	c.Conn.Close()
+}
+
+// startLegacy marks the client started by Reader and Sender, so Run refuses to start it again.
+func (c *Client) startLegacy() {
+	c.init()
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+}
+
+func (c *Client) init() {
+	c.initOnce.Do(func() {
+		c.stop = make(chan struct{})
+		c.done = make(chan struct{})
+		c.queue = newSendQueue(c.Queue)
+		c.control = make(chan ngen.Message, 4)
+		c.epoch = time.Now()
+		c.quit = c.stop // Until Run serves a connection, see Reader and Sender.
+		if c.Logger == nil {
+			c.Logger = ngservice.NopLogger{}
+		}
+		if c.Metrics == nil {
+			c.Metrics = ngservice.NopMetrics{}
+		}
+	})
 }
 
-// Reader spawns a block for loop reading off the conn on Client
+// Run reads and writes messages until the connection fails, ctx is cancelled or Close is called.
+// A client with Dial reconnects instead of stopping when the connection fails.
+// Once Run returns the connection is closed, both the reading and writing goroutines have exited
+// and Incoming has been closed. The returned error is the same as Err.
+func (c *Client) Run(ctx context.Context) error {
+	c.init()
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return ErrRunning
+	}
+	c.started = true
+	conn := c.Conn
+	c.mu.Unlock()
+	forwarded := make(chan struct{})
+	go c.forward(forwarded)
+
+	local := c.Settings
+	if local == nil {
+		local = &ngen.Context{}
+	}
+
+	if conn == nil {
+		if c.Dial == nil {
+			c.shutdown(errors.New("client: no Conn or Dial"))
+		} else if err := c.dial(ctx); err != nil {
+			c.shutdown(err)
+		}
+	}
+	for reconnected := false; !c.stopping(); reconnected = true {
+		err := c.serve(ctx, local, reconnected)
+		if c.Dial == nil || c.stopping() || rejected(err) {
+			c.shutdown(err)
+			break
+		}
+		c.Logger.Info("disconnected", "name", c.name(), "err", err)
+		if c.OnDisconnected != nil {
+			c.OnDisconnected(err)
+		}
+		if err := c.dial(ctx); err != nil {
+			c.shutdown(err)
+		}
+	}
+	<-forwarded
+	c.finish()
+	err := c.Err()
+	c.Logger.Debug("client stopped", "name", c.name(), "err", err)
+	return err
+}
+
+// serve runs the current connection until it fails or the client is stopped.
+func (c *Client) serve(ctx context.Context, local *ngen.Context, reconnected bool) error {
+	quit := make(chan struct{})
+	var once sync.Once
+	var connErr error
+	fail := func(err error) {
+		once.Do(func() {
+			if err == nil {
+				err = ErrClosed
+			}
+			connErr = err
+			close(quit)
+		})
+	}
+	// Drop control frames meant for the last connection.
+	for len(c.control) > 0 {
+		<-c.control
+	}
+	c.mu.Lock()
+	c.quit, c.fail = quit, fail
+	c.lastRead = time.Now()
+	c.remote, c.mismatched = nil, nil
+	c.principal = nil
+	c.mu.Unlock()
+	c.resetDeltas()
+
+	settingsSync := make(chan *ngen.Context, 1)
+	resumeSync := make(chan bool, 1)
+	authSync := make(chan error, 1)
+	ready := make(chan bool, 1)
+	authCtx, cancelAuth := context.WithCancel(ctx)
+	defer cancelAuth()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fail(c.send(local, settingsSync, resumeSync, authSync, ready))
+	}()
+	go func() {
+		defer wg.Done()
+		fail(c.read(authCtx, local, settingsSync, resumeSync, authSync))
+	}()
+	if c.Heartbeat.Interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fail(c.heartbeat())
+		}()
+	}
+
+	for running := true; running; {
+		select {
+		case resumed := <-ready:
+			if reconnected && c.OnReconnected != nil {
+				c.OnReconnected(resumed)
+			}
+		case <-ctx.Done():
+			c.shutdown(ctx.Err())
+		case <-c.stop:
+			running = false
+		case <-quit:
+			running = false
+		}
+	}
+	fail(nil)
+	cancelAuth()
+	// Closing the conn unblocks any pending Read or Write.
+	c.Conn.Close()
+	wg.Wait()
+	return connErr
+}
+
+// stopping reports whether the client is shutting down for good.
+func (c *Client) stopping() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown records the terminal error and tells the goroutines to stop.
+// Only the first error is kept.
+func (c *Client) shutdown(err error) {
+	if err == nil {
+		err = ErrClosed
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		close(c.stop)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) finish() {
+	close(c.Incoming)
+	close(c.done)
+}
+
+// Close stops the client and waits for it to finish shutting down.
+func (c *Client) Close() error {
+	c.init()
+	c.shutdown(ErrClosed)
+	c.mu.Lock()
+	started := c.started
+	c.started = true
+	c.mu.Unlock()
+	if !started {
+		// Never ran, clean up here.
+		if c.Conn != nil {
+			c.Conn.Close()
+		}
+		c.finish()
+	}
+	<-c.done
+	return nil
+}
+
+// Done returns a channel that is closed once the client has completely stopped.
+func (c *Client) Done() <-chan struct{} {
+	c.init()
+	return c.done
+}
+
+// Err returns the reason the client stopped, or nil if it is still running.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// read spawns a block for loop reading off the conn on Client
 // it will put all read packets onto the incoming channel.
 // This code requires the conn to not shard packets.
-func Reader(c *Client, local *ngen.Context, remote chan *ngen.Context) {
+func (c *Client) read(ctx context.Context, local *ngen.Context, remote chan<- *ngen.Context, resumed chan<- bool, authed chan<- error) error {
 	idx := 0
-	buffer := make([]byte, 4096)
+	pooled := ngen.GetBuffer(ngen.DefaultBufferSize)
+	defer func() { ngen.PutBuffer(pooled) }()
+	buffer := pooled.Buf
 	// Cached versioning info.
 	// This means we don't have to send it on every request, only on each connection.
 
-	remoteSettings := local // Use local settings until we have a remote.
+	remoteSettings := local   // Use local settings until we have a remote.
+	var codec ngservice.Codec // Negotiated in the handshake.
+	var inflated []byte
+	authenticated := c.Authenticator == nil
+	var resume *ngservice.Resume // Applied once the remote is authenticated.
 
 	for {
+		if idx == len(buffer) {
+			// Expand buffer to hold the message!
+			bigger := ngen.GetBuffer(len(buffer) * 2)
+			copy(bigger.Buf, buffer)
+			ngen.PutBuffer(pooled)
+			pooled, buffer = bigger, bigger.Buf
+		}
+		c.setReadDeadline()
 		n, err := c.Conn.Read(buffer[idx:])
 		if err != nil {
-			// ded?
-			break
+			return err
 		} else if n == 0 {
-			break
-		} else if n+idx >= len(buffer) {
-			// Expand buffer to hold the message!
-			newbuff := make([]byte, len(buffer)*2)
-			copy(newbuff, buffer)
-			buffer = newbuff
-			idx += n
-			continue
-		}
-
-		p, ok := ngservice.ReadPacket(remoteSettings, buffer[:idx+n])
-		if !ok {
-			// increment idx by how much we wrote.
-			idx += n
-			// fmt.Printf("No Packet... Buffer: %v\n", buffer[:idx])
-			continue
-		}
-
-		if p.Header.MsgType == ngen.MessageTypeContext {
-			fmt.Printf("Got remote settings: %#v\n", p.NetMsg)
-			remoteSettings = p.NetMsg.(*ngen.Context)
-			remote <- remoteSettings // send to 'sender' channel now
-		} else {
+			return io.ErrUnexpectedEOF
+		}
+		c.touch()
+		idx += n
+
+		// Read every complete packet in the buffer
+		start := 0
+		for {
+			l, ok := ngservice.FrameLength(buffer[start:idx])
+			if !ok {
+				break
+			}
+			frame := buffer[start : start+l]
+			start += l
+			h, _ := ngservice.FrameHeader(frame)
+			if !c.canReceive(h.MsgType) {
+				c.countReceived(h.MsgType)
+				c.Metrics.DecodeFailure(h.MsgType)
+				c.Logger.Warn("refused message of incompatible type", "name", c.name(), "type", h.MsgType)
+				continue
+			}
+			if h.Compressed {
+				var err error
+				if inflated, err = c.decompress(inflated[:0], frame, codec, h.MsgType); err != nil {
+					c.countReceived(h.MsgType)
+					c.Metrics.DecodeFailure(h.MsgType)
+					c.Logger.Warn("failed to decompress message", "name", c.name(), "type", h.MsgType, "err", err)
+					continue
+				}
+				frame = inflated
+			}
+			p, ok := ngservice.ReadPacket(remoteSettings, frame)
+			c.countReceived(p.Header.MsgType)
+			if !ok {
+				// Unknown message type or corrupt message, skip it.
+				c.Metrics.DecodeFailure(p.Header.MsgType)
+				c.Logger.Warn("failed to decode message", "name", c.name(), "type", p.Header.MsgType, "len", l)
+				continue
+			}
+			c.Metrics.MessageIn(p.Header.MsgType, l)
+
+			if p.Header.MsgType == ngen.MessageTypeContext {
+				remoteSettings = p.NetMsg.(*ngen.Context)
+				codec = c.recvCodec(remoteSettings)
+				c.checkSchemas(local, remoteSettings)
+				c.Logger.Debug("got remote settings", "name", c.name(), "versioned", len(remoteSettings.FieldVersions), "codecs", remoteSettings.Codecs)
+				if !c.handshake(local) {
+					// The remote waits for our settings.
+					c.sendControl(c.hello(local))
+				}
+				select {
+				case remote <- remoteSettings: // send to 'sender' channel now
+				case <-c.quit:
+					return nil
+				}
+				if checkRequired(local, remoteSettings) != nil {
+					// The sender tells the remote and stops the connection.
+					<-c.quit
+					return nil
+				}
+				continue
+			}
+			if m, ok := p.NetMsg.(*ngservice.Close); ok {
+				return remoteClosed(m)
+			}
+			if r, ok := p.NetMsg.(*ngservice.Resume); ok && !authenticated {
+				resume = r
+				continue
+			}
+			if c.handleControl(p.NetMsg) || authenticated && c.handleResume(p.NetMsg, resumed) || c.handleBaselineAck(p.NetMsg) {
+				continue
+			}
+			if !authenticated {
+				err := c.authenticate(ctx, p.NetMsg, resume)
+				authed <- err
+				if err != nil {
+					// The sender tells the remote and stops the connection.
+					<-c.quit
+					return nil
+				}
+				authenticated = true
+				if resume != nil {
+					c.handleResume(resume, resumed)
+				}
+				continue
+			} else if _, ok := p.NetMsg.(*ngservice.Authenticate); ok {
+				continue // Not expected, nothing to verify it with.
+			}
+			if mt := payloadType(p.NetMsg); mt != p.Header.MsgType && !c.canReceive(mt) {
+				c.Metrics.DecodeFailure(mt)
+				c.Logger.Warn("refused wrapped message of incompatible type", "name", c.name(), "type", mt)
+				continue
+			}
+			if d, ok := p.NetMsg.(*ngservice.Delta); ok {
+				msg, err := c.applyDelta(remoteSettings, d)
+				if err != nil {
+					c.Metrics.DecodeFailure(d.Type)
+					c.Logger.Warn("failed to apply delta", "name", c.name(), "type", d.Type, "err", err)
+					continue
+				} else if msg == nil {
+					continue // Older than the last one.
+				}
+				p.NetMsg = msg
+			}
+
 			// Successful packet read
-			c.Incoming <- p.NetMsg
+			select {
+			case c.Incoming <- p.NetMsg:
+			case <-c.quit:
+				return nil
+			}
 		}
 
-		// copy back in case we have multiple packets in the buffer
-		l := p.Len()
-		if l != idx {
-			copy(buffer, buffer[l:])
+		// copy back in case we have a partial packet left in the buffer
+		if start > 0 {
+			copy(buffer, buffer[start:idx])
+			idx -= start
 		}
-		idx = 0
 	}
-	close(c.Incoming)
 }
 
-func Sender(c *Client, local *ngen.Context, remote chan *ngen.Context) {
+func (c *Client) send(local *ngen.Context, remote <-chan *ngen.Context, resumeSync <-chan bool, authed <-chan error, ready chan<- bool) error {
 	remoteSettings := local // start with local settings by default
 
-	// Only send and wait for versioning message if we have versioned messages
-	if len(local.FieldVersions) > 0 {
+	if c.Reconnect.Resume {
+		// The remote needs to know the session before anything else.
+		if err := c.write(nil, c.resumeFrame()); err != nil {
+			return err
+		}
+	}
+	// Only send and wait for versioning message if we have versioned messages or codecs to negotiate.
+	handshake := c.handshake(local)
+	start := time.Now()
+	if handshake {
 		// First message out is the settings (versioning info) for this instance.
 		// This will allow the other side to read our versioned structs.
-		n, err := c.Conn.Write(ngservice.WriteMessage(nil, local))
-		if err != nil || n == 0 {
-			fmt.Printf("Failed to write handshake settings with remote: %s", err.Error())
-			return
+		if err := c.write(nil, c.hello(local)); err != nil {
+			return err
 		}
-
-		remoteSettings = <-remote
 	}
+	if handshake {
+		timer := time.NewTimer(c.handshakeTimeout())
+		select {
+		case remoteSettings = <-remote:
+			c.Metrics.Handshake(time.Since(start))
+		case <-timer.C:
+			// Older remotes only answer a Context, keep sending with the local settings.
+			c.Logger.Warn("remote sent no settings, using local settings", "name", c.name(), "waited", time.Since(start))
+		case <-c.quit:
+			timer.Stop()
+			return nil
+		}
+		timer.Stop()
+		if err := checkRequired(local, remoteSettings); err != nil {
+			c.write(remoteSettings, closeFrame(err.(*ngservice.CloseError)))
+			return err
+		}
+	}
+	if err := c.sendCredentials(remoteSettings); err != nil {
+		return err
+	}
+	if c.Authenticator != nil {
+		// Nothing goes out until the remote is known.
+		select {
+		case err := <-authed:
+			if ce, ok := err.(*ngservice.CloseError); ok {
+				c.write(remoteSettings, closeFrame(ce))
+				return err
+			}
+		case <-c.quit:
+			return nil
+		}
+	}
+	resumed := false
+	if c.Reconnect.Resume {
+		// Known once the remote authenticated.
+		select {
+		case resumed = <-resumeSync:
+		case <-c.quit:
+			return nil
+		}
+	}
+	if resumed {
+		if err := c.replay(remoteSettings); err != nil {
+			return err
+		}
+	}
+	ready <- resumed
 
-	for m := range c.Outgoing {
-		if m == nil {
-			return // Empty message means die
+	for {
+		m, quit := c.nextMessage(true, nil)
+		if quit {
+			return nil
 		}
-		n, err := c.Conn.Write(ngservice.WriteMessage(remoteSettings, m))
-		if err != nil {
-			fmt.Printf("Writing failed: %s\n", err.Error())
-			break
-		} else if n == 0 {
-			fmt.Printf("outgoing write failed, shutting down writer.\n")
-			break
+		c.Metrics.QueueDepth(c.QueueLen())
+		if c.Batch.MaxBytes > 0 {
+			quit, err := c.writeBatch(remoteSettings, m)
+			if err != nil || quit {
+				return err
+			}
+		} else if err := c.write(remoteSettings, m); err != nil {
+			return err
 		}
 	}
 }
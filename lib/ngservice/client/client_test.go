@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+func newTestClient(conn net.Conn, ctx *ngen.Context) *Client {
+	return &Client{
+		Conn:     conn,
+		Outgoing: make(chan ngen.Message, 10),
+		Incoming: make(chan ngen.Message, 10),
+		Settings: ctx,
+	}
+}
+
+// run starts the client and returns a channel that gets the result of Run.
+func run(c *Client, ctx context.Context) chan error {
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run(ctx) }()
+	return errs
+}
+
+// checkLeaks fails the test if goroutines started after `before` are still running.
+func checkLeaks(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Leaked goroutines: %d > %d\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// checkStopped verifies the client is completely shut down with the expected error.
+func checkStopped(t *testing.T, c *Client, runErr error, expected error) {
+	t.Helper()
+	if runErr != expected || c.Err() != expected {
+		t.Fatalf("Expected %v from Run and Err, got: %v, %v", expected, runErr, c.Err())
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Fatalf("Done not closed after Run returned")
+	}
+	for range c.Incoming {
+		// drain, range exits only if Incoming was closed.
+	}
+}
+
+func TestClientExchange(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	errsA, errsB := run(ca, context.Background()), run(cb, context.Background())
+
+	ca.Outgoing <- &testMsg{V: "one"}
+	ca.Outgoing <- testMsg{V: "two"}
+	for _, expected := range []string{"one", "two"} {
+		msg := <-cb.Incoming
+		if msg.(*testMsg).V != expected {
+			t.Fatalf("Expected %s, got %#v", expected, msg)
+		}
+	}
+
+	ca.Outgoing <- nil // nil message closes the client
+	checkStopped(t, ca, <-errsA, ErrClosed)
+	// Remote side sees the conn close.
+	checkStopped(t, cb, <-errsB, io.EOF)
+	checkLeaks(t, before)
+}
+
+func TestClientCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newTestClient(a, &ngen.Context{Read: testRead})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := run(c, ctx)
+	cancel()
+	checkStopped(t, c, <-errs, context.Canceled)
+	b.Close()
+	checkLeaks(t, before)
+}
+
+func TestClientHandshakeBlocked(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := net.Pipe()
+	go io.Copy(ioutil.Discard, b) // remote never replies with settings
+	c := newTestClient(a, &ngen.Context{Read: testRead, FieldVersions: map[ngen.MessageType][]byte{testMsgType: {1}}})
+	errs := run(c, context.Background())
+
+	// Sender is stuck waiting for the remote settings.
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	checkStopped(t, c, <-errs, ErrClosed)
+	b.Close()
+	checkLeaks(t, before)
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newTestClient(a, &ngen.Context{Read: testRead})
+	c.Compression = CompressionOptions{Codecs: []ngservice.Codec{ngservice.Flate}}
+	c.HandshakeTimeout = 10 * time.Millisecond
+	run(c, context.Background())
+	defer c.Close()
+
+	// The remote never sends its settings, like one built before the handshake.
+	large := strings.Repeat("the quick brown fox jumps over the lazy dog. ", 100)
+	c.Outgoing <- testMsg{V: large}
+	buf := make([]byte, 0, 8192)
+	for {
+		l, ok := ngservice.FrameLength(buf)
+		if !ok {
+			n, err := b.Read(buf[len(buf):cap(buf)])
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			buf = buf[:len(buf)+n]
+			continue
+		}
+		p, ok := ngservice.ReadPacket(&ngen.Context{Read: testRead}, buf[:l])
+		buf = buf[:copy(buf, buf[l:])]
+		if ok && p.Header.MsgType == testMsgType {
+			if p.NetMsg.(*testMsg).V != large {
+				t.Fatalf("Expected the message uncompressed, got %d bytes", len(p.NetMsg.(*testMsg).V))
+			}
+			return
+		}
+		if p.Header.MsgType != ngen.MessageTypeContext {
+			t.Fatalf("Expected the Context and the message, got %+v", p.Header)
+		}
+	}
+}
+
+func TestClientIncomingNotRead(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	errsA, errsB := run(ca, context.Background()), run(cb, context.Background())
+
+	// Fill up the remote Incoming without anyone reading it.
+	for i := 0; i < cap(cb.Incoming)+5; i++ {
+		ca.Outgoing <- &testMsg{V: "spam"}
+	}
+	time.Sleep(10 * time.Millisecond)
+	cb.Close()
+	if cb.Err() != ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", cb.Err())
+	}
+	<-errsA
+	<-errsB
+	if ca.Err() == nil {
+		t.Fatalf("Expected remote to stop with an error")
+	}
+	checkLeaks(t, before)
+}
+
+func TestClientCloseBeforeRun(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newTestClient(a, nil)
+	c.Close()
+	c.Close() // Safe to call twice
+	if err := c.Run(context.Background()); err != ErrRunning {
+		t.Fatalf("Expected ErrRunning from Run after Close, got %v", err)
+	}
+	checkStopped(t, c, ErrClosed, ErrClosed)
+}
+
+func TestReaderSender(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead, FieldVersions: map[ngen.MessageType][]byte{testMsgType: {1}}}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	for _, c := range []*Client{ca, cb} {
+		remote := make(chan *ngen.Context)
+		go Reader(c, ctx, remote)
+		go Sender(c, ctx, remote)
+	}
+
+	ca.Outgoing <- &testMsg{V: "one"}
+	if msg := <-cb.Incoming; msg.(*testMsg).V != "one" {
+		t.Fatalf("Expected one, got %#v", msg)
+	}
+	if err := ca.Run(context.Background()); err != ErrRunning {
+		t.Fatalf("Expected ErrRunning from Run after Reader and Sender, got %v", err)
+	}
+
+	ca.Outgoing <- nil // nil message closes the client
+	<-ca.Done()
+	checkStopped(t, ca, ErrClosed, ErrClosed)
+	cb.Close()
+	checkLeaks(t, before)
+}
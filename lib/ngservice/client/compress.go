@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// errNoCodec is reported for compressed frames from a remote that didn't agree on a codec.
+var errNoCodec = errors.New("client: compressed frame without a codec")
+
+// DefaultCompressionThreshold is the smallest frame content that is compressed if CompressionOptions.Threshold is zero.
+const DefaultCompressionThreshold = 256
+
+// CompressionOptions configure compressing frame contents. Compression is off by default.
+// Codecs are exchanged in the Context handshake, frames are only compressed with a codec both sides support.
+type CompressionOptions struct {
+	// Codecs this side supports, in order of preference. The remote compresses with the first one it supports.
+	Codecs []ngservice.Codec
+	// Threshold is the smallest frame content worth compressing. Smaller frames are sent as they are.
+	Threshold int
+	// Dictionaries preset the codec per message type, for example with common strings.
+	// Both sides need the same dictionaries.
+	Dictionaries map[ngen.MessageType][]byte
+}
+
+// handshake reports whether the Context is exchanged at the start of every connection.
+func (c *Client) handshake(local *ngen.Context) bool {
+	return len(local.FieldVersions) > 0 || len(local.Schemas) > 0 || len(c.Compression.Codecs) > 0
+}
+
+// hello returns the Context sent to the remote, local with the supported codecs.
+func (c *Client) hello(local *ngen.Context) *ngen.Context {
+	if len(c.Compression.Codecs) == 0 {
+		return local
+	}
+	hello := *local
+	hello.Codecs = ngservice.CodecNames(c.Compression.Codecs)
+	return &hello
+}
+
+// recvCodec returns the codec the remote compresses with, the first of ours it supports.
+func (c *Client) recvCodec(remote *ngen.Context) ngservice.Codec {
+	for _, codec := range c.Compression.Codecs {
+		for _, name := range remote.Codecs {
+			if codec.Name() == name {
+				return codec
+			}
+		}
+	}
+	return nil
+}
+
+// compress compresses the last frame in buf, which starts at start, if it is big enough and ctx is
+// the Context of a remote that supports one of our codecs.
+func (c *Client) compress(buf *ngen.Buffer, start uint32, ctx *ngen.Context, mt ngen.MessageType) {
+	if ctx == nil || len(ctx.Codecs) == 0 {
+		return
+	}
+	threshold := c.Compression.Threshold
+	if threshold == 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	codec := ngservice.PickCodec(ctx.Codecs, c.Compression.Codecs)
+	if codec == nil || int(buf.Loc-start)-ngservice.HeaderLength < threshold {
+		return
+	}
+	scratch := ngen.GetBuffer(0)
+	defer ngen.PutBuffer(scratch)
+	if err := ngservice.CompressFrame(buf, start, codec, c.Compression.Dictionaries[mt], scratch); err != nil {
+		// Still valid uncompressed.
+		c.Logger.Warn("failed to compress message", "name", c.name(), "type", mt, "err", err)
+	}
+}
+
+// decompress appends frame with its content decompressed to dst.
+func (c *Client) decompress(dst []byte, frame []byte, codec ngservice.Codec, mt ngen.MessageType) ([]byte, error) {
+	if codec == nil {
+		return nil, errNoCodec
+	}
+	return ngservice.DecompressFrame(dst, frame, codec, c.Compression.Dictionaries[mt])
+}
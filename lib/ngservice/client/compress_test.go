@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// exchangeCompressed sends a small and a large message from ca to cb and returns the bytes written by ca.
+func exchangeCompressed(t *testing.T, ca, cb *Client) int64 {
+	t.Helper()
+	conn := &countingConn{Conn: ca.Conn.(net.Conn)}
+	ca.Conn = conn
+	run(ca, context.Background())
+	run(cb, context.Background())
+	defer cb.Close()
+
+	small, large := "short chat line", strings.Repeat("the quick brown fox jumps over the lazy dog. ", 100)
+	ca.Outgoing <- testMsg{V: small}
+	ca.Outgoing <- testMsg{V: large}
+	for _, expected := range []string{small, large} {
+		if msg := <-cb.Incoming; msg.(*testMsg).V != expected {
+			t.Fatalf("Expected %d byte message, got %d bytes", len(expected), len(msg.(*testMsg).V))
+		}
+	}
+	ca.Close() // Waits for the sender to finish counting.
+	return atomic.LoadInt64(&conn.bytes)
+}
+
+func TestCompression(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	opts := CompressionOptions{
+		Codecs:       []ngservice.Codec{ngservice.Flate},
+		Dictionaries: map[ngen.MessageType][]byte{testMsgType: []byte("quick brown fox lazy dog")},
+	}
+	ca.Compression, cb.Compression = opts, opts
+
+	if n := exchangeCompressed(t, ca, cb); n > 500 {
+		t.Fatalf("Expected large message to be compressed, wrote %d bytes", n)
+	}
+}
+
+func TestCompressionNotNegotiated(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	ca.Compression = CompressionOptions{Codecs: []ngservice.Codec{ngservice.Flate}}
+
+	// cb answers the handshake without codecs, so nothing is compressed.
+	if n := exchangeCompressed(t, ca, cb); n < 4500 {
+		t.Fatalf("Expected uncompressed messages, wrote %d bytes", n)
+	}
+}
+
+func TestDecompressFrame(t *testing.T) {
+	content := strings.Repeat("abc", 500)
+	buf := ngen.GetBuffer(0)
+	defer ngen.PutBuffer(buf)
+	scratch := ngen.GetBuffer(0)
+	defer ngen.PutBuffer(scratch)
+	ngservice.WriteMessageTo(buf, nil, testMsg{V: content})
+	plain := append([]byte(nil), buf.Bytes()...)
+
+	if err := ngservice.CompressFrame(buf, 0, ngservice.Flate, nil, scratch); err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	h, _ := ngservice.FrameHeader(buf.Bytes())
+	if !h.Compressed || h.MsgType != testMsgType || int(buf.Loc) >= len(plain) {
+		t.Fatalf("Expected smaller compressed frame, got %+v in %d bytes", h, buf.Loc)
+	}
+	if mt := ngen.MessageType(ngen.Uint32(buf.Bytes())); mt != ngservice.MessageTypeCompressed {
+		t.Fatalf("Expected compressed frame type %d, got %d", ngservice.MessageTypeCompressed, mt)
+	}
+	if _, ok := ngservice.ReadPacket(&ngen.Context{Read: testRead}, buf.Bytes()); ok {
+		t.Fatalf("Compressed frame must not be decoded directly")
+	}
+	frame, err := ngservice.DecompressFrame(nil, buf.Bytes(), ngservice.Flate, nil)
+	if err != nil || string(frame) != string(plain) {
+		t.Fatalf("Expected original frame back, got %d bytes, %v", len(frame), err)
+	}
+	if _, err := ngservice.DecompressFrame(nil, buf.Bytes()[:buf.Loc-4], ngservice.Flate, nil); err == nil {
+		t.Fatalf("Expected truncated frame to fail")
+	}
+}
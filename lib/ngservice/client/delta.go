@@ -0,0 +1,147 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// errMissingBaseline is reported for a delta whose baseline isn't kept anymore.
+var errMissingBaseline = errors.New("client: delta baseline missing")
+
+// DefaultDeltaHistory is how many sent and received messages of each type are kept as baselines.
+const DefaultDeltaHistory = 32
+
+// deltaStream is the state of delta compressed messages of one type.
+type deltaStream struct {
+	seq       uint32                  // last sent, or last applied when receiving
+	acked     uint32                  // newest baseline the remote acknowledged
+	baselines map[uint32]ngen.Message // recent messages by seq
+}
+
+func (s *deltaStream) keep(seq uint32, msg ngen.Message) {
+	s.baselines[seq] = msg
+	if seq > DefaultDeltaHistory {
+		delete(s.baselines, seq-DefaultDeltaHistory)
+	}
+}
+
+func deltaStreams(streams map[ngen.MessageType]*deltaStream, mt ngen.MessageType) *deltaStream {
+	s := streams[mt]
+	if s == nil {
+		s = &deltaStream{baselines: map[uint32]ngen.Message{}}
+		streams[mt] = s
+	}
+	return s
+}
+
+// Delta returns msg as a delta against the newest message of the same type the remote acknowledged,
+// or with all fields if there is none. Send the result like any other message, the remote client
+// applies it and delivers the complete message on Incoming.
+// The delta holds a copy of msg, so msg can be changed once Delta returns.
+func (c *Client) Delta(msg ngen.DeltaMessage) *ngservice.Delta {
+	mt := msg.MsgType()
+	if cp, ok := c.clone(msg).(ngen.DeltaMessage); ok {
+		msg = cp // Kept as a baseline, never given out.
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sentDeltas == nil {
+		c.sentDeltas = map[ngen.MessageType]*deltaStream{}
+	}
+	s := deltaStreams(c.sentDeltas, mt)
+	s.seq++
+	s.keep(s.seq, msg)
+	d := &ngservice.Delta{Type: mt, Seq: s.seq, Msg: msg}
+	if base, ok := s.baselines[s.acked]; ok && s.acked != 0 {
+		d.Base, d.Baseline = s.acked, base
+	}
+	return d
+}
+
+// applyDelta rebuilds the message of a received delta and acknowledges it as the next baseline.
+// Returns nil without error for deltas older than the last one applied.
+func (c *Client) applyDelta(ctx *ngen.Context, d *ngservice.Delta) (ngen.Message, error) {
+	c.mu.Lock()
+	if c.receivedDeltas == nil {
+		c.receivedDeltas = map[ngen.MessageType]*deltaStream{}
+	}
+	s := deltaStreams(c.receivedDeltas, d.Type)
+	if d.Seq <= s.seq {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	var base ngen.Message
+	if d.Base != 0 {
+		base = s.baselines[d.Base]
+	}
+	c.mu.Unlock()
+
+	if d.Base != 0 && base == nil {
+		c.sendControl(ngservice.BaselineAck{Type: d.Type})
+		return nil, errMissingBaseline
+	}
+	if ctx.ReadDelta == nil {
+		return nil, ngen.ErrNoDelta
+	}
+	msg, err := ctx.ReadDelta(ctx, d.Type, base, ngen.NewBuffer(d.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if d.Seq > s.seq {
+		s.seq = d.Seq
+	}
+	s.keep(d.Seq, msg)
+	c.mu.Unlock()
+	c.sendControl(ngservice.BaselineAck{Type: d.Type, Seq: d.Seq})
+	// msg shares memory with its baseline, the application gets a copy it can change.
+	return c.clone(msg), nil
+}
+
+// clone returns a copy of msg that shares no memory with it, by serializing it and reading it back
+// with the local Settings. Returns msg itself if that isn't possible.
+func (c *Client) clone(msg ngen.Message) ngen.Message {
+	local := c.Settings
+	if local == nil || local.Read == nil {
+		return msg
+	}
+	buf := ngen.GetBuffer(msg.Length(local))
+	defer ngen.PutBuffer(buf)
+	if err := msg.Serialize(local, buf); err != nil {
+		return msg
+	}
+	content := ngen.NewBuffer(buf.Bytes())
+	cp := local.Read(local, msg.MsgType(), content)
+	if cp == nil || content.Err != nil {
+		return msg
+	}
+	return cp
+}
+
+// handleBaselineAck processes baseline acks from the remote.
+// Returns false if msg isn't a baseline ack.
+func (c *Client) handleBaselineAck(msg ngen.Message) bool {
+	a, ok := msg.(*ngservice.BaselineAck)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	if s := c.sentDeltas[a.Type]; s != nil && (a.Seq == 0 || a.Seq > s.acked) {
+		s.acked = a.Seq
+	}
+	c.mu.Unlock()
+	return true
+}
+
+// resetDeltas forgets baselines, a new connection may not have the remote's.
+func (c *Client) resetDeltas() {
+	c.mu.Lock()
+	for _, s := range c.sentDeltas {
+		s.acked = 0
+	}
+	c.receivedDeltas = nil
+	c.mu.Unlock()
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// ErrHeartbeatTimeout is the terminal error of a client that heard nothing from the remote
+// for MaxMissed heartbeat intervals.
+var ErrHeartbeatTimeout = errors.New("client: remote missed heartbeats")
+
+// DefaultMaxMissed is the number of heartbeat intervals without any data from the remote
+// before a client disconnects, if HeartbeatOptions.MaxMissed isn't set.
+const DefaultMaxMissed = 3
+
+// HeartbeatOptions configure liveness checks of the connection. Everything is off by default.
+type HeartbeatOptions struct {
+	// Interval between pings sent to the remote. Zero disables pings and dead peer detection.
+	Interval time.Duration
+	// MaxMissed is how many intervals may pass without reading anything from the remote
+	// before the client stops with ErrHeartbeatTimeout.
+	MaxMissed int
+	// ReadTimeout and WriteTimeout set a deadline on every read and write of the Conn.
+	// They are ignored if the Conn doesn't have SetReadDeadline/SetWriteDeadline.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// RTT returns the round trip time of the last answered ping, or 0 if none was answered yet.
+func (c *Client) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// heartbeat pings the remote every interval and stops the client if nothing was read for too long.
+func (c *Client) heartbeat() error {
+	maxMissed := c.Heartbeat.MaxMissed
+	if maxMissed <= 0 {
+		maxMissed = DefaultMaxMissed
+	}
+	limit := time.Duration(maxMissed) * c.Heartbeat.Interval
+	t := time.NewTicker(c.Heartbeat.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.mu.Lock()
+			idle := time.Since(c.lastRead)
+			c.mu.Unlock()
+			if idle > limit {
+				c.Logger.Warn("remote missed heartbeats", "name", c.name(), "idle", idle)
+				return ErrHeartbeatTimeout
+			}
+			c.sendControl(ngservice.Ping{Sent: int64(time.Since(c.epoch))})
+		case <-c.quit:
+			return nil
+		}
+	}
+}
+
+// handleControl processes heartbeat frames from the remote.
+// Returns false if msg isn't a control frame and should be delivered.
+func (c *Client) handleControl(msg ngen.Message) bool {
+	switch m := msg.(type) {
+	case *ngservice.Ping:
+		c.sendControl(ngservice.Pong{Sent: m.Sent})
+	case *ngservice.Pong:
+		rtt := time.Since(c.epoch) - time.Duration(m.Sent)
+		c.mu.Lock()
+		c.rtt = rtt
+		c.mu.Unlock()
+	default:
+		return false
+	}
+	return true
+}
+
+// sendControl queues a control frame ahead of normal messages.
+// Control frames are dropped rather than blocking if the sender is behind.
+func (c *Client) sendControl(m ngen.Message) {
+	select {
+	case c.control <- m:
+	default:
+	}
+}
+
+// touch records that data was just read from the remote.
+func (c *Client) touch() {
+	c.mu.Lock()
+	c.lastRead = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *Client) setReadDeadline() {
+	if c.Heartbeat.ReadTimeout <= 0 {
+		return
+	}
+	if d, ok := c.Conn.(readDeadliner); ok {
+		d.SetReadDeadline(time.Now().Add(c.Heartbeat.ReadTimeout))
+	}
+}
+
+func (c *Client) setWriteDeadline() {
+	if c.Heartbeat.WriteTimeout <= 0 {
+		return
+	}
+	if d, ok := c.Conn.(writeDeadliner); ok {
+		d.SetWriteDeadline(time.Now().Add(c.Heartbeat.WriteTimeout))
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+func TestHeartbeatRTT(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	ca.Heartbeat = HeartbeatOptions{Interval: 5 * time.Millisecond, MaxMissed: 10}
+	errs := run(ca, context.Background())
+	run(cb, context.Background())
+	defer cb.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for ca.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("No RTT measured, client error: %v", ca.Err())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Remote answers pings without being told to, so we stay connected past MaxMissed.
+	time.Sleep(80 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("Client with answering remote stopped: %v", err)
+	case msg := <-cb.Incoming:
+		t.Fatalf("Heartbeat delivered as message: %#v", msg)
+	default:
+	}
+	ca.Close()
+	checkStopped(t, ca, <-errs, ErrClosed)
+}
+
+func TestHeartbeatDeadPeer(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b) // Remote that never answers.
+	c := newTestClient(a, &ngen.Context{Read: testRead})
+	c.Heartbeat = HeartbeatOptions{Interval: 5 * time.Millisecond}
+
+	start := time.Now()
+	err := c.Run(context.Background())
+	checkStopped(t, c, err, ErrHeartbeatTimeout)
+	if d := time.Since(start); d < DefaultMaxMissed*c.Heartbeat.Interval {
+		t.Fatalf("Disconnected before missing %d heartbeats: %s", DefaultMaxMissed, d)
+	}
+}
+
+func TestHeartbeatReadTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+	c := newTestClient(a, &ngen.Context{Read: testRead})
+	c.Heartbeat = HeartbeatOptions{ReadTimeout: 10 * time.Millisecond}
+
+	err := c.Run(context.Background())
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected read timeout, got: %v", err)
+	}
+}
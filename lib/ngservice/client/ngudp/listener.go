@@ -0,0 +1,256 @@
+package ngudp
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/lologarithm/netgen/lib/ngservice"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+	"github.com/lologarithm/netgen/lib/ngservice/reliable"
+	"github.com/lologarithm/netgen/lib/ngservice/secure"
+)
+
+// Listener accepts UDP connections from clients made with New or Dial.
+// All connections share one socket, datagrams are routed by remote address.
+type Listener struct {
+	udp      *net.UDPConn
+	opts     Options
+	accepted chan *client.Client
+
+	mu     sync.Mutex
+	conns  map[string]*serverConn
+	err    error
+	closed chan struct{}
+}
+
+// Listen opens a UDP socket on addr. opts configure every accepted connection,
+// opts.Reliable.MTU is the largest datagram the server sends, a client asking for less gets less.
+func Listen(addr string, opts Options) (*Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		udp:      udp,
+		opts:     options(opts),
+		accepted: make(chan *client.Client, acceptBacklog),
+		conns:    map[string]*serverConn{},
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// Addr returns the address the listener is bound to.
+func (l *Listener) Addr() net.Addr {
+	return l.udp.LocalAddr()
+}
+
+// Accept waits for the handshake of the next connection and returns a client for it, which isn't running yet.
+func (l *Listener) Accept() (*client.Client, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.closed:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close closes the socket and with it every accepted connection.
+func (l *Listener) Close() error {
+	l.shutdown(ErrClosed)
+	return nil
+}
+
+func (l *Listener) shutdown(err error) {
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		return
+	}
+	l.err = err
+	conns := l.conns
+	l.conns = map[string]*serverConn{}
+	close(l.closed)
+	l.mu.Unlock()
+
+	for _, sc := range conns {
+		sc.Close()
+	}
+	l.udp.Close()
+}
+
+func (l *Listener) serve() {
+	buf := make([]byte, reliable.MaxDatagram)
+	for {
+		n, addr, err := l.udp.ReadFromUDP(buf)
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		l.receive(addr, buf[:n])
+	}
+}
+
+// receive handles a datagram from addr.
+func (l *Listener) receive(addr *net.UDPAddr, d []byte) {
+	l.mu.Lock()
+	sc := l.conns[addr.String()]
+	l.mu.Unlock()
+	switch d[0] {
+	case kindHandshake:
+		l.connect(addr, sc, d)
+	case kindData:
+		if sc != nil {
+			sc.deliver(d[1:])
+		}
+	case kindClose:
+		// Anyone can send it, secure connections end with a sealed close instead, see secure.Conn.
+		if sc != nil && l.opts.Secure == nil {
+			sc.close(false)
+		}
+	}
+}
+
+// connect answers a Connect frame, starting a new connection unless it is a retry of the current one.
+func (l *Listener) connect(addr *net.UDPAddr, sc *serverConn, d []byte) {
+	hello, ok := handshakeFrame(d).(*ngservice.Connect)
+	if !ok {
+		return
+	}
+	if sc != nil && sc.token == hello.Token {
+		l.udp.WriteToUDP(sc.ack, addr) // Our answer was lost.
+		return
+	}
+	if sc != nil {
+		if l.opts.Secure != nil {
+			// Anyone can send a handshake, the current connection has to end first.
+			return
+		}
+		sc.close(false) // Client restarted on the same port.
+	}
+	if l.opts.Secure != nil && len(hello.Key) == 0 {
+		return // Plaintext isn't accepted.
+	}
+	mtu := l.opts.Reliable.MTU
+	if int(hello.MTU) < mtu {
+		mtu = int(hello.MTU)
+	}
+	if mtu-l.opts.overhead() < minPayload {
+		return
+	}
+	ack := ngservice.ConnectAck{Token: hello.Token, MTU: uint16(mtu)}
+	var keys *secure.Keys
+	if l.opts.Secure != nil {
+		exchange, err := secure.NewExchange()
+		if err != nil {
+			return
+		}
+		if keys, err = exchange.Keys(hello.Key, l.opts.Secure, false); err != nil {
+			return
+		}
+		ack.Key = exchange.Public()
+	}
+
+	sc = &serverConn{
+		l:      l,
+		addr:   addr,
+		token:  hello.Token,
+		ack:    datagram(kindHandshake, ngservice.WriteMessage(nil, ack)),
+		recv:   make(chan []byte, recvBacklog),
+		closed: make(chan struct{}),
+	}
+	var conn io.ReadWriteCloser = sc
+	if keys != nil {
+		conn = secure.NewConn(sc, keys)
+	}
+	opts := l.opts.delivery(mtu)
+	c := newClient(addr.String(), reliable.New(conn, opts), opts.MTU)
+
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		c.Conn.Close()
+		return
+	}
+	l.conns[addr.String()] = sc
+	l.mu.Unlock()
+	select {
+	case l.accepted <- c:
+		l.udp.WriteToUDP(sc.ack, addr)
+	default:
+		// Backlog is full, the client retries.
+		c.Conn.Close()
+	}
+}
+
+// serverConn is the datagram conn of one accepted connection.
+type serverConn struct {
+	l     *Listener
+	addr  *net.UDPAddr
+	token uint64
+	ack   []byte // datagram answering the handshake
+
+	recv   chan []byte
+	once   sync.Once
+	closed chan struct{}
+}
+
+// deliver queues a datagram for Read, dropping it if the reader is behind.
+func (sc *serverConn) deliver(d []byte) {
+	select {
+	case sc.recv <- append([]byte(nil), d...):
+	default:
+	}
+}
+
+func (sc *serverConn) Read(p []byte) (int, error) {
+	select {
+	case d := <-sc.recv:
+		return copy(p, d), nil
+	case <-sc.closed:
+		return 0, io.EOF
+	}
+}
+
+func (sc *serverConn) Write(p []byte) (int, error) {
+	select {
+	case <-sc.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if _, err := sc.l.udp.WriteToUDP(datagram(kindData, p), sc.addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close tells the client the connection is gone.
+func (sc *serverConn) Close() error {
+	sc.close(true)
+	return nil
+}
+
+func (sc *serverConn) close(notify bool) {
+	sc.once.Do(func() {
+		close(sc.closed)
+		sc.l.mu.Lock()
+		if sc.l.conns[sc.addr.String()] == sc {
+			delete(sc.l.conns, sc.addr.String())
+		}
+		sc.l.mu.Unlock()
+		if notify {
+			sc.l.udp.WriteToUDP([]byte{kindClose}, sc.addr)
+		}
+	})
+}
@@ -0,0 +1,291 @@
+// Package ngudp carries clients over UDP.
+//
+// Every connection starts with a handshake of ngservice.Connect/ConnectAck frames agreeing on the MTU
+// and, if Options.Secure is set, exchanging keys to seal every datagram with. After that the client's
+// frames (starting with the usual Context exchange) go through the reliable package.
+// Message types sent Unreliable form a lossy channel next to the reliable ordered one, so for example
+// position updates are not held back by a lost chat message. See reliable.Options.Modes.
+package ngudp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+	"github.com/lologarithm/netgen/lib/ngservice/reliable"
+	"github.com/lologarithm/netgen/lib/ngservice/secure"
+)
+
+// First byte of every datagram.
+const (
+	kindHandshake byte = iota + 1
+	kindData
+	kindClose
+)
+
+const (
+	// DefaultHandshakeTimeout is how long Dial waits for the server if ctx has no earlier deadline.
+	DefaultHandshakeTimeout = 5 * time.Second
+	// DefaultHeartbeat is the heartbeat interval of clients made by this package.
+	// UDP doesn't notice a vanished remote, heartbeats do.
+	DefaultHeartbeat = 5 * time.Second
+
+	handshakeRetry = 250 * time.Millisecond
+	acceptBacklog  = 16
+	recvBacklog    = 256
+)
+
+var (
+	// ErrHandshakeTimeout is returned by Dial if the server never answered.
+	ErrHandshakeTimeout = errors.New("ngudp: no answer to handshake")
+	// ErrClosed is returned by Accept once the Listener is closed.
+	ErrClosed = errors.New("ngudp: listener closed")
+	// ErrInsecure is returned by Dial with Options.Secure if the server doesn't encrypt.
+	ErrInsecure = errors.New("ngudp: server does not encrypt")
+)
+
+// Options configure the connections of a Listener or client.
+type Options struct {
+	// Reliable configures delivery, Reliable.MTU is the largest datagram sent.
+	Reliable reliable.Options
+	// Secure, if set, encrypts connections with keys exchanged in the handshake.
+	// A Listener with Secure only accepts encrypted connections, a client with Secure only connects to one.
+	Secure *secure.Config
+}
+
+// overhead is the number of bytes in each datagram in front of the reliable layer.
+func (o Options) overhead() int {
+	if o.Secure != nil {
+		return 1 + secure.Overhead
+	}
+	return 1
+}
+
+// delivery returns the reliable options of a connection with the agreed MTU, leaving room for the overhead
+// of the transport in every datagram.
+func (o Options) delivery(mtu int) reliable.Options {
+	r := o.Reliable
+	r.MTU = mtu - o.overhead()
+	r.MaxDatagram = reliable.MaxDatagram - o.overhead()
+	return r
+}
+
+// minPayload fits a reliable header with one frame header.
+const minPayload = reliable.Overhead + ngservice.HeaderLength
+
+// options fills in the defaults of the transport. Heartbeats are sent unreliable unless configured otherwise.
+func options(o Options) Options {
+	opts := o.Reliable
+	if opts.MTU <= 0 {
+		opts.MTU = reliable.DefaultMTU
+	}
+	modes := map[ngen.MessageType]reliable.Mode{
+		ngservice.MessageTypePing: reliable.Unreliable,
+		ngservice.MessageTypePong: reliable.Unreliable,
+	}
+	for mt, m := range opts.Modes {
+		modes[mt] = m
+	}
+	opts.Modes = modes
+	o.Reliable = opts
+	return o
+}
+
+// newClient wraps conn, batching frames into datagrams of payload bytes.
+func newClient(name string, conn io.ReadWriteCloser, payload int) *client.Client {
+	return &client.Client{
+		Name:      name,
+		Conn:      conn,
+		Outgoing:  make(chan ngen.Message, 10),
+		Incoming:  make(chan ngen.Message, 10),
+		Batch:     client.BatchOptions{MaxBytes: payload - reliable.Overhead},
+		Heartbeat: client.HeartbeatOptions{Interval: DefaultHeartbeat},
+	}
+}
+
+// New is used by a go client to connect to a Listener at addr.
+// The client redoes the handshake with addr if the connection is lost.
+func New(addr string, opts Options) (*client.Client, error) {
+	conn, payload, err := dial(context.Background(), addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(addr, conn, payload)
+	c.Dial = func(ctx context.Context) (io.ReadWriteCloser, error) {
+		conn, payload, err := dial(ctx, addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		// The server may agree on another MTU. Run only dials while nothing is written.
+		c.Batch.MaxBytes = payload - reliable.Overhead
+		return conn, nil
+	}
+	return c, nil
+}
+
+// Dial connects to a Listener at addr. Used as client.Client.Dial.
+func Dial(ctx context.Context, addr string, opts Options) (io.ReadWriteCloser, error) {
+	conn, _, err := dial(ctx, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial returns the connection and the payload size of its datagrams.
+func dial(ctx context.Context, addr string, opts Options) (*reliable.Conn, int, error) {
+	opts = options(opts)
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	mtu, keys, err := handshake(ctx, udp, opts)
+	if err != nil {
+		udp.Close()
+		return nil, 0, err
+	}
+	var conn io.ReadWriteCloser = &clientConn{udp: udp, secure: keys != nil}
+	if keys != nil {
+		conn = secure.NewConn(conn, keys)
+	}
+	r := opts.delivery(mtu)
+	return reliable.New(conn, r), r.MTU, nil
+}
+
+// handshake sends Connect until the server acknowledges it and returns the agreed MTU
+// and, with opts.Secure, the session keys.
+func handshake(ctx context.Context, udp *net.UDPConn, opts Options) (int, *secure.Keys, error) {
+	connect := ngservice.Connect{Token: newToken(), MTU: uint16(opts.Reliable.MTU)}
+	var exchange *secure.Exchange
+	if opts.Secure != nil {
+		var err error
+		if exchange, err = secure.NewExchange(); err != nil {
+			return 0, nil, err
+		}
+		connect.Key = exchange.Public()
+	}
+	hello := datagram(kindHandshake, ngservice.WriteMessage(nil, connect))
+	deadline := time.Now().Add(DefaultHandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	defer udp.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, reliable.MaxDatagram)
+	for time.Now().Before(deadline) {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		if _, err := udp.Write(hello); err != nil {
+			return 0, nil, err
+		}
+		retry := time.Now().Add(handshakeRetry)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		udp.SetReadDeadline(retry)
+		for {
+			n, err := udp.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			} else if err != nil {
+				return 0, nil, err
+			}
+			ack, ok := handshakeFrame(buf[:n]).(*ngservice.ConnectAck)
+			if !ok || ack.Token != connect.Token {
+				continue
+			}
+			if exchange == nil {
+				return int(ack.MTU), nil, nil
+			} else if len(ack.Key) == 0 {
+				return 0, nil, ErrInsecure
+			}
+			keys, err := exchange.Keys(ack.Key, opts.Secure, true)
+			return int(ack.MTU), keys, err
+		}
+	}
+	return 0, nil, ErrHandshakeTimeout
+}
+
+// handshakeFrame decodes a handshake datagram, returning nil for anything else.
+func handshakeFrame(d []byte) ngen.Message {
+	if len(d) < 1+ngservice.HeaderLength || d[0] != kindHandshake {
+		return nil
+	}
+	switch ngen.MessageType(ngen.Uint32(d[1:])) {
+	case ngservice.MessageTypeConnect, ngservice.MessageTypeConnectAck:
+		p, _ := ngservice.ReadPacket(nil, d[1:])
+		return p.NetMsg
+	}
+	return nil
+}
+
+func datagram(kind byte, payload []byte) []byte {
+	d := make([]byte, 1+len(payload))
+	d[0] = kind
+	copy(d[1:], payload)
+	return d
+}
+
+func newToken() uint64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return binary.LittleEndian.Uint64(b)
+}
+
+// clientConn is the datagram conn of a dialed connection.
+type clientConn struct {
+	udp    *net.UDPConn
+	secure bool // only a sealed close ends the connection, see secure.Conn
+	once   sync.Once
+}
+
+func (cc *clientConn) Read(p []byte) (int, error) {
+	for {
+		n, err := cc.udp.Read(p)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		switch p[0] {
+		case kindData:
+			return copy(p, p[1:n]), nil
+		case kindClose:
+			if !cc.secure {
+				return 0, io.EOF
+			}
+		}
+		// Late handshake answers are ignored.
+	}
+}
+
+func (cc *clientConn) Write(p []byte) (int, error) {
+	if _, err := cc.udp.Write(datagram(kindData, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close tells the server the connection is gone, so it doesn't wait for heartbeats to run out.
+func (cc *clientConn) Close() error {
+	var err error
+	cc.once.Do(func() {
+		cc.udp.Write([]byte{kindClose})
+		err = cc.udp.Close()
+	})
+	return err
+}
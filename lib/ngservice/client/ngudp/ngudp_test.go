@@ -0,0 +1,315 @@
+package ngudp
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+	"github.com/lologarithm/netgen/lib/ngservice/reliable"
+	"github.com/lologarithm/netgen/lib/ngservice/secure"
+)
+
+const (
+	textType ngen.MessageType = 100 // reliable ordered
+	posType  ngen.MessageType = 101 // unreliable
+)
+
+type textMsg struct {
+	V string
+}
+
+func (m textMsg) MsgType() ngen.MessageType { return textType }
+
+func (m textMsg) Length(*ngen.Context) int { return 4 + len(m.V) }
+
+func (m textMsg) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteString(m.V)
+	return buf.Err
+}
+
+type posMsg struct {
+	X, Y int32
+	Pad  string
+}
+
+func (m posMsg) MsgType() ngen.MessageType { return posType }
+
+func (m posMsg) Length(*ngen.Context) int { return 12 + len(m.Pad) }
+
+func (m posMsg) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteInt32(m.X)
+	buf.WriteInt32(m.Y)
+	buf.WriteString(m.Pad)
+	return buf.Err
+}
+
+func testRead(_ *ngen.Context, mt ngen.MessageType, buf *ngen.Buffer) ngen.Message {
+	switch mt {
+	case ngen.MessageTypeContext:
+		return ngen.DeserializeContext(&ngen.Context{Read: testRead}, buf)
+	case textType:
+		return &textMsg{V: buf.ReadString()}
+	case posType:
+		return &posMsg{X: buf.ReadInt32(), Y: buf.ReadInt32(), Pad: buf.ReadString()}
+	}
+	return nil
+}
+
+// versioned settings make both sides exchange their Context before anything else.
+var settings = &ngen.Context{Read: testRead, FieldVersions: map[ngen.MessageType][]byte{textType: {1}}}
+
+var opts = Options{Reliable: reliable.Options{Modes: map[ngen.MessageType]reliable.Mode{posType: reliable.Unreliable}}}
+
+func receive(t *testing.T, incoming chan ngen.Message) ngen.Message {
+	t.Helper()
+	select {
+	case msg := <-incoming:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+	return nil
+}
+
+// connect starts a listener and a client connected to it.
+func connect(t *testing.T, serverOpts, clientOpts Options) (*Listener, *client.Client, *client.Client) {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0", serverOpts)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	c, err := New(l.Addr().String(), clientOpts)
+	if err != nil {
+		l.Close()
+		t.Fatalf("New failed: %v", err)
+	}
+	sc, err := l.Accept()
+	if err != nil {
+		l.Close()
+		t.Fatalf("Accept failed: %v", err)
+	}
+	client.ManageClient(settings, c)
+	client.ManageClient(settings, sc)
+	return l, c, sc
+}
+
+func TestExchange(t *testing.T) {
+	l, c, sc := connect(t, opts, opts)
+	defer l.Close()
+	defer c.Close()
+
+	c.Outgoing <- textMsg{V: "hello"}
+	if msg := receive(t, sc.Incoming).(*textMsg); msg.V != "hello" {
+		t.Fatalf("Expected hello, got %#v", msg)
+	}
+	sc.Outgoing <- posMsg{X: 1, Y: 2}
+	if msg := receive(t, c.Incoming).(*posMsg); msg.X != 1 || msg.Y != 2 {
+		t.Fatalf("Expected position, got %#v", msg)
+	}
+
+	c.Close()
+	select {
+	case <-sc.Done():
+		if sc.Err() != io.EOF {
+			t.Fatalf("Expected server side to see EOF, got: %v", sc.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Server side didn't notice client closing")
+	}
+}
+
+func TestMTU(t *testing.T) {
+	clientOpts := opts
+	clientOpts.Reliable.MTU = 500
+	l, c, sc := connect(t, opts, clientOpts)
+	defer l.Close()
+	defer c.Close()
+	defer sc.Close()
+
+	// Unreliable messages must fit in the MTU the server agreed to, larger reliable ones still arrive.
+	c.Outgoing <- posMsg{X: 1, Pad: strings.Repeat("x", 500)}
+	c.Outgoing <- textMsg{V: strings.Repeat("y", 5000)}
+	c.Outgoing <- posMsg{X: 2, Pad: strings.Repeat("x", 400)}
+	if msg := receive(t, sc.Incoming).(*textMsg); len(msg.V) != 5000 {
+		t.Fatalf("Expected 5000 byte text, got %d", len(msg.V))
+	}
+	if msg := receive(t, sc.Incoming).(*posMsg); msg.X != 2 {
+		t.Fatalf("Expected oversized position to be dropped, got %#v", msg)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Dial(ctx, silent.LocalAddr().String(), opts); err != ErrHandshakeTimeout {
+		t.Fatalf("Expected %v, got %v", ErrHandshakeTimeout, err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l, c, sc := connect(t, opts, opts)
+	defer c.Close()
+	l.Close()
+	<-sc.Done()
+	if _, err := l.Accept(); err != ErrClosed {
+		t.Fatalf("Expected %v, got %v", ErrClosed, err)
+	}
+	select {
+	case <-c.Done():
+		t.Fatalf("Client should reconnect instead of stopping: %v", c.Err())
+	default:
+	}
+}
+
+func TestSecure(t *testing.T) {
+	secureOpts := opts
+	secureOpts.Secure = &secure.Config{PresharedKey: []byte("local test key")}
+	l, c, sc := connect(t, secureOpts, secureOpts)
+	defer l.Close()
+	defer c.Close()
+	defer sc.Close()
+
+	c.Outgoing <- textMsg{V: strings.Repeat("secret ", 1000)}
+	if msg := receive(t, sc.Incoming).(*textMsg); len(msg.V) != 7000 {
+		t.Fatalf("Expected 7000 byte text, got %d", len(msg.V))
+	}
+	sc.Outgoing <- posMsg{X: 1, Y: 2}
+	if msg := receive(t, c.Incoming).(*posMsg); msg.X != 1 || msg.Y != 2 {
+		t.Fatalf("Expected position, got %#v", msg)
+	}
+}
+
+func TestSecureMismatch(t *testing.T) {
+	secureOpts := opts
+	secureOpts.Secure = &secure.Config{}
+
+	plain, err := Listen("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer plain.Close()
+	if _, err := Dial(context.Background(), plain.Addr().String(), secureOpts); err != ErrInsecure {
+		t.Fatalf("Expected %v, got %v", ErrInsecure, err)
+	}
+
+	encrypted, err := Listen("127.0.0.1:0", secureOpts)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer encrypted.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Dial(ctx, encrypted.Addr().String(), opts); err != ErrHandshakeTimeout {
+		t.Fatalf("Expected plaintext client to be ignored, got %v", err)
+	}
+}
+
+func TestSecureMaxFrame(t *testing.T) {
+	secureOpts := opts
+	secureOpts.Secure = &secure.Config{PresharedKey: []byte("local test key")}
+	l, c, sc := connect(t, secureOpts, secureOpts)
+	defer l.Close()
+	defer c.Close()
+	defer sc.Close()
+
+	// Frames only fit if the reliable header, the seal and the kind byte fit in a UDP datagram too.
+	largest := reliable.MaxDatagram - secureOpts.overhead() - reliable.Overhead - ngservice.HeaderLength - 4
+	c.Outgoing <- textMsg{V: strings.Repeat("x", largest+1)}
+	c.Outgoing <- textMsg{V: strings.Repeat("y", largest)}
+	if msg := receive(t, sc.Incoming).(*textMsg); len(msg.V) != largest {
+		t.Fatalf("Expected %d byte text, got %d", largest, len(msg.V))
+	}
+}
+
+func TestRedialMTU(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+	c, err := New(addr, opts)
+	if err != nil {
+		l.Close()
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	batches := make(chan int, 1)
+	c.OnReconnected = func(bool) { batches <- c.Batch.MaxBytes }
+	if c.Batch.MaxBytes != reliable.DefaultMTU-1-reliable.Overhead {
+		t.Fatalf("Unexpected batch size %d", c.Batch.MaxBytes)
+	}
+	client.ManageClient(settings, c)
+
+	// The server comes back with a smaller MTU.
+	l.Close()
+	smaller := opts
+	smaller.Reliable.MTU = 600
+	if l, err = Listen(addr, smaller); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	client.ManageClient(settings, sc)
+	defer sc.Close()
+	select {
+	case size := <-batches:
+		if size != 600-1-reliable.Overhead {
+			t.Fatalf("Expected batches of the new MTU, got %d", size)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Client didn't reconnect")
+	}
+}
+
+func TestSecureSpoofedClose(t *testing.T) {
+	secureOpts := opts
+	secureOpts.Secure = &secure.Config{PresharedKey: []byte("local test key")}
+	l, c, sc := connect(t, secureOpts, secureOpts)
+	defer l.Close()
+	defer c.Close()
+	defer sc.Close()
+
+	// Plaintext closes and restarts claiming to come from the client, and a close sent to the client.
+	addr, err := net.ResolveUDPAddr("udp", sc.Name)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	exchange, err := secure.NewExchange()
+	if err != nil {
+		t.Fatalf("NewExchange failed: %v", err)
+	}
+	l.receive(addr, []byte{kindClose})
+	l.receive(addr, datagram(kindHandshake, ngservice.WriteMessage(nil, ngservice.Connect{Token: newToken(), MTU: reliable.DefaultMTU, Key: exchange.Public()})))
+	l.udp.WriteToUDP([]byte{kindClose}, addr)
+
+	c.Outgoing <- textMsg{V: "still here"}
+	if msg := receive(t, sc.Incoming).(*textMsg); msg.V != "still here" {
+		t.Fatalf("Expected text, got %#v", msg)
+	}
+	sc.Outgoing <- textMsg{V: "me too"}
+	if msg := receive(t, c.Incoming).(*textMsg); msg.V != "me too" {
+		t.Fatalf("Expected text, got %#v", msg)
+	}
+
+	// The sealed close still ends the connection.
+	c.Close()
+	select {
+	case <-sc.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Server side didn't stop after the client closed")
+	}
+}
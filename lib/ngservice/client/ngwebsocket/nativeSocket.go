@@ -3,6 +3,11 @@
 package ngwebsocket
 
 import (
+	"context"
+	"io"
+	"net"
+	"time"
+
 	"github.com/lologarithm/netgen/lib/ngen"
 	"github.com/lologarithm/netgen/lib/ngservice/client"
 	"golang.org/x/net/websocket"
@@ -21,14 +26,12 @@ func AcceptConn(conn *websocket.Conn) *client.Client {
 }
 
 // New is used by a go client to open a websocket to a server.
+// The client reconnects to url if the connection is lost, onOpen is only called for the first connection.
 func New(url, origin string, onOpen func()) (*client.Client, error) {
-	conn, err := websocket.Dial(url, "", origin)
+	ws, err := Dial(context.Background(), url, origin)
 	if err != nil {
 		return nil, err
 	}
-	ws := &BinaryWebsocket{
-		socket: conn,
-	}
 	if onOpen != nil {
 		go func() {
 			onOpen()
@@ -39,27 +42,60 @@ func New(url, origin string, onOpen func()) (*client.Client, error) {
 		Conn:     ws,
 		Outgoing: make(chan ngen.Message, 10),
 		Incoming: make(chan ngen.Message, 10),
+		Dial: func(ctx context.Context) (io.ReadWriteCloser, error) {
+			return Dial(ctx, url, origin)
+		},
 	}, nil
 }
 
+// Dial opens a websocket to url. Used as client.Client.Dial.
+func Dial(ctx context.Context, url, origin string) (io.ReadWriteCloser, error) {
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		config.Dialer.Deadline = deadline
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryWebsocket{socket: conn}, nil
+}
+
 type BinaryWebsocket struct {
-	socket *websocket.Conn
+	socket  *websocket.Conn
+	pending []byte // part of the last websocket message that didn't fit in Read
 }
 
 func (ws *BinaryWebsocket) Read(p []byte) (n int, err error) {
-	var inbuf []byte
-	err = websocket.Message.Receive(ws.socket, &inbuf)
-	if err != nil {
-		return 0, err
+	if len(ws.pending) == 0 {
+		err = websocket.Message.Receive(ws.socket, &ws.pending)
+		if err != nil {
+			return 0, err
+		}
 	}
-	copy(p, inbuf)
-	return len(inbuf), err
+	n = copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
 }
 
 func (ws *BinaryWebsocket) Close() error {
 	return ws.socket.Close()
 }
 
+// SetReadDeadline lets client.HeartbeatOptions.ReadTimeout apply to the websocket.
+func (ws *BinaryWebsocket) SetReadDeadline(t time.Time) error {
+	return ws.socket.SetReadDeadline(t)
+}
+
+// SetWriteDeadline lets client.HeartbeatOptions.WriteTimeout apply to the websocket.
+func (ws *BinaryWebsocket) SetWriteDeadline(t time.Time) error {
+	return ws.socket.SetWriteDeadline(t)
+}
+
 func (ws *BinaryWebsocket) Write(p []byte) (n int, err error) {
 	err = websocket.Message.Send(ws.socket, p)
 	return len(p), err
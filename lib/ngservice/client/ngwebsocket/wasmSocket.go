@@ -3,7 +3,10 @@
 package ngwebsocket
 
 import (
+	"context"
 	"errors"
+	"io"
+	"sync"
 	"syscall/js"
 	"time"
 
@@ -11,75 +14,159 @@ import (
 	"github.com/lologarithm/netgen/lib/ngservice/client"
 )
 
+// DefaultHeartbeat is the heartbeat interval of clients made by New. Reads of a browser websocket can't time out,
+// so heartbeats are what notices a server that went silent on a half open connection.
+const DefaultHeartbeat = 20 * time.Second
+
 // NewClient to follow the pattern from the server client.
-func New(url, _ string, onConnect func()) (*client.Client, error) {
+// The client reconnects to url if the connection is lost, onConnect is only called for the first connection.
+func New(url, origin string, onConnect func()) (*client.Client, error) {
+	ws := open(url)
+	go func() {
+		select {
+		case <-ws.opened:
+			onConnect()
+		case <-ws.closed:
+		}
+	}()
+
+	return &client.Client{
+		Conn:     ws,
+		Outgoing: make(chan ngen.Message, 10),
+		Incoming: make(chan ngen.Message, 10),
+		Dial: func(ctx context.Context) (io.ReadWriteCloser, error) {
+			return Dial(ctx, url, origin)
+		},
+		Heartbeat: client.HeartbeatOptions{Interval: DefaultHeartbeat},
+	}, nil
+}
+
+// Dial opens a websocket to url and waits until it is connected. Used as client.Client.Dial.
+func Dial(ctx context.Context, url, _ string) (io.ReadWriteCloser, error) {
+	ws := open(url)
+	select {
+	case <-ws.opened:
+		return ws, nil
+	case <-ws.closed:
+		return nil, errors.New("ngwebsocket: failed to connect to " + url)
+	case <-ctx.Done():
+		ws.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// open starts connecting a browser websocket.
+func open(url string) *wsjs {
 	conn := js.Global().Get("WebSocket").New(url)
 	conn.Set("binaryType", "arraybuffer")
-	conn.Call("addEventListener", "open", js.FuncOf(func(this js.Value, args []js.Value) interface{} { onConnect(); return nil }), false)
 
 	ws := &wsjs{
 		conn:     conn,
-		buffer:   make([]byte, 4096),
-		idx:      0,
 		framebuf: make(chan []byte, 2), // can hold 2 frames
+		opened:   make(chan struct{}),
+		closed:   make(chan struct{}),
 	}
-
-	onMessage := func(this js.Value, args []js.Value) interface{} {
+	ws.listen("open", func(args []js.Value) {
+		close(ws.opened)
+	})
+	ws.listen("close", func(args []js.Value) {
+		ws.shutdown()
+	})
+	ws.listen("message", func(args []js.Value) {
 		data := args[0].Get("data")
 		slice := make([]byte, data.Get("byteLength").Int())
 		view := js.Global().Get("Uint8Array").New(data)
 		js.CopyBytesToGo(slice, view)
 		go func() {
-			ws.framebuf <- slice
+			select {
+			case ws.framebuf <- slice:
+			case <-ws.closed:
+			}
 		}()
-		return nil
-	}
+	})
+	return ws
+}
 
-	conn.Call("addEventListener", "message", js.FuncOf(onMessage), false)
+// errTimeout is returned by Read when the read deadline passes.
+var errTimeout error = timeoutError{}
 
-	// TODO: handle disconnects/reconnects
+type timeoutError struct{}
 
-	return &client.Client{
-		Conn:     ws,
-		Outgoing: make(chan ngen.Message, 10),
-		Incoming: make(chan ngen.Message, 10),
-	}, nil
-}
+func (timeoutError) Error() string   { return "ngwebsocket: read timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
 
 type wsjs struct {
-	conn     js.Value
-	buffer   []byte
-	idx      int
-	framebuf chan []byte
+	conn      js.Value
+	pending   []byte // part of the last websocket message that didn't fit in Read
+	framebuf  chan []byte
+	opened    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	funcs     []js.Func
+	deadline  time.Time
+}
+
+// listen adds an event listener that is released once the socket is closed.
+func (ws *wsjs) listen(event string, f func(args []js.Value)) {
+	fn := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		f(args)
+		return nil
+	})
+	ws.funcs = append(ws.funcs, fn)
+	ws.conn.Call("addEventListener", event, fn, false)
+}
+
+// shutdown unblocks Read and releases the event listeners.
+func (ws *wsjs) shutdown() {
+	ws.closeOnce.Do(func() {
+		close(ws.closed)
+		for _, fn := range ws.funcs {
+			fn.Release()
+		}
+	})
+}
+
+// SetReadDeadline lets client.HeartbeatOptions.ReadTimeout apply to the websocket.
+func (ws *wsjs) SetReadDeadline(t time.Time) error {
+	ws.deadline = t
+	return nil
 }
 
 func (ws *wsjs) Read(p []byte) (int, error) {
-	if ws.idx == 0 {
+	if len(ws.pending) == 0 {
+		var timeout <-chan time.Time
+		if !ws.deadline.IsZero() {
+			t := time.NewTimer(time.Until(ws.deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
 		select {
-		case slice := <-ws.framebuf:
-			copy(ws.buffer[ws.idx:], slice)
-			ws.idx += len(slice)
-		case <-time.NewTimer(time.Second * 60).C:
-			// No message for 60 seconds.. seems like its dead?
-			return 0, errors.New("failed to read")
+		case ws.pending = <-ws.framebuf:
+		case <-timeout:
+			return 0, errTimeout
+		case <-ws.closed:
+			return 0, io.EOF
 		}
 	}
 
-	num := ws.idx
-	if len(p) < num {
-		num = len(p) // can't read more than will fit.
-	}
-	copy(p, ws.buffer[:num])
-	ws.idx -= num
+	num := copy(p, ws.pending) // can't read more than will fit.
+	ws.pending = ws.pending[num:]
 	return num, nil
 }
 
 func (ws *wsjs) Close() error {
+	ws.shutdown()
 	ws.conn.Call("close")
 	return nil
 }
 
 func (ws *wsjs) Write(p []byte) (int, error) {
+	select {
+	case <-ws.opened:
+	case <-ws.closed:
+		return 0, io.ErrClosedPipe
+	}
 	// technically N is wrong here, but the err should make this ok...
 	var err error
 	defer func() {
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+var (
+	// ErrQueueFull is returned when a message could not be queued and was dropped.
+	ErrQueueFull = errors.New("client: send queue full")
+	// ErrSlowConsumer is the terminal error of a client disconnected by the Disconnect overflow policy.
+	ErrSlowConsumer = errors.New("client: disconnected slow consumer")
+)
+
+// OverflowPolicy decides what happens when a message is sent to a full queue.
+type OverflowPolicy int
+
+const (
+	// Block waits for space in the queue. TrySend returns ErrQueueFull instead of waiting.
+	Block OverflowPolicy = iota
+	// DropOldest removes the oldest queued message to make room.
+	DropOldest
+	// DropNewest drops the message being sent.
+	DropNewest
+	// Disconnect closes the client with ErrSlowConsumer.
+	Disconnect
+)
+
+// DefaultQueueSize is the queue size used if QueueOptions.Size is not set.
+const DefaultQueueSize = 64
+
+// QueueOptions configure the send queue used by Send and TrySend.
+type QueueOptions struct {
+	Size     int
+	Overflow OverflowPolicy
+	// Coalesce lists message types where only the latest queued message matters, such as state updates.
+	// Sending one of these replaces a message of the same type that is still queued.
+	Coalesce []ngen.MessageType
+}
+
+// sendQueue is a fixed size ring of messages waiting to be written.
+type sendQueue struct {
+	mu       sync.Mutex
+	buf      []ngen.Message
+	head     int
+	n        int
+	policy   OverflowPolicy
+	coalesce map[ngen.MessageType]bool
+	left     int // messages to pop until the queue ends after close, -1 if it isn't closed
+
+	ready chan struct{} // signaled when messages are added
+	space chan struct{} // signaled when messages are removed
+}
+
+func newSendQueue(opts QueueOptions) *sendQueue {
+	size := opts.Size
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	q := &sendQueue{
+		buf:      make([]ngen.Message, size),
+		policy:   opts.Overflow,
+		coalesce: make(map[ngen.MessageType]bool, len(opts.Coalesce)),
+		left:     -1,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+	}
+	for _, mt := range opts.Coalesce {
+		q.coalesce[mt] = true
+	}
+	return q
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push adds the message to the queue. If the queue is full it returns false, unless
+// the message was coalesced or the policy made room by dropping a message.
+// dropped is the message removed from the queue, if any.
+func (q *sendQueue) push(m ngen.Message) (ok bool, dropped ngen.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.coalesce[m.MsgType()] {
+		for i := 0; i < q.n; i++ {
+			idx := (q.head + i) % len(q.buf)
+			if q.buf[idx].MsgType() == m.MsgType() {
+				dropped = q.buf[idx]
+				q.buf[idx] = m
+				return true, dropped
+			}
+		}
+	}
+	if q.n == len(q.buf) {
+		if q.policy != DropOldest {
+			return false, nil
+		}
+		dropped = q.buf[q.head]
+		q.buf[q.head] = nil
+		q.head = (q.head + 1) % len(q.buf)
+		q.n--
+		if q.left > 0 {
+			q.left--
+		}
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = m
+	q.n++
+	signal(q.ready)
+	return true, dropped
+}
+
+func (q *sendQueue) pop() ngen.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return nil
+	}
+	m := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	if q.left > 0 {
+		q.left--
+	}
+	signal(q.space)
+	return m
+}
+
+// close ends the queue after the messages that are queued now.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	if q.left < 0 {
+		q.left = q.n
+	}
+	q.mu.Unlock()
+	signal(q.ready)
+}
+
+// closed reports whether all messages queued before close were popped.
+func (q *sendQueue) closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.left == 0
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// Send queues a message to be written following the queue's overflow policy.
+// With the Block policy Send waits until there is space, ctx is done or the client stops.
+func (c *Client) Send(ctx context.Context, m ngen.Message) error {
+	c.init()
+	for {
+		err := c.TrySend(m)
+		if err != ErrQueueFull || c.queue.policy != Block {
+			return err
+		}
+		select {
+		case <-c.queue.space:
+			// Retry, another sender may have taken the space first.
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.stop:
+			return c.Err()
+		}
+	}
+}
+
+// TrySend queues a message without ever blocking. Returns ErrQueueFull if the message was not queued.
+func (c *Client) TrySend(m ngen.Message) error {
+	c.init()
+	select {
+	case <-c.stop:
+		return c.Err()
+	default:
+	}
+	ok, dropped := c.queue.push(m)
+	if dropped != nil {
+		c.Metrics.MessageDropped(dropped.MsgType())
+	}
+	if ok {
+		return nil
+	}
+	switch c.queue.policy {
+	case Disconnect:
+		c.Logger.Warn("send queue full, disconnecting", "name", c.name())
+		c.shutdown(ErrSlowConsumer)
+		return ErrSlowConsumer
+	case DropNewest:
+		c.Metrics.MessageDropped(m.MsgType())
+	}
+	return ErrQueueFull
+}
+
+// forward moves the messages sent on Outgoing into the send queue until the client stops, so they follow
+// the queue's size, overflow policy and coalescing, and are written in the order they were queued.
+// A nil message closes the client once the messages queued before it are written.
+func (c *Client) forward(done chan<- struct{}) {
+	defer close(done)
+	for {
+		select {
+		case m := <-c.Outgoing:
+			if m == nil {
+				c.queue.close() // Empty message means die
+				return
+			}
+			if err := c.Send(context.Background(), m); err != nil && err != ErrQueueFull {
+				return // The client stopped.
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// QueueLen returns the number of messages waiting to be written,
+// including messages on the Outgoing channel.
+func (c *Client) QueueLen() int {
+	c.init()
+	return c.queue.len() + len(c.Outgoing)
+}
+
+// QueueCap returns the size of the send queue.
+func (c *Client) QueueCap() int {
+	c.init()
+	return len(c.queue.buf)
+}
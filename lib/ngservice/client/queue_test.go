@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+const stateMsgType ngen.MessageType = 1001
+
+// stateMsg is a second message type used to test coalescing.
+type stateMsg struct {
+	testMsg
+}
+
+func (m stateMsg) MsgType() ngen.MessageType { return stateMsgType }
+
+func queuedValues(c *Client) []string {
+	vals := []string{}
+	for m := c.queue.pop(); m != nil; m = c.queue.pop() {
+		switch tm := m.(type) {
+		case testMsg:
+			vals = append(vals, tm.V)
+		case stateMsg:
+			vals = append(vals, "state:"+tm.V)
+		}
+	}
+	return vals
+}
+
+func checkValues(t *testing.T, actual []string, expected ...string) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	c := &Client{Queue: QueueOptions{Size: 2, Overflow: DropOldest}}
+	for _, v := range []string{"1", "2", "3"} {
+		if err := c.TrySend(testMsg{V: v}); err != nil {
+			t.Fatalf("TrySend failed: %s", err)
+		}
+	}
+	if c.QueueLen() != 2 || c.QueueCap() != 2 {
+		t.Fatalf("Unexpected queue len/cap: %d/%d", c.QueueLen(), c.QueueCap())
+	}
+	checkValues(t, queuedValues(c), "2", "3")
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	c := &Client{Queue: QueueOptions{Size: 2, Overflow: DropNewest}}
+	c.TrySend(testMsg{V: "1"})
+	c.TrySend(testMsg{V: "2"})
+	if err := c.Send(context.Background(), testMsg{V: "3"}); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+	checkValues(t, queuedValues(c), "1", "2")
+}
+
+func TestQueueBlock(t *testing.T) {
+	c := &Client{Queue: QueueOptions{Size: 1}}
+	c.TrySend(testMsg{V: "1"})
+	if err := c.TrySend(testMsg{V: "2"}); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Send(ctx, testMsg{V: "2"}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected send to time out, got %v", err)
+	}
+
+	sent := make(chan error)
+	go func() { sent <- c.Send(context.Background(), testMsg{V: "3"}) }()
+	time.Sleep(5 * time.Millisecond)
+	checkValues(t, []string{c.queue.pop().(testMsg).V}, "1")
+	if err := <-sent; err != nil {
+		t.Fatalf("Blocked send failed: %s", err)
+	}
+	checkValues(t, queuedValues(c), "3")
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &Client{Conn: a, Incoming: make(chan ngen.Message), Queue: QueueOptions{Size: 1, Overflow: Disconnect}}
+	c.TrySend(testMsg{V: "1"})
+	if err := c.TrySend(testMsg{V: "2"}); err != ErrSlowConsumer {
+		t.Fatalf("Expected ErrSlowConsumer, got %v", err)
+	}
+	if err := c.TrySend(testMsg{V: "3"}); err != ErrSlowConsumer {
+		t.Fatalf("Expected sends after disconnect to fail, got %v", err)
+	}
+	if err := c.Run(context.Background()); err != ErrSlowConsumer {
+		t.Fatalf("Expected client to stop with ErrSlowConsumer, got %v", err)
+	}
+}
+
+func TestQueueCoalesce(t *testing.T) {
+	c := &Client{Queue: QueueOptions{Size: 2, Overflow: DropNewest, Coalesce: []ngen.MessageType{stateMsgType}}}
+	c.TrySend(stateMsg{testMsg{V: "a"}})
+	c.TrySend(testMsg{V: "1"})
+	c.TrySend(stateMsg{testMsg{V: "b"}})
+	if err := c.TrySend(stateMsg{testMsg{V: "c"}}); err != nil {
+		t.Fatalf("Coalesced send into full queue failed: %s", err)
+	}
+	checkValues(t, queuedValues(c), "state:c", "1")
+}
+
+func TestQueueSend(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	run(ca, context.Background())
+	run(cb, context.Background())
+	defer ca.Close()
+	defer cb.Close()
+
+	for _, v := range []string{"1", "2", "3"} {
+		if err := ca.Send(context.Background(), testMsg{V: v}); err != nil {
+			t.Fatalf("Send failed: %s", err)
+		}
+	}
+	for _, v := range []string{"1", "2", "3"} {
+		if msg := <-cb.Incoming; msg.(*testMsg).V != v {
+			t.Fatalf("Expected %s, got %#v", v, msg)
+		}
+	}
+}
+
+func TestQueueOutgoing(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, b := net.Pipe()
+	var read ngen.Reader
+	read = func(ctx *ngen.Context, mt ngen.MessageType, buffer *ngen.Buffer) ngen.Message {
+		switch mt {
+		case ngen.MessageTypeContext:
+			return ngen.DeserializeContext(&ngen.Context{Read: read}, buffer)
+		case stateMsgType:
+			return &stateMsg{testMsg{V: buffer.ReadString()}}
+		}
+		return testRead(ctx, mt, buffer)
+	}
+	// The handshake holds back the sender until the remote runs.
+	ctx := &ngen.Context{Read: read, FieldVersions: map[ngen.MessageType][]byte{testMsgType: {1}}}
+	ca, cb := newTestClient(a, ctx), newTestClient(b, ctx)
+	ca.Queue.Coalesce = []ngen.MessageType{stateMsgType}
+	errsA := run(ca, context.Background())
+
+	ca.Outgoing <- testMsg{V: "1"}
+	ca.Outgoing <- stateMsg{testMsg{V: "a"}}
+	ca.Outgoing <- stateMsg{testMsg{V: "b"}}
+	for ca.QueueLen() != 2 || len(ca.Outgoing) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ca.Send(context.Background(), testMsg{V: "2"})
+	ca.Outgoing <- nil // Closes once everything before it is written.
+
+	errsB := run(cb, context.Background())
+	vals := []string{}
+	for i := 0; i < 3; i++ {
+		switch m := (<-cb.Incoming).(type) {
+		case *testMsg:
+			vals = append(vals, m.V)
+		case *stateMsg:
+			vals = append(vals, "state:"+m.V)
+		}
+	}
+	checkValues(t, vals, "1", "state:b", "2")
+	checkStopped(t, ca, <-errsA, ErrClosed)
+	checkStopped(t, cb, <-errsB, io.EOF)
+	checkLeaks(t, before)
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Defaults used for unset ReconnectOptions.
+const (
+	DefaultMinDelay    = 100 * time.Millisecond
+	DefaultMaxDelay    = 30 * time.Second
+	DefaultReplayLimit = 256
+)
+
+// ReconnectOptions configure how a client with a Dial func reconnects after losing its connection.
+type ReconnectOptions struct {
+	// MinDelay is the wait after the first failed dial, doubling after each failure up to MaxDelay.
+	// The first dial after a disconnect is immediate.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxAttempts is the number of dials before giving up. Zero retries until the client is stopped.
+	MaxAttempts int
+
+	// Resume keeps sent messages until the remote acknowledges them and replays the rest after reconnecting
+	// to the same session. The server must accept the connections through Sessions.
+	Resume bool
+	// ReplayLimit is the most unacknowledged messages kept for replay, older ones are dropped.
+	ReplayLimit int
+}
+
+// dial connects with c.Dial, retrying with exponential backoff.
+func (c *Client) dial(ctx context.Context) error {
+	delay := c.Reconnect.MinDelay
+	if delay <= 0 {
+		delay = DefaultMinDelay
+	}
+	maxDelay := c.Reconnect.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		dctx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-c.stop:
+				cancel()
+			case <-dctx.Done():
+			}
+		}()
+		conn, err := c.Dial(dctx)
+		cancel()
+		if err == nil {
+			c.mu.Lock()
+			c.Conn = conn
+			c.mu.Unlock()
+			return nil
+		}
+		if c.Reconnect.MaxAttempts > 0 && attempt >= c.Reconnect.MaxAttempts {
+			return err
+		}
+
+		// Jitter keeps clients that lost the same server from reconnecting in lockstep.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		c.Logger.Info("dial failed", "name", c.name(), "attempt", attempt, "retry", wait, "err", err)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-c.stop:
+			t.Stop()
+			return ErrClosed
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
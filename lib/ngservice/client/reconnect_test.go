@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// lossyConn pretends to write everything while drop is set.
+type lossyConn struct {
+	net.Conn
+	drop int32
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.drop) == 1 {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// pipeServer returns a Dial func connecting to server with net.Pipe.
+// The client side of every conn is sent to conns.
+func pipeServer(server func(net.Conn), conns chan<- *lossyConn) func(context.Context) (io.ReadWriteCloser, error) {
+	return func(context.Context) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		go server(b)
+		conn := &lossyConn{Conn: a}
+		conns <- conn
+		return conn, nil
+	}
+}
+
+func expectValues(t *testing.T, incoming chan ngen.Message, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		select {
+		case msg := <-incoming:
+			if msg.(*testMsg).V != v {
+				t.Fatalf("Expected %s, got %#v", v, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", v)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ctx := &ngen.Context{Read: testRead}
+	received := make(chan ngen.Message, 10)
+	server := func(conn net.Conn) {
+		sc := newTestClient(conn, ctx)
+		go sc.Run(context.Background())
+		for msg := range sc.Incoming {
+			received <- msg
+		}
+	}
+	conns := make(chan *lossyConn, 10)
+	c := newTestClient(nil, ctx)
+	c.Dial = pipeServer(server, conns)
+	disconnected := make(chan error, 1)
+	reconnected := make(chan bool, 1)
+	c.OnDisconnected = func(err error) { disconnected <- err }
+	c.OnReconnected = func(resumed bool) { reconnected <- resumed }
+	errs := run(c, context.Background())
+
+	c.Outgoing <- testMsg{V: "1"}
+	expectValues(t, received, "1")
+	select {
+	case <-reconnected:
+		t.Fatalf("First connection reported as reconnected")
+	default:
+	}
+	(<-conns).Close()
+	if err := <-disconnected; err == nil {
+		t.Fatalf("Expected disconnect error")
+	}
+	if resumed := <-reconnected; resumed {
+		t.Fatalf("Reconnect without Resume reported resumed session")
+	}
+	c.Outgoing <- testMsg{V: "2"}
+	expectValues(t, received, "2")
+
+	c.Close()
+	checkStopped(t, c, <-errs, ErrClosed)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	failed := errors.New("dial failed")
+	attempts := 0
+	c := newTestClient(nil, &ngen.Context{Read: testRead})
+	c.Reconnect = ReconnectOptions{MinDelay: time.Millisecond, MaxAttempts: 3}
+	c.Dial = func(context.Context) (io.ReadWriteCloser, error) {
+		attempts++
+		return nil, failed
+	}
+	err := c.Run(context.Background())
+	checkStopped(t, c, err, failed)
+	if attempts != 3 {
+		t.Fatalf("Expected 3 dial attempts, got %d", attempts)
+	}
+}
+
+func TestResume(t *testing.T) {
+	ctx := &ngen.Context{Read: testRead}
+	sessions := &Sessions{}
+	serverClients := make(chan *Client, 10)
+	server := func(conn net.Conn) {
+		sc := newTestClient(conn, ctx)
+		if resumed, err := sessions.Accept(sc); resumed || err != nil {
+			return
+		}
+		serverClients <- sc
+		sc.Run(context.Background())
+	}
+	conns := make(chan *lossyConn, 10)
+	c := newTestClient(nil, ctx)
+	c.Reconnect = ReconnectOptions{Resume: true}
+	c.Dial = pipeServer(server, conns)
+	reconnected := make(chan bool, 1)
+	c.OnReconnected = func(resumed bool) { reconnected <- resumed }
+	errs := run(c, context.Background())
+	defer func() {
+		c.Close()
+		checkStopped(t, c, <-errs, ErrClosed)
+	}()
+
+	sc := <-serverClients
+	conn := <-conns
+	c.Outgoing <- testMsg{V: "1"}
+	sc.Outgoing <- testMsg{V: "a"}
+	expectValues(t, sc.Incoming, "1")
+	expectValues(t, c.Incoming, "a")
+
+	// Lose messages in flight, then the connection.
+	atomic.StoreInt32(&conn.drop, 1)
+	c.Outgoing <- testMsg{V: "2"}
+	c.Outgoing <- testMsg{V: "3"}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		sent := c.sent
+		c.mu.Unlock()
+		if sent == 3 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Messages never written")
+		}
+	}
+	conn.Close()
+
+	if resumed := <-reconnected; !resumed {
+		t.Fatalf("Expected session to resume")
+	}
+	expectValues(t, sc.Incoming, "2", "3")
+	c.Outgoing <- testMsg{V: "4"}
+	sc.Outgoing <- testMsg{V: "b"}
+	expectValues(t, sc.Incoming, "4")
+	expectValues(t, c.Incoming, "b")
+	select {
+	case other := <-serverClients:
+		t.Fatalf("Resumed connection started a new session: %#v", other)
+	default:
+	}
+	sc.Close()
+}
+
+func TestResumeExpired(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	sessions := &Sessions{Linger: 10 * time.Millisecond}
+	c := newTestClient(a, ctx)
+	c.Reconnect = ReconnectOptions{Resume: true, MaxAttempts: 1}
+	c.Dial = func(context.Context) (io.ReadWriteCloser, error) { return nil, io.ErrClosedPipe }
+	errs := run(c, context.Background())
+
+	sc := newTestClient(b, ctx)
+	if resumed, err := sessions.Accept(sc); resumed || err != nil {
+		t.Fatalf("Expected new session, got: %v, %v", resumed, err)
+	}
+	serverErrs := run(sc, context.Background())
+	c.Outgoing <- testMsg{V: "1"}
+	expectValues(t, sc.Incoming, "1")
+
+	a.Close() // client can't come back
+	checkStopped(t, c, <-errs, io.ErrClosedPipe)
+	checkStopped(t, sc, <-serverErrs, ErrSessionExpired)
+}
+
+func TestResumeNotResuming(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	c := newTestClient(a, ctx)
+	errs := run(c, context.Background())
+	c.Outgoing <- testMsg{V: "1"}
+
+	sc := newTestClient(b, ctx)
+	if resumed, err := (&Sessions{}).Accept(sc); resumed || err != ErrNotResuming {
+		t.Fatalf("Expected ErrNotResuming, got: %v, %v", resumed, err)
+	}
+	// The first frame is still read after Accept looked at it.
+	serverErrs := run(sc, context.Background())
+	expectValues(t, sc.Incoming, "1")
+
+	c.Close()
+	checkStopped(t, c, <-errs, ErrClosed)
+	checkStopped(t, sc, <-serverErrs, io.EOF)
+}
+
+func TestResumeWrongToken(t *testing.T) {
+	a, b := net.Pipe()
+	ctx := &ngen.Context{Read: testRead}
+	sessions := &Sessions{}
+	c := newTestClient(a, ctx)
+	c.Reconnect = ReconnectOptions{Resume: true}
+	errs := run(c, context.Background())
+	sc := newTestClient(b, ctx)
+	if resumed, err := sessions.Accept(sc); resumed || err != nil {
+		t.Fatalf("Expected new session, got: %v, %v", resumed, err)
+	}
+	go sc.Run(context.Background())
+	c.Outgoing <- testMsg{V: "1"}
+	expectValues(t, sc.Incoming, "1")
+
+	// Someone who only knows the session id gets a session of their own.
+	c.mu.Lock()
+	frame := ngservice.Resume{Session: c.session, Token: c.token + 1}
+	c.mu.Unlock()
+	x, y := net.Pipe()
+	defer x.Close()
+	go x.Write(ngservice.WriteMessage(nil, frame))
+	other := newTestClient(y, ctx)
+	if resumed, err := sessions.Accept(other); resumed || err != nil {
+		t.Fatalf("Expected new session, got: %v, %v", resumed, err)
+	}
+	other.Close()
+	if other.session == frame.Session {
+		t.Fatalf("Session id was reused for the new session")
+	}
+	c.Outgoing <- testMsg{V: "2"}
+	expectValues(t, sc.Incoming, "2")
+
+	c.Close()
+	checkStopped(t, c, <-errs, ErrClosed)
+	sc.Close()
+}
@@ -0,0 +1,358 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+var (
+	// ErrSessionExpired is the terminal error of a server side client whose remote didn't resume in time.
+	ErrSessionExpired = errors.New("client: session expired")
+	// ErrNotResuming is returned by Sessions.Accept if the remote didn't start with a resume frame.
+	ErrNotResuming = errors.New("client: remote is not resuming sessions")
+
+	errReplaced = errors.New("client: connection replaced by resumed connection")
+)
+
+// DefaultLinger is how long Sessions keeps a disconnected session if Linger isn't set.
+const DefaultLinger = time.Minute
+
+// ackEvery is how many messages are read before acknowledging them to the remote.
+const ackEvery = 32
+
+// controlFrame reports whether frames of this type are part of the connection handling
+// rather than the session, so they are never counted, acknowledged or replayed.
+func controlFrame(mt ngen.MessageType) bool {
+	switch mt {
+	case ngen.MessageTypeContext, ngservice.MessageTypePing, ngservice.MessageTypePong,
+		ngservice.MessageTypeResume, ngservice.MessageTypeResumeAck, ngservice.MessageTypeBaselineAck,
+		ngservice.MessageTypeClose, ngservice.MessageTypeAuthenticate:
+		return true
+	}
+	return false
+}
+
+// resumeFrame is the first frame written on each connection when resuming sessions.
+func (c *Client) resumeFrame() ngservice.Resume {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ngservice.Resume{Session: c.session, Token: c.token, Received: c.received}
+}
+
+// track keeps a written message for replay until the remote acknowledges it.
+func (c *Client) track(m ngen.Message) {
+	if !c.Reconnect.Resume || controlFrame(m.MsgType()) {
+		return
+	}
+	limit := c.Reconnect.ReplayLimit
+	if limit <= 0 {
+		limit = DefaultReplayLimit
+	}
+	c.mu.Lock()
+	c.sent++
+	c.unacked = append(c.unacked, m)
+	var dropped ngen.Message
+	if len(c.unacked) > limit {
+		dropped = c.unacked[0]
+		c.unacked[0] = nil
+		c.unacked = c.unacked[1:]
+	}
+	c.mu.Unlock()
+	if dropped != nil {
+		c.Metrics.MessageDropped(dropped.MsgType())
+	}
+}
+
+// countReceived counts a frame read from the remote and acknowledges every ackEvery frames.
+func (c *Client) countReceived(mt ngen.MessageType) {
+	if !c.Reconnect.Resume || controlFrame(mt) {
+		return
+	}
+	c.mu.Lock()
+	c.received++
+	received := c.received
+	ack := received-c.acked >= ackEvery
+	if ack {
+		c.acked = received
+	}
+	c.mu.Unlock()
+	if ack {
+		c.sendControl(ngservice.ResumeAck{Received: received})
+	}
+}
+
+// ack forgets messages the remote has read. Must be called with mu held.
+func (c *Client) ack(received uint64) {
+	first := c.sent - uint64(len(c.unacked)) // sequence number before unacked[0]
+	if received <= first {
+		return
+	}
+	n := received - first
+	if n > uint64(len(c.unacked)) {
+		n = uint64(len(c.unacked))
+	}
+	for i := uint64(0); i < n; i++ {
+		c.unacked[i] = nil
+	}
+	c.unacked = append(c.unacked[:0], c.unacked[n:]...)
+}
+
+// resume handles the remote's resume frame and reports whether the session continues.
+// A new session forgets everything that was kept for the previous one.
+func (c *Client) resume(r *ngservice.Resume) bool {
+	c.mu.Lock()
+	if c.continues(r) {
+		c.ack(r.Received)
+		c.mu.Unlock()
+		return true
+	}
+	if c.sessions != nil {
+		// Server side of a new session, the remote doesn't know the id yet.
+		c.mu.Unlock()
+		return false
+	}
+	dropped := c.unacked
+	c.session, c.token = r.Session, r.Token
+	c.sent, c.received, c.acked, c.unacked = 0, 0, 0, nil
+	c.mu.Unlock()
+	for _, m := range dropped {
+		c.Metrics.MessageDropped(m.MsgType())
+	}
+	return false
+}
+
+// continues reports whether r resumes the current session. Must be called with mu held.
+func (c *Client) continues(r *ngservice.Resume) bool {
+	return r.Session != 0 && r.Session == c.session && sameToken(r.Token, c.token)
+}
+
+// handleResume processes session frames from the remote.
+// Returns false if msg isn't a session frame.
+func (c *Client) handleResume(msg ngen.Message, resumed chan<- bool) bool {
+	switch m := msg.(type) {
+	case *ngservice.Resume:
+		if !c.Reconnect.Resume {
+			// Tell the remote it can't resume with us instead of leaving it waiting.
+			c.sendControl(ngservice.Resume{})
+			return true
+		}
+		select {
+		case resumed <- c.resume(m):
+		default:
+		}
+	case *ngservice.ResumeAck:
+		c.mu.Lock()
+		c.ack(m.Received)
+		c.mu.Unlock()
+	default:
+		return false
+	}
+	return true
+}
+
+// replay writes every message the remote didn't acknowledge before the last disconnect.
+func (c *Client) replay(ctx *ngen.Context) error {
+	c.mu.Lock()
+	msgs := append([]ngen.Message(nil), c.unacked...)
+	c.mu.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	c.Logger.Debug("replaying messages", "name", c.name(), "count", len(msgs))
+	buf := ngen.GetBuffer(0)
+	defer ngen.PutBuffer(buf)
+	for _, m := range msgs {
+		c.appendFrame(buf, ctx, m)
+	}
+	return c.writeFrames(buf.Bytes())
+}
+
+// interrupt drops the current connection, a client with Dial reconnects afterwards.
+func (c *Client) interrupt(err error) {
+	c.mu.Lock()
+	fail := c.fail
+	c.mu.Unlock()
+	if fail != nil {
+		fail(err)
+	}
+}
+
+// Sessions lets a server hand connections of resuming clients back to the Client of their session,
+// so messages that were lost while disconnected are replayed. Sessions is safe for concurrent use.
+type Sessions struct {
+	// Linger is how long a disconnected session waits for its remote to come back.
+	Linger time.Duration
+
+	mu     sync.Mutex
+	active map[uint64]*session
+}
+
+type session struct {
+	c     *Client
+	conns chan io.ReadWriteCloser
+	token uint64
+}
+
+// Accept reads the resume frame a client with Reconnect.Resume sends first on c.Conn.
+//
+// If it resumes a known session with the session's token the conn is handed to the Client of that session
+// and Accept blocks until that client is done with the conn, returning true. Otherwise c starts a new session
+// and Accept returns false right away, the caller should then Run c as usual.
+// If the remote doesn't resume sessions ErrNotResuming is returned and c.Conn replays what Accept read,
+// so c can still Run without a session.
+func (s *Sessions) Accept(c *Client) (resumed bool, err error) {
+	header := make([]byte, ngservice.HeaderLength)
+	if n, err := io.ReadFull(c.Conn, header); err != nil {
+		c.Conn = newResumeConn(c.Conn, header[:n])
+		return false, err
+	}
+	if ngen.MessageType(ngen.Uint32(header)) != ngservice.MessageTypeResume {
+		c.Conn = newResumeConn(c.Conn, header)
+		return false, ErrNotResuming
+	}
+	l, _ := ngservice.FrameLength(header)
+	hello := make([]byte, l)
+	copy(hello, header)
+	if n, err := io.ReadFull(c.Conn, hello[len(header):]); err != nil {
+		c.Conn = newResumeConn(c.Conn, hello[:len(header)+n])
+		return false, err
+	}
+	// The resume frame is still read by the client of the session.
+	conn := newResumeConn(c.Conn, hello)
+	p, ok := ngservice.ReadPacket(nil, hello)
+	if !ok {
+		c.Conn = conn
+		return false, ErrNotResuming
+	}
+	r := p.NetMsg.(*ngservice.Resume)
+
+	s.mu.Lock()
+	sess := s.active[r.Session]
+	s.mu.Unlock()
+	if r.Session != 0 && sess != nil && sameToken(r.Token, sess.token) {
+		// The old conn may be half open, don't wait for it to time out.
+		sess.c.interrupt(errReplaced)
+		for handed := false; !handed; {
+			select {
+			case sess.conns <- conn:
+				handed = true
+			case stale := <-sess.conns: // Remote reconnected again before the last one was picked up.
+				stale.Close()
+			}
+		}
+		select {
+		case <-conn.released:
+		case <-sess.c.Done():
+			conn.Close()
+		}
+		return true, nil
+	}
+
+	// Ids and tokens are always picked here, the remote can't choose them.
+	sess = &session{c: c, conns: make(chan io.ReadWriteCloser, 1), token: newSessionID()}
+	s.mu.Lock()
+	if s.active == nil {
+		s.active = map[uint64]*session{}
+	}
+	id := newSessionID()
+	for id == 0 || s.active[id] != nil {
+		id = newSessionID()
+	}
+	s.active[id] = sess
+	s.mu.Unlock()
+
+	c.Conn = conn
+	c.session, c.token = id, sess.token
+	c.sessions = s
+	c.Reconnect.Resume = true
+	c.Reconnect.MaxAttempts = 1
+	c.Dial = s.waiter(sess)
+	go func() {
+		<-c.Done()
+		s.mu.Lock()
+		delete(s.active, id)
+		s.mu.Unlock()
+	}()
+	return false, nil
+}
+
+// waiter is the Dial of a server side session, waiting for the remote to resume.
+func (s *Sessions) waiter(sess *session) func(context.Context) (io.ReadWriteCloser, error) {
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		linger := s.Linger
+		if linger <= 0 {
+			linger = DefaultLinger
+		}
+		t := time.NewTimer(linger)
+		defer t.Stop()
+		select {
+		case conn := <-sess.conns:
+			return conn, nil
+		case <-t.C:
+			return nil, ErrSessionExpired
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sameToken compares session tokens in constant time.
+func sameToken(a, b uint64) bool {
+	return subtle.ConstantTimeEq(int32(a>>32), int32(b>>32))&subtle.ConstantTimeEq(int32(a), int32(b)) == 1
+}
+
+func newSessionID() uint64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return binary.LittleEndian.Uint64(b)
+}
+
+func newResumeConn(conn io.ReadWriteCloser, prefix []byte) *resumeConn {
+	return &resumeConn{ReadWriteCloser: conn, prefix: prefix, released: make(chan struct{})}
+}
+
+// resumeConn replays bytes already read by Sessions.Accept and reports when it is closed.
+type resumeConn struct {
+	io.ReadWriteCloser
+	prefix   []byte
+	once     sync.Once
+	released chan struct{}
+}
+
+func (rc *resumeConn) Read(p []byte) (int, error) {
+	if len(rc.prefix) > 0 {
+		n := copy(p, rc.prefix)
+		rc.prefix = rc.prefix[n:]
+		return n, nil
+	}
+	return rc.ReadWriteCloser.Read(p)
+}
+
+func (rc *resumeConn) SetReadDeadline(t time.Time) error {
+	if d, ok := rc.ReadWriteCloser.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (rc *resumeConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := rc.ReadWriteCloser.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (rc *resumeConn) Close() error {
+	err := rc.ReadWriteCloser.Close()
+	rc.once.Do(func() { close(rc.released) })
+	return err
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Handler processes a single message received from a client.
+type Handler func(*Client, ngen.Message)
+
+// Middleware wraps a Handler to add behavior like logging, metrics or auth checks.
+// Middleware can stop a message by not calling the next handler.
+type Middleware func(next Handler) Handler
+
+// Mux dispatches incoming messages to handlers based on their MessageType.
+// Generated Router types embed a Mux to provide typed registration functions.
+//
+// Handlers and middleware should be registered before calling Serve/Dispatch.
+type Mux struct {
+	handlers  map[ngen.MessageType]Handler
+	unhandled Handler
+	mw        []Middleware
+
+	// chains are the handlers wrapped with all middleware.
+	chains         map[ngen.MessageType]Handler
+	unhandledChain Handler
+}
+
+// NewMux creates an empty Mux. Messages without a handler are dropped.
+func NewMux() *Mux {
+	return &Mux{
+		handlers: map[ngen.MessageType]Handler{},
+		chains:   map[ngen.MessageType]Handler{},
+	}
+}
+
+// Handle registers a handler for the given message type, replacing any existing handler.
+func (m *Mux) Handle(mt ngen.MessageType, h Handler) {
+	m.handlers[mt] = h
+	m.chains[mt] = m.wrap(h)
+}
+
+// Unhandled sets the handler called for any message type without a registered handler.
+func (m *Mux) Unhandled(h Handler) {
+	m.unhandled = h
+	m.unhandledChain = m.wrap(h)
+}
+
+// Use appends middleware to the chain. The first middleware added is the outermost.
+func (m *Mux) Use(mw ...Middleware) {
+	m.mw = append(m.mw, mw...)
+	for mt, h := range m.handlers {
+		m.chains[mt] = m.wrap(h)
+	}
+	if m.unhandled != nil {
+		m.unhandledChain = m.wrap(m.unhandled)
+	}
+}
+
+func (m *Mux) wrap(h Handler) Handler {
+	if h == nil {
+		return nil
+	}
+	for i := len(m.mw) - 1; i >= 0; i-- {
+		h = m.mw[i](h)
+	}
+	return h
+}
+
+// Dispatch sends a single message to the matching handler.
+func (m *Mux) Dispatch(c *Client, msg ngen.Message) {
+	if msg == nil {
+		return
+	}
+	if h, ok := m.chains[msg.MsgType()]; ok {
+		h(c, msg)
+		return
+	}
+	if m.unhandledChain != nil {
+		m.unhandledChain(c, msg)
+	}
+}
+
+// Serve dispatches every message read from c.Incoming until it is closed
+// or a nil message is received.
+func (m *Mux) Serve(c *Client) {
+	for msg := range c.Incoming {
+		if msg == nil {
+			return
+		}
+		m.Dispatch(c, msg)
+	}
+}
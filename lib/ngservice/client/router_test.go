@@ -0,0 +1,66 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+const testMsgType ngen.MessageType = 1000
+
+// testMsg is a hand written message used to test the client without generated code.
+type testMsg struct {
+	V string
+}
+
+func (m testMsg) MsgType() ngen.MessageType { return testMsgType }
+
+func (m testMsg) Serialize(ctx *ngen.Context, buffer *ngen.Buffer) error {
+	buffer.WriteString(m.V)
+	return buffer.Err
+}
+
+func (m testMsg) Length(ctx *ngen.Context) int { return 4 + len(m.V) }
+
+func testRead(ctx *ngen.Context, mt ngen.MessageType, buffer *ngen.Buffer) ngen.Message {
+	switch mt {
+	case ngen.MessageTypeContext:
+		return ngen.DeserializeContext(&ngen.Context{Read: testRead}, buffer)
+	case testMsgType:
+		return &testMsg{V: buffer.ReadString()}
+	}
+	return nil
+}
+
+func TestMuxDispatch(t *testing.T) {
+	mux := NewMux()
+	order := []string{}
+	mux.Use(func(next Handler) Handler {
+		return func(c *Client, msg ngen.Message) {
+			order = append(order, "outer")
+			next(c, msg)
+		}
+	}, func(next Handler) Handler {
+		return func(c *Client, msg ngen.Message) {
+			order = append(order, "inner")
+			next(c, msg)
+		}
+	})
+	mux.Handle(testMsgType, func(c *Client, msg ngen.Message) {
+		order = append(order, "handler:"+msg.(*testMsg).V)
+	})
+	unhandled := 0
+	mux.Unhandled(func(c *Client, msg ngen.Message) {
+		unhandled++
+	})
+
+	mux.Dispatch(nil, &testMsg{V: "a"})
+	mux.Dispatch(nil, ngen.Context{})
+
+	if len(order) != 5 || order[0] != "outer" || order[1] != "inner" || order[2] != "handler:a" {
+		t.Fatalf("Unexpected middleware order: %v", order)
+	}
+	if unhandled != 1 {
+		t.Fatalf("Expected one unhandled message, got %d", unhandled)
+	}
+}
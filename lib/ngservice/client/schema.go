@@ -0,0 +1,99 @@
+package client
+
+import (
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// checkSchemas compares the remote's message types with ours once its Context is read,
+// reports the ones that can't be exchanged and keeps them to refuse their messages.
+// The remote's Context is kept for RemoteSettings.
+func (c *Client) checkSchemas(local, remote *ngen.Context) {
+	mismatches := local.CompareSchemas(remote)
+	var refused map[ngen.MessageType]ngen.SchemaMismatch
+	for _, m := range mismatches {
+		if refused == nil {
+			refused = map[ngen.MessageType]ngen.SchemaMismatch{}
+		}
+		refused[m.Type] = m
+		c.Logger.Warn("incompatible message type", "name", c.name(), "type", m.Type, "reason", m.Kind)
+	}
+	c.mu.Lock()
+	c.mismatched, c.remote = refused, remote
+	c.mu.Unlock()
+	if len(mismatches) > 0 && c.OnIncompatible != nil {
+		c.OnIncompatible(mismatches)
+	}
+}
+
+// checkRequired returns the *ngservice.CloseError of a remote without fields required locally.
+func checkRequired(local, remote *ngen.Context) error {
+	if err := local.CheckRequired(remote); err != nil {
+		return &ngservice.CloseError{Reason: ngservice.CloseIncompatible, Message: err.Error(), Err: err}
+	}
+	return nil
+}
+
+// DefaultHandshakeTimeout is how long the Context of the remote is waited for if Client.HandshakeTimeout is zero.
+const DefaultHandshakeTimeout = 5 * time.Second
+
+func (c *Client) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return c.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+// RemoteSettings returns the Context the remote sent in the handshake of the current connection, nil before.
+// Versioned messages from the remote were read with it, their HasX methods take it.
+func (c *Client) RemoteSettings() *ngen.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// canSend reports whether the remote can read messages of type mt.
+func (c *Client) canSend(mt ngen.MessageType) bool {
+	c.mu.Lock()
+	m, ok := c.mismatched[mt]
+	c.mu.Unlock()
+	return !ok || m.Sends()
+}
+
+// canReceive reports whether messages of type mt from the remote can be read.
+func (c *Client) canReceive(mt ngen.MessageType) bool {
+	c.mu.Lock()
+	m, ok := c.mismatched[mt]
+	c.mu.Unlock()
+	return !ok || m.Receives()
+}
+
+// payloadType is the type of the message carried by m. Deltas carry a message of their own type,
+// RPC and Authenticate frames carry one in their body, which is unwrapped the same way.
+func payloadType(m ngen.Message) ngen.MessageType {
+	var body ngen.Message
+	switch w := m.(type) {
+	case ngservice.Delta:
+		return w.Type
+	case *ngservice.Delta:
+		return w.Type
+	case ngservice.Request:
+		body = w.Body
+	case *ngservice.Request:
+		body = w.Body
+	case ngservice.Response:
+		body = w.Body
+	case *ngservice.Response:
+		body = w.Body
+	case ngservice.Authenticate:
+		body = w.Credentials
+	case *ngservice.Authenticate:
+		body = w.Credentials
+	}
+	if body == nil {
+		return m.MsgType()
+	}
+	return payloadType(body)
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+const otherMsgType ngen.MessageType = 1001
+
+// otherMsg is laid out like testMsg with a type of its own.
+type otherMsg struct {
+	testMsg
+}
+
+func (m otherMsg) MsgType() ngen.MessageType { return otherMsgType }
+
+func schemaRead(ctx *ngen.Context, mt ngen.MessageType, buffer *ngen.Buffer) ngen.Message {
+	switch mt {
+	case ngen.MessageTypeContext:
+		return ngen.DeserializeContext(&ngen.Context{Read: schemaRead}, buffer)
+	case otherMsgType:
+		return &otherMsg{testMsg{V: buffer.ReadString()}}
+	}
+	return testRead(ctx, mt, buffer)
+}
+
+func TestSchemaMismatchNotSent(t *testing.T) {
+	a, b := net.Pipe()
+	ca := newTestClient(a, &ngen.Context{Read: schemaRead, Schemas: map[ngen.MessageType]uint32{testMsgType: 1, otherMsgType: 1}})
+	cb := newTestClient(b, &ngen.Context{Read: schemaRead, Schemas: map[ngen.MessageType]uint32{testMsgType: 1, otherMsgType: 2}})
+	reported := make(chan []ngen.SchemaMismatch, 1)
+	ca.OnIncompatible = func(m []ngen.SchemaMismatch) { reported <- m }
+	run(ca, context.Background())
+	run(cb, context.Background())
+	defer ca.Close()
+	defer cb.Close()
+
+	expected := []ngen.SchemaMismatch{{Type: otherMsgType, Kind: ngen.MismatchLayout}}
+	if m := <-reported; !reflect.DeepEqual(m, expected) {
+		t.Fatalf("Expected %v reported, got %v", expected, m)
+	}
+	ca.Outgoing <- otherMsg{testMsg{V: "garbage"}}
+	ca.Outgoing <- ngservice.Request{ID: 1, Body: otherMsg{testMsg{V: "garbage"}}}
+	ca.Outgoing <- testMsg{V: "after"}
+	if msg, ok := (<-cb.Incoming).(*testMsg); !ok || msg.V != "after" {
+		t.Fatalf("Expected only the compatible message, got %#v", msg)
+	}
+}
+
+func TestSchemaMismatchNotRead(t *testing.T) {
+	a, b := net.Pipe()
+	cb := newTestClient(b, &ngen.Context{Read: schemaRead, Schemas: map[ngen.MessageType]uint32{testMsgType: 1, otherMsgType: 1}})
+	run(cb, context.Background())
+	defer cb.Close()
+	go io.Copy(ioutil.Discard, a)
+
+	// A remote that sends anyway.
+	remote := &ngen.Context{Schemas: map[ngen.MessageType]uint32{testMsgType: 1, otherMsgType: 2}}
+	garbage := otherMsg{testMsg{V: "garbage"}}
+	for _, m := range []ngen.Message{remote, garbage, ngservice.Response{ID: 1, Body: garbage}, testMsg{V: "after"}} {
+		if _, err := a.Write(ngservice.WriteMessage(nil, m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := <-cb.Incoming
+	if msg, ok := got.(*testMsg); !ok || msg.V != "after" {
+		t.Fatalf("Expected only the compatible message, got %#v", got)
+	}
+}
+
+func TestRequiredFieldMissing(t *testing.T) {
+	a, b := net.Pipe()
+	ca := newTestClient(a, &ngen.Context{
+		Read:          testRead,
+		FieldVersions: map[ngen.MessageType][]byte{testMsgType: {1, 2}},
+		Required:      map[ngen.MessageType][]byte{testMsgType: {2}},
+	})
+	cb := newTestClient(b, &ngen.Context{Read: testRead, FieldVersions: map[ngen.MessageType][]byte{testMsgType: {1}}})
+	errA, errB := run(ca, context.Background()), run(cb, context.Background())
+
+	err := <-errA
+	if ce, ok := err.(*ngservice.CloseError); !ok || ce.Reason != ngservice.CloseIncompatible || ce.Remote {
+		t.Fatalf("Expected local incompatible close, got %v", err)
+	}
+	err = <-errB
+	if ce, ok := err.(*ngservice.CloseError); !ok || ce.Reason != ngservice.CloseIncompatible || !ce.Remote {
+		t.Fatalf("Expected remote incompatible close, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package ngservice
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// MessageTypeCompressed is the frame type of compressed frames. The content is the type of the
+// original frame followed by its compressed content.
+const MessageTypeCompressed ngen.MessageType = 15
+
+// compressedLen is the size of the original type in front of compressed content.
+const compressedLen = 4
+
+// Codec compresses frame contents. The remote must use a codec with the same name to decompress.
+// Implementations must be safe for concurrent use.
+type Codec interface {
+	// Name identifies the codec in the handshake.
+	Name() string
+	// Compress appends the compressed src to dst. dict, if not nil, presets the compressor.
+	Compress(dst, src, dict []byte) ([]byte, error)
+	// Decompress appends the decompressed src to dst, using the same dict as Compress.
+	Decompress(dst, src, dict []byte) ([]byte, error)
+}
+
+// errFrameTooLarge is returned for compressed frames that decompress to more than a frame can hold.
+var errFrameTooLarge = errors.New("ngservice: decompressed frame too large")
+
+// Flate is a Codec using compress/flate at the best speed level.
+var Flate Codec = &flateCodec{}
+
+type flateCodec struct {
+	mu      sync.Mutex
+	writers map[string]*sync.Pool // by dictionary
+	readers sync.Pool
+}
+
+func (*flateCodec) Name() string { return "flate" }
+
+func (f *flateCodec) writerPool(dict []byte) *sync.Pool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.writers[string(dict)]; ok {
+		return p
+	}
+	if f.writers == nil {
+		f.writers = map[string]*sync.Pool{}
+	}
+	d := append([]byte(nil), dict...)
+	p := &sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriterDict(nil, flate.BestSpeed, d)
+		return w
+	}}
+	f.writers[string(dict)] = p
+	return p
+}
+
+func (f *flateCodec) Compress(dst, src, dict []byte) ([]byte, error) {
+	pool := f.writerPool(dict)
+	w := pool.Get().(*flate.Writer)
+	defer pool.Put(w)
+	out := bytes.NewBuffer(dst)
+	w.Reset(out) // Keeps the dictionary of the pool.
+	if _, err := w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return out.Bytes(), nil
+}
+
+func (f *flateCodec) Decompress(dst, src, dict []byte) ([]byte, error) {
+	r, _ := f.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReaderDict(bytes.NewReader(src), dict)
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), dict); err != nil {
+		return dst, err
+	}
+	defer f.readers.Put(r)
+	out := bytes.NewBuffer(dst)
+	// Nothing past the most a frame can hold, so small frames can't inflate into huge ones.
+	if _, err := io.Copy(out, io.LimitReader(r, 0xFFFF+1)); err != nil {
+		return dst, err
+	}
+	return out.Bytes(), nil
+}
+
+// CodecNames returns the names of codecs for the Context handshake.
+func CodecNames(codecs []Codec) []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// PickCodec returns the first codec named in preferred that is in codecs, or nil if there is none.
+func PickCodec(preferred []string, codecs []Codec) Codec {
+	for _, name := range preferred {
+		for _, c := range codecs {
+			if c.Name() == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// CompressFrame compresses the content of the frame at the start of dst.Buf[start:dst.Loc] in place,
+// if that makes it smaller. scratch is used to hold the compressed content.
+func CompressFrame(dst *ngen.Buffer, start uint32, codec Codec, dict []byte, scratch *ngen.Buffer) error {
+	frame := dst.Buf[start:dst.Loc]
+	out, err := codec.Compress(scratch.Buf[:0], frame[headerLen:], dict)
+	if err != nil {
+		return err
+	}
+	scratch.Buf = out[:cap(out)] // Keep the grown buffer for the pool.
+	l := compressedLen + len(out)
+	if l >= len(frame)-headerLen || l > 0xFFFF {
+		return nil
+	}
+	ngen.PutUint32(frame[headerLen:], ngen.Uint32(frame))
+	ngen.PutUint32(frame, uint32(MessageTypeCompressed))
+	ngen.PutUint16(frame[4:], uint16(l))
+	copy(frame[headerLen+compressedLen:], out)
+	dst.Loc = start + uint32(headerLen+l)
+	return nil
+}
+
+// DecompressFrame appends the frame with decompressed content to dst and returns it.
+func DecompressFrame(dst, frame []byte, codec Codec, dict []byte) ([]byte, error) {
+	h, ok := parseHeader(frame)
+	l := int(h.ContentLength) + headerLen
+	if !ok || !h.Compressed || len(frame) < l || h.ContentLength < compressedLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	start := len(dst)
+	dst = append(dst, frame[:headerLen]...)
+	ngen.PutUint32(dst[start:], uint32(h.MsgType))
+	dst, err := codec.Decompress(dst, frame[headerLen+compressedLen:l], dict)
+	if err != nil {
+		return nil, err
+	}
+	if len(dst)-start-headerLen > 0xFFFF {
+		return nil, errFrameTooLarge
+	}
+	ngen.PutUint16(dst[start+4:], uint16(len(dst)-start-headerLen))
+	return dst, nil
+}
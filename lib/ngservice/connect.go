@@ -0,0 +1,85 @@
+package ngservice
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Message types reserved for the connection handshake of datagram transports.
+const (
+	MessageTypeConnect    ngen.MessageType = 9
+	MessageTypeConnectAck ngen.MessageType = 10
+)
+
+// Connect is sent by a datagram client until the server answers with a ConnectAck.
+// Token identifies the connection attempt, MTU is the largest datagram the client wants to send.
+// Key is the client's public key if it wants the connection encrypted, see the secure package.
+type Connect struct {
+	Token uint64
+	MTU   uint16
+	Key   []byte
+}
+
+// MsgType is to implement the Message interface
+func (c Connect) MsgType() ngen.MessageType {
+	return MessageTypeConnect
+}
+
+// Serialize writes the connect frame to the buffer.
+func (c Connect) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint64(c.Token)
+	buf.WriteUint16(c.MTU)
+	writeKey(buf, c.Key)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (c Connect) Length(_ *ngen.Context) int {
+	return 10 + keyLength(c.Key)
+}
+
+// ConnectAck accepts the connection with the same Token. MTU is the size both sides use.
+// Key is the server's public key if the connection is encrypted.
+type ConnectAck struct {
+	Token uint64
+	MTU   uint16
+	Key   []byte
+}
+
+// MsgType is to implement the Message interface
+func (c ConnectAck) MsgType() ngen.MessageType {
+	return MessageTypeConnectAck
+}
+
+// Serialize writes the connect ack frame to the buffer.
+func (c ConnectAck) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint64(c.Token)
+	buf.WriteUint16(c.MTU)
+	writeKey(buf, c.Key)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (c ConnectAck) Length(_ *ngen.Context) int {
+	return 10 + keyLength(c.Key)
+}
+
+// The key is left out of unencrypted handshakes.
+func writeKey(buf *ngen.Buffer, key []byte) {
+	if len(key) > 0 {
+		buf.WriteByteSlice(key)
+	}
+}
+
+func keyLength(key []byte) int {
+	if len(key) == 0 {
+		return 0
+	}
+	return 4 + len(key)
+}
+
+func readKey(buf *ngen.Buffer) []byte {
+	if buf.Err != nil || int(buf.Loc) >= len(buf.Buf) {
+		return nil
+	}
+	return buf.ReadByteSlice()
+}
@@ -0,0 +1,70 @@
+package ngservice
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Message types reserved for delta compressed messages.
+const (
+	MessageTypeDelta       ngen.MessageType = 11
+	MessageTypeBaselineAck ngen.MessageType = 12
+)
+
+// Delta carries a message as the changes since a baseline the remote acknowledged.
+// Seq numbers the messages of each type from 1, Base is the Seq of the baseline or 0 to send all fields.
+type Delta struct {
+	Type ngen.MessageType
+	Seq  uint32
+	Base uint32
+
+	// Msg and Baseline are the message and its baseline on the sending side.
+	Msg      ngen.DeltaMessage
+	Baseline ngen.Message
+	// Body is the received delta, applied to the baseline by the client.
+	Body []byte
+}
+
+// MsgType is to implement the Message interface
+func (d Delta) MsgType() ngen.MessageType {
+	return MessageTypeDelta
+}
+
+// Serialize writes the delta frame to the buffer.
+func (d Delta) Serialize(ctx *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint32(uint32(d.Type))
+	buf.WriteUint32(d.Seq)
+	buf.WriteUint32(d.Base)
+	if err := d.Msg.SerializeDelta(ctx, d.Baseline, buf); err != nil {
+		return err
+	}
+	return buf.Err
+}
+
+// Length returns length of this message
+func (d Delta) Length(ctx *ngen.Context) int {
+	return 12 + d.Msg.DeltaLength(ctx, d.Baseline)
+}
+
+// BaselineAck tells the sender of deltas which message it can use as baseline.
+// Seq 0 means the baseline of a delta was missing and the next one must contain all fields.
+type BaselineAck struct {
+	Type ngen.MessageType
+	Seq  uint32
+}
+
+// MsgType is to implement the Message interface
+func (a BaselineAck) MsgType() ngen.MessageType {
+	return MessageTypeBaselineAck
+}
+
+// Serialize writes the ack frame to the buffer.
+func (a BaselineAck) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint32(uint32(a.Type))
+	buf.WriteUint32(a.Seq)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (a BaselineAck) Length(_ *ngen.Context) int {
+	return 8
+}
@@ -0,0 +1,53 @@
+package ngservice
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Message types reserved for heartbeat frames.
+const (
+	MessageTypePing ngen.MessageType = 5
+	MessageTypePong ngen.MessageType = 6
+)
+
+// Ping asks the remote to reply with a Pong carrying the same Sent value.
+type Ping struct {
+	Sent int64 // Sender's timestamp in nanoseconds, only meaningful to the sender
+}
+
+// MsgType is to implement the Message interface
+func (p Ping) MsgType() ngen.MessageType {
+	return MessageTypePing
+}
+
+// Serialize writes the ping frame to the buffer.
+func (p Ping) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteInt64(p.Sent)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (p Ping) Length(_ *ngen.Context) int {
+	return 8
+}
+
+// Pong is the reply to a Ping.
+type Pong struct {
+	Sent int64 // Copied from the Ping
+}
+
+// MsgType is to implement the Message interface
+func (p Pong) MsgType() ngen.MessageType {
+	return MessageTypePong
+}
+
+// Serialize writes the pong frame to the buffer.
+func (p Pong) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteInt64(p.Sent)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (p Pong) Length(_ *ngen.Context) int {
+	return 8
+}
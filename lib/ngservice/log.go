@@ -0,0 +1,83 @@
+package ngservice
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// Logger receives diagnostics from ngservice and its clients.
+// Args are alternating key/value pairs. The method set matches *slog.Logger so it can be used directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NopLogger discards everything.
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...interface{}) {}
+func (NopLogger) Info(string, ...interface{})  {}
+func (NopLogger) Warn(string, ...interface{})  {}
+func (NopLogger) Error(string, ...interface{}) {}
+
+// Level is the severity of a log message. Values match slog levels.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// StdLogger writes messages at or above Min to a standard library logger
+// formatted like `INFO msg key=value`.
+type StdLogger struct {
+	Log *log.Logger
+	Min Level
+}
+
+// NewStdLogger creates a Logger printing to l.
+func NewStdLogger(l *log.Logger, min Level) *StdLogger {
+	return &StdLogger{Log: l, Min: min}
+}
+
+func (l *StdLogger) Debug(msg string, args ...interface{}) { l.print(LevelDebug, msg, args) }
+func (l *StdLogger) Info(msg string, args ...interface{})  { l.print(LevelInfo, msg, args) }
+func (l *StdLogger) Warn(msg string, args ...interface{})  { l.print(LevelWarn, msg, args) }
+func (l *StdLogger) Error(msg string, args ...interface{}) { l.print(LevelError, msg, args) }
+
+func (l *StdLogger) print(lvl Level, msg string, args []interface{}) {
+	if lvl < l.Min {
+		return
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(lvl.String())
+	buf.WriteString(" ")
+	buf.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(buf, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(buf, " !BADKEY=%v", args[i])
+		}
+	}
+	l.Log.Print(buf.String())
+}
@@ -0,0 +1,35 @@
+package ngservice
+
+import (
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Metrics is notified about traffic on a connection.
+// Implementations must be safe for concurrent use since every client reports to it.
+// See the ngmetrics package for an implementation that can be exported.
+type Metrics interface {
+	// MessageIn is called for each message read. Bytes includes the frame header.
+	MessageIn(mt ngen.MessageType, bytes int)
+	// MessageOut is called for each message written. Bytes includes the frame header.
+	MessageOut(mt ngen.MessageType, bytes int)
+	// MessageDropped is called when a queued message is discarded without being sent.
+	MessageDropped(mt ngen.MessageType)
+	// DecodeFailure is called when a complete frame could not be decoded.
+	DecodeFailure(mt ngen.MessageType)
+	// Handshake is called once the versioning handshake with the remote is complete.
+	Handshake(latency time.Duration)
+	// QueueDepth reports the number of messages waiting to be sent.
+	QueueDepth(depth int)
+}
+
+// NopMetrics discards all metrics.
+type NopMetrics struct{}
+
+func (NopMetrics) MessageIn(ngen.MessageType, int)  {}
+func (NopMetrics) MessageOut(ngen.MessageType, int) {}
+func (NopMetrics) MessageDropped(ngen.MessageType)  {}
+func (NopMetrics) DecodeFailure(ngen.MessageType)   {}
+func (NopMetrics) Handshake(time.Duration)          {}
+func (NopMetrics) QueueDepth(int)                   {}
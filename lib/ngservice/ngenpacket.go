@@ -6,6 +6,9 @@ import (
 
 const headerLen int = 6
 
+// HeaderLength is the size of the frame header in front of every message.
+const HeaderLength = headerLen
+
 // Packet is a single network message.
 type Packet struct {
 	Header  Header
@@ -20,8 +23,9 @@ func (p *Packet) Len() int {
 
 // Header is the first bytes of a packet
 type Header struct {
-	MsgType       ngen.MessageType // byte 0-3, type
+	MsgType       ngen.MessageType // byte 0-3, type, of the original frame if compressed
 	ContentLength uint16           // byte 4-6, content length
+	Compressed    bool             // frame of type MessageTypeCompressed
 }
 
 // parseHeader will parse the header off a byte array.
@@ -30,23 +34,123 @@ func parseHeader(rawBytes []byte) (mf Header, ok bool) {
 		return
 	}
 	mf.MsgType = ngen.MessageType(ngen.Uint32(rawBytes[0:4]))
+	if mf.MsgType == MessageTypeCompressed {
+		mf.Compressed = true
+		if len(rawBytes) >= headerLen+compressedLen {
+			mf.MsgType = ngen.MessageType(ngen.Uint32(rawBytes[headerLen:]))
+		}
+	}
 	mf.ContentLength = ngen.Uint16(rawBytes[4:6])
 	return mf, true
 }
 
+// FrameHeader parses the header of the first frame in rawBytes.
+// Returns false if rawBytes is shorter than a header.
+func FrameHeader(rawBytes []byte) (Header, bool) {
+	return parseHeader(rawBytes)
+}
+
+// FrameLength returns the length of the first frame in rawBytes, including the header.
+// Returns false if rawBytes does not contain a complete frame.
+func FrameLength(rawBytes []byte) (int, bool) {
+	h, ok := parseHeader(rawBytes)
+	if !ok {
+		return 0, false
+	}
+	l := int(h.ContentLength) + headerLen
+	return l, l <= len(rawBytes)
+}
+
 // ReadPacket takes a context and a byte slice and tries to read a packet from it.
+// Compressed frames are not decoded, see DecompressFrame.
 func ReadPacket(ctx *ngen.Context, rawBytes []byte) (packet Packet, ok bool) {
-	if packet.Header, ok = parseHeader(rawBytes); !ok {
-		return packet, ok
+	if packet.Header, ok = parseHeader(rawBytes); !ok || packet.Header.Compressed {
+		return packet, false
 	}
 
 	if packet.Len() <= len(rawBytes) {
-		packet.NetMsg = ctx.Read(ctx, packet.Header.MsgType, ngen.NewBuffer(rawBytes[headerLen:packet.Len()]))
+		buf := ngen.NewBuffer(rawBytes[headerLen:packet.Len()])
+		packet.NetMsg = readBuiltin(ctx, packet.Header.MsgType, buf)
+		if packet.NetMsg == nil {
+			packet.NetMsg = ctx.Read(ctx, packet.Header.MsgType, buf)
+		}
+		if buf.Err != nil {
+			packet.NetMsg = nil // Ran out of bytes while decoding.
+		}
 	}
 	return packet, packet.NetMsg != nil
 }
 
-// WriteMessage turns a message into byte slice for writing to network
+// readBuiltin decodes frames that are defined by ngservice instead of the generated packages.
+// Returns nil if the message type is not a builtin.
+func readBuiltin(ctx *ngen.Context, mt ngen.MessageType, buf *ngen.Buffer) ngen.Message {
+	switch mt {
+	case MessageTypeRequest:
+		r := &Request{
+			ID:      buf.ReadUint32(),
+			Method:  buf.ReadUint32(),
+			Timeout: buf.ReadUint32(),
+		}
+		r.Body = readBody(ctx, buf)
+		return r
+	case MessageTypeResponse:
+		r := &Response{
+			ID:    buf.ReadUint32(),
+			Error: buf.ReadString(),
+		}
+		r.Body = readBody(ctx, buf)
+		return r
+	case MessageTypeCancel:
+		return &Cancel{ID: buf.ReadUint32()}
+	case MessageTypePing:
+		return &Ping{Sent: buf.ReadInt64()}
+	case MessageTypePong:
+		return &Pong{Sent: buf.ReadInt64()}
+	case MessageTypeResume:
+		return &Resume{Session: buf.ReadUint64(), Token: buf.ReadUint64(), Received: buf.ReadUint64()}
+	case MessageTypeResumeAck:
+		return &ResumeAck{Received: buf.ReadUint64()}
+	case MessageTypeDelta:
+		d := &Delta{
+			Type: ngen.MessageType(buf.ReadUint32()),
+			Seq:  buf.ReadUint32(),
+			Base: buf.ReadUint32(),
+		}
+		if buf.Err == nil {
+			// The frame is reused by the reader, the body is only applied later.
+			d.Body = append([]byte(nil), buf.Buf[buf.Loc:]...)
+			buf.Loc = uint32(len(buf.Buf))
+		}
+		return d
+	case MessageTypeBaselineAck:
+		return &BaselineAck{Type: ngen.MessageType(buf.ReadUint32()), Seq: buf.ReadUint32()}
+	case MessageTypeClose:
+		return &Close{Reason: CloseReason(buf.ReadUint16()), Message: buf.ReadString()}
+	case MessageTypeAuthenticate:
+		return &Authenticate{Credentials: readBody(ctx, buf)}
+	case MessageTypeConnect:
+		return &Connect{Token: buf.ReadUint64(), MTU: buf.ReadUint16(), Key: readKey(buf)}
+	case MessageTypeConnectAck:
+		return &ConnectAck{Token: buf.ReadUint64(), MTU: buf.ReadUint16(), Key: readKey(buf)}
+	}
+	return nil
+}
+
+// WriteMessageTo writes the message with its frame header into dst at dst.Loc, growing dst.Buf if needed.
+// Reusing dst, for example one from ngen.GetBuffer, avoids allocating for each message.
+func WriteMessageTo(dst *ngen.Buffer, ctx *ngen.Context, msg ngen.Message) error {
+	length := msg.Length(ctx)
+	dst.Grow(headerLen + length)
+	dst.WriteUint32(uint32(msg.MsgType()))
+	dst.WriteUint16(uint16(length))
+	if err := msg.Serialize(ctx, dst); err != nil {
+		return err
+	}
+	return dst.Err
+}
+
+// WriteMessage turns a message into byte slice for writing to network.
+// This allocates a new slice for every message, use WriteMessageTo on busy connections.
 func WriteMessage(ctx *ngen.Context, msg ngen.Message) []byte {
 	length := msg.Length(ctx)
 	buf := ngen.NewBuffer(make([]byte, length+headerLen))
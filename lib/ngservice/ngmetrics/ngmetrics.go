@@ -0,0 +1,174 @@
+// Package ngmetrics collects ngservice metrics in memory and exports them
+// through expvar or as Prometheus text format without running any network services.
+package ngmetrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// TypeStats are the counters for a single message type.
+type TypeStats struct {
+	MessagesIn     uint64
+	BytesIn        uint64
+	MessagesOut    uint64
+	BytesOut       uint64
+	Dropped        uint64
+	DecodeFailures uint64
+}
+
+// Snapshot is a copy of all counters at a point in time.
+type Snapshot struct {
+	Types          map[ngen.MessageType]TypeStats
+	Handshakes     uint64
+	HandshakeTotal time.Duration
+	QueueDepth     int
+}
+
+// Counters implements ngservice.Metrics by keeping totals in memory.
+type Counters struct {
+	// TypeName optionally converts a message type into a label value.
+	// Defaults to the numeric message type.
+	TypeName func(ngen.MessageType) string
+
+	mu   sync.Mutex
+	snap Snapshot
+}
+
+// New creates an empty set of counters.
+func New() *Counters {
+	return &Counters{snap: Snapshot{Types: map[ngen.MessageType]TypeStats{}}}
+}
+
+func (c *Counters) update(mt ngen.MessageType, f func(*TypeStats)) {
+	c.mu.Lock()
+	s := c.snap.Types[mt]
+	f(&s)
+	c.snap.Types[mt] = s
+	c.mu.Unlock()
+}
+
+func (c *Counters) MessageIn(mt ngen.MessageType, bytes int) {
+	c.update(mt, func(s *TypeStats) {
+		s.MessagesIn++
+		s.BytesIn += uint64(bytes)
+	})
+}
+
+func (c *Counters) MessageOut(mt ngen.MessageType, bytes int) {
+	c.update(mt, func(s *TypeStats) {
+		s.MessagesOut++
+		s.BytesOut += uint64(bytes)
+	})
+}
+
+func (c *Counters) MessageDropped(mt ngen.MessageType) {
+	c.update(mt, func(s *TypeStats) {
+		s.Dropped++
+	})
+}
+
+func (c *Counters) DecodeFailure(mt ngen.MessageType) {
+	c.update(mt, func(s *TypeStats) {
+		s.DecodeFailures++
+	})
+}
+
+func (c *Counters) Handshake(latency time.Duration) {
+	c.mu.Lock()
+	c.snap.Handshakes++
+	c.snap.HandshakeTotal += latency
+	c.mu.Unlock()
+}
+
+func (c *Counters) QueueDepth(depth int) {
+	c.mu.Lock()
+	c.snap.QueueDepth = depth
+	c.mu.Unlock()
+}
+
+// Snapshot returns a copy of the current counters.
+func (c *Counters) Snapshot() Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.snap
+	s.Types = make(map[ngen.MessageType]TypeStats, len(c.snap.Types))
+	for k, v := range c.snap.Types {
+		s.Types[k] = v
+	}
+	return s
+}
+
+// Publish exposes the counters as an expvar with the given name.
+// Like expvar.Publish this panics if the name is already in use.
+func (c *Counters) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		s := c.Snapshot()
+		types := map[string]TypeStats{}
+		for mt, ts := range s.Types {
+			types[c.typeName(mt)] = ts
+		}
+		return map[string]interface{}{
+			"types":              types,
+			"handshakes":         s.Handshakes,
+			"handshake_seconds":  s.HandshakeTotal.Seconds(),
+			"outgoing_queue_len": s.QueueDepth,
+		}
+	}))
+}
+
+func (c *Counters) typeName(mt ngen.MessageType) string {
+	if c.TypeName != nil {
+		return c.TypeName(mt)
+	}
+	return strconv.FormatUint(uint64(mt), 10)
+}
+
+// WritePrometheus writes the counters in the Prometheus text exposition format.
+func (c *Counters) WritePrometheus(w io.Writer) error {
+	s := c.Snapshot()
+	types := make([]ngen.MessageType, 0, len(s.Types))
+	for mt := range s.Types {
+		types = append(types, mt)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	counters := []struct {
+		name string
+		help string
+		val  func(TypeStats) uint64
+	}{
+		{"netgen_messages_in_total", "Messages read.", func(t TypeStats) uint64 { return t.MessagesIn }},
+		{"netgen_bytes_in_total", "Bytes read including frame headers.", func(t TypeStats) uint64 { return t.BytesIn }},
+		{"netgen_messages_out_total", "Messages written.", func(t TypeStats) uint64 { return t.MessagesOut }},
+		{"netgen_bytes_out_total", "Bytes written including frame headers.", func(t TypeStats) uint64 { return t.BytesOut }},
+		{"netgen_dropped_total", "Queued messages discarded without being sent.", func(t TypeStats) uint64 { return t.Dropped }},
+		{"netgen_decode_failures_total", "Frames that failed to decode.", func(t TypeStats) uint64 { return t.DecodeFailures }},
+	}
+	for _, ct := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", ct.name, ct.help, ct.name); err != nil {
+			return err
+		}
+		for _, mt := range types {
+			if _, err := fmt.Fprintf(w, "%s{type=%q} %d\n", ct.name, c.typeName(mt), ct.val(s.Types[mt])); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, `# HELP netgen_handshake_seconds Time spent on versioning handshakes.
+# TYPE netgen_handshake_seconds summary
+netgen_handshake_seconds_sum %g
+netgen_handshake_seconds_count %d
+# HELP netgen_outgoing_queue_length Messages waiting to be sent at last report.
+# TYPE netgen_outgoing_queue_length gauge
+netgen_outgoing_queue_length %d
+`, s.HandshakeTotal.Seconds(), s.Handshakes, s.QueueDepth)
+	return err
+}
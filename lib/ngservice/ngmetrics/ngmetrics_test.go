@@ -0,0 +1,49 @@
+package ngmetrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	c := New()
+	c.TypeName = func(mt ngen.MessageType) string {
+		if mt == 20 {
+			return "Chat"
+		}
+		return "unknown"
+	}
+	c.MessageIn(20, 10)
+	c.MessageIn(20, 16)
+	c.MessageOut(20, 8)
+	c.DecodeFailure(21)
+	c.Handshake(500 * time.Millisecond)
+	c.QueueDepth(3)
+
+	s := c.Snapshot()
+	if s.Types[20].MessagesIn != 2 || s.Types[20].BytesIn != 26 || s.Types[21].DecodeFailures != 1 {
+		t.Fatalf("Unexpected snapshot: %#v", s)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.WritePrometheus(buf); err != nil {
+		t.Fatalf("Failed to write metrics: %s", err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`netgen_messages_in_total{type="Chat"} 2`,
+		`netgen_bytes_in_total{type="Chat"} 26`,
+		`netgen_bytes_out_total{type="Chat"} 8`,
+		`netgen_decode_failures_total{type="unknown"} 1`,
+		`netgen_handshake_seconds_sum 0.5`,
+		`netgen_outgoing_queue_length 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("Missing %q in output:\n%s", line, out)
+		}
+	}
+}
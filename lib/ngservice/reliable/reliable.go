@@ -0,0 +1,483 @@
+// Package reliable adds acknowledged delivery on top of a datagram connection such as UDP.
+//
+// Every message type is sent with a delivery mode. Unreliable messages are sent once and may be lost,
+// duplicated or reordered. Reliable messages are retransmitted until acknowledged and delivered exactly
+// once in any order. ReliableOrdered messages are also delivered in the order they were written, a lost
+// message holds back later ordered messages but not messages of the other modes.
+//
+// A Conn is meant to be the Conn of a client.Client: the frames written by the client are packed into
+// datagrams by delivery mode, and delivered frames are read back as a stream.
+package reliable
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+)
+
+// Mode is how messages of a type are delivered.
+type Mode byte
+
+const (
+	// ReliableOrdered messages are delivered exactly once in the order they were written. This is the default.
+	ReliableOrdered Mode = iota
+	// Reliable messages are delivered exactly once in any order.
+	Reliable
+	// Unreliable messages are sent once and may be lost, duplicated or arrive out of order.
+	Unreliable
+
+	modeAck // datagram only carries acks
+)
+
+// Overhead is the size of the header in front of the frames in every datagram.
+const Overhead = 17
+
+// MaxDatagram is the default of Options.MaxDatagram, the biggest UDP payload over IPv4.
+const MaxDatagram = 65507
+
+// Defaults used for unset Options.
+const (
+	DefaultMTU         = 1200
+	DefaultResendAfter = 200 * time.Millisecond
+	DefaultMaxResends  = 10
+	DefaultMaxInFlight = 1024
+
+	tick   = 10 * time.Millisecond // how often retransmits and delayed acks are checked
+	minRTO = 20 * time.Millisecond
+)
+
+var (
+	// ErrUnacknowledged is returned once a message was retransmitted MaxResends times without an ack.
+	ErrUnacknowledged = errors.New("reliable: remote stopped acknowledging messages")
+	// ErrPartialFrame is returned by Write if p doesn't end with a complete frame.
+	ErrPartialFrame = errors.New("reliable: write must contain whole frames")
+)
+
+// Options configure a Conn.
+type Options struct {
+	// Modes sets the delivery mode of message types, all others use Default.
+	// Builtin message types (up to ngen.MaxReservedMessageType) are ReliableOrdered unless listed here.
+	Modes   map[ngen.MessageType]Mode
+	Default Mode
+	// MTU is the largest datagram written. Frames are packed into datagrams up to this size,
+	// a frame that doesn't fit is sent in a datagram of its own.
+	MTU int
+	// MaxDatagram is the largest datagram the conn underneath can write, after the overhead it adds itself.
+	// It limits the reliable frames that don't fit in the MTU.
+	MaxDatagram int
+	// ResendAfter is the retransmit timeout used until a round trip time has been measured.
+	ResendAfter time.Duration
+	// MaxResends is how often a datagram is retransmitted before the Conn fails with ErrUnacknowledged.
+	MaxResends int
+	// MaxInFlight is the most unacknowledged reliable datagrams, Write blocks while there are more.
+	MaxInFlight int
+}
+
+// Stats count what happened on a Conn.
+type Stats struct {
+	Sent       uint64        // Datagrams written, including retransmits and acks
+	Resent     uint64        // Datagrams retransmitted
+	Received   uint64        // Datagrams read
+	Duplicates uint64        // Reliable datagrams read more than once
+	RTT        time.Duration // Smoothed round trip time of acknowledged datagrams
+}
+
+// segment is a reliable datagram waiting for an ack.
+type segment struct {
+	mode    Mode
+	seq     uint32
+	order   uint32
+	payload []byte
+	sentAt  time.Time
+	resends int
+}
+
+// Conn provides delivery modes over a datagram conn, where each Write sends one datagram
+// and each Read returns one datagram.
+type Conn struct {
+	conn io.ReadWriteCloser
+	opts Options
+
+	writeMu sync.Mutex // serializes writes to conn
+
+	mu sync.Mutex
+	// Sending side
+	nextSeq   uint32
+	nextOrder uint32
+	inflight  []*segment
+	space     chan struct{}
+	rto       time.Duration
+	// Receiving side
+	recvAck     uint32              // every seq up to this was received
+	recvAbove   map[uint32]struct{} // seqs received after a gap
+	ackPending  bool
+	nextDeliver uint32
+	ordered     map[uint32][]byte // ordered payloads waiting for earlier ones
+	ready       [][]byte
+	readable    chan struct{}
+	stats       Stats
+	err         error
+
+	pending   []byte // rest of the payload given out by Read
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// New starts delivering over conn, which must preserve datagram boundaries.
+func New(conn io.ReadWriteCloser, opts Options) *Conn {
+	if opts.MTU <= 0 {
+		opts.MTU = DefaultMTU
+	}
+	if opts.MaxDatagram <= 0 {
+		opts.MaxDatagram = MaxDatagram
+	}
+	if opts.ResendAfter <= 0 {
+		opts.ResendAfter = DefaultResendAfter
+	}
+	if opts.MaxResends <= 0 {
+		opts.MaxResends = DefaultMaxResends
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = DefaultMaxInFlight
+	}
+	c := &Conn{
+		conn:        conn,
+		opts:        opts,
+		space:       make(chan struct{}, 1),
+		rto:         opts.ResendAfter,
+		recvAbove:   map[uint32]struct{}{},
+		nextDeliver: 1,
+		ordered:     map[uint32][]byte{},
+		readable:    make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.tickLoop()
+	return c
+}
+
+// Mode returns the delivery mode used for a message type.
+func (c *Conn) Mode(mt ngen.MessageType) Mode {
+	if m, ok := c.opts.Modes[mt]; ok {
+		return m
+	}
+	if mt <= ngen.MaxReservedMessageType {
+		return ReliableOrdered
+	}
+	return c.opts.Default
+}
+
+// MaxFrame returns the largest frame of a message type that can be written.
+// Unreliable frames must fit in a single MTU sized datagram, since a lost IP fragment loses all of it.
+// Reliable frames that don't fit are sent in a larger datagram of their own.
+func (c *Conn) MaxFrame(mt ngen.MessageType) int {
+	if c.Mode(mt) == Unreliable {
+		return c.opts.MTU - Overhead
+	}
+	return c.opts.MaxDatagram - Overhead
+}
+
+// Stats returns a copy of the counters of this conn.
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Write sends the frames in p, packing consecutive frames with the same delivery mode into datagrams.
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		start := written
+		mode := Mode(0)
+		for written < len(p) {
+			l, ok := ngservice.FrameLength(p[written:])
+			if !ok {
+				return start, ErrPartialFrame
+			}
+			m := c.Mode(ngen.MessageType(ngen.Uint32(p[written:])))
+			if written > start && (m != mode || Overhead+written+l-start > c.opts.MTU) {
+				break
+			}
+			mode = m
+			written += l
+		}
+		if err := c.send(mode, p[start:written]); err != nil {
+			return start, err
+		}
+	}
+	return written, nil
+}
+
+func (c *Conn) send(mode Mode, payload []byte) error {
+	if mode == Unreliable {
+		return c.writeDatagram(mode, 0, 0, payload)
+	}
+
+	c.mu.Lock()
+	for len(c.inflight) >= c.opts.MaxInFlight && c.err == nil {
+		c.mu.Unlock()
+		select {
+		case <-c.space:
+		case <-c.closed:
+		}
+		c.mu.Lock()
+	}
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.nextSeq++
+	seg := &segment{mode: mode, seq: c.nextSeq, payload: append([]byte(nil), payload...), sentAt: time.Now()}
+	if mode == ReliableOrdered {
+		c.nextOrder++
+		seg.order = c.nextOrder
+	}
+	c.inflight = append(c.inflight, seg)
+	c.mu.Unlock()
+	return c.writeDatagram(mode, seg.seq, seg.order, seg.payload)
+}
+
+// writeDatagram writes a datagram with the latest acks.
+func (c *Conn) writeDatagram(mode Mode, seq, order uint32, payload []byte) error {
+	d := make([]byte, Overhead+len(payload))
+	c.mu.Lock()
+	ack, bits := c.acks()
+	c.ackPending = false
+	c.stats.Sent++
+	c.mu.Unlock()
+
+	d[0] = byte(mode)
+	ngen.PutUint32(d[1:], seq)
+	ngen.PutUint32(d[5:], order)
+	ngen.PutUint32(d[9:], ack)
+	ngen.PutUint32(d[13:], bits)
+	copy(d[Overhead:], payload)
+
+	c.writeMu.Lock()
+	_, err := c.conn.Write(d)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+// acks returns the cumulative ack and a bit for each of the 32 following seqs. Must be called with mu held.
+func (c *Conn) acks() (ack, bits uint32) {
+	for i := uint32(0); i < 32; i++ {
+		if _, ok := c.recvAbove[c.recvAck+1+i]; ok {
+			bits |= 1 << i
+		}
+	}
+	return c.recvAck, bits
+}
+
+func (c *Conn) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.receive(buf[:n])
+	}
+}
+
+func (c *Conn) receive(d []byte) {
+	if len(d) < Overhead {
+		return // Not one of ours.
+	}
+	mode := Mode(d[0])
+	seq := ngen.Uint32(d[1:])
+	order := ngen.Uint32(d[5:])
+	payload := d[Overhead:]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Received++
+	c.acknowledged(ngen.Uint32(d[9:]), ngen.Uint32(d[13:]))
+
+	switch mode {
+	case Unreliable:
+		c.deliver(payload)
+	case Reliable, ReliableOrdered:
+		c.ackPending = true
+		if seq <= c.recvAck {
+			c.stats.Duplicates++
+			return
+		}
+		if _, ok := c.recvAbove[seq]; ok {
+			c.stats.Duplicates++
+			return
+		}
+		c.recvAbove[seq] = struct{}{}
+		for {
+			if _, ok := c.recvAbove[c.recvAck+1]; !ok {
+				break
+			}
+			delete(c.recvAbove, c.recvAck+1)
+			c.recvAck++
+		}
+
+		if mode == Reliable {
+			c.deliver(payload)
+			return
+		}
+		c.ordered[order] = append([]byte(nil), payload...)
+		for p, ok := c.ordered[c.nextDeliver]; ok; p, ok = c.ordered[c.nextDeliver] {
+			delete(c.ordered, c.nextDeliver)
+			c.nextDeliver++
+			c.ready = append(c.ready, p)
+		}
+		signal(c.readable)
+	}
+}
+
+// acknowledged forgets segments the remote received. Must be called with mu held.
+func (c *Conn) acknowledged(ack, bits uint32) {
+	now := time.Now()
+	kept := c.inflight[:0]
+	for _, seg := range c.inflight {
+		d := seg.seq - ack - 1
+		if seg.seq > ack && (d >= 32 || bits&(1<<d) == 0) {
+			kept = append(kept, seg)
+			continue
+		}
+		if seg.resends == 0 {
+			c.sampleRTT(now.Sub(seg.sentAt))
+		}
+	}
+	if len(kept) < len(c.inflight) {
+		for i := len(kept); i < len(c.inflight); i++ {
+			c.inflight[i] = nil
+		}
+		c.inflight = kept
+		signal(c.space)
+	}
+}
+
+// sampleRTT updates the smoothed round trip time and the retransmit timeout. Must be called with mu held.
+func (c *Conn) sampleRTT(rtt time.Duration) {
+	if c.stats.RTT == 0 {
+		c.stats.RTT = rtt
+	} else {
+		c.stats.RTT = (7*c.stats.RTT + rtt) / 8
+	}
+	// Acks can wait for a tick before they are sent.
+	c.rto = 2*c.stats.RTT + tick
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// deliver copies a payload into the read queue. Must be called with mu held.
+func (c *Conn) deliver(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	c.ready = append(c.ready, append([]byte(nil), payload...))
+	signal(c.readable)
+}
+
+func (c *Conn) tickLoop() {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			c.resend(now)
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// resend retransmits expired segments and sends acks that couldn't be sent along with other datagrams.
+func (c *Conn) resend(now time.Time) {
+	c.mu.Lock()
+	var expired []*segment
+	for _, seg := range c.inflight {
+		if now.Sub(seg.sentAt) < c.rto {
+			continue
+		}
+		if seg.resends >= c.opts.MaxResends {
+			c.mu.Unlock()
+			c.fail(ErrUnacknowledged)
+			return
+		}
+		seg.resends++
+		seg.sentAt = now
+		c.stats.Resent++
+		expired = append(expired, seg)
+	}
+	ackOnly := c.ackPending && len(expired) == 0
+	c.mu.Unlock()
+
+	for _, seg := range expired {
+		if c.writeDatagram(seg.mode, seg.seq, seg.order, seg.payload) != nil {
+			return
+		}
+	}
+	if ackOnly {
+		c.writeDatagram(modeAck, 0, 0, nil)
+	}
+}
+
+// Read returns frames that were delivered, in the order they became deliverable.
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		c.mu.Lock()
+		if len(c.ready) > 0 {
+			c.pending = c.ready[0]
+			c.ready[0] = nil
+			c.ready = c.ready[1:]
+			c.mu.Unlock()
+			break
+		}
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-c.readable:
+		case <-c.closed:
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Close closes the underlying conn. Pending reads return io.EOF.
+func (c *Conn) Close() error {
+	c.fail(io.EOF)
+	return nil
+}
+
+// fail stops the conn, only the first error is kept.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,269 @@
+package reliable
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+)
+
+// lossyDatagram is one end of an in memory datagram link that drops, duplicates and reorders datagrams.
+type lossyDatagram struct {
+	peer   *lossyDatagram
+	recv   chan []byte
+	loss   float64
+	mu     *sync.Mutex
+	rng    *rand.Rand
+	once   sync.Once
+	closed chan struct{}
+}
+
+func lossyPair(loss float64) (*lossyDatagram, *lossyDatagram) {
+	mu, rng := &sync.Mutex{}, rand.New(rand.NewSource(1))
+	a := &lossyDatagram{recv: make(chan []byte, 4096), loss: loss, mu: mu, rng: rng, closed: make(chan struct{})}
+	b := &lossyDatagram{recv: make(chan []byte, 4096), loss: loss, mu: mu, rng: rng, closed: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (d *lossyDatagram) Write(p []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	d.mu.Lock()
+	lost, dup := d.rng.Float64() < d.loss, d.rng.Float64() < 0.1
+	delay := time.Duration(d.rng.Intn(3000)) * time.Microsecond
+	d.mu.Unlock()
+	if lost {
+		return len(p), nil
+	}
+	datagram := append([]byte(nil), p...)
+	deliver := func() {
+		select {
+		case d.peer.recv <- datagram:
+		default: // Full queues drop like a real network.
+		}
+	}
+	time.AfterFunc(delay, deliver)
+	if dup {
+		time.AfterFunc(2*delay, deliver)
+	}
+	return len(p), nil
+}
+
+func (d *lossyDatagram) Read(p []byte) (int, error) {
+	select {
+	case datagram := <-d.recv:
+		return copy(p, datagram), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *lossyDatagram) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+const numType ngen.MessageType = 100
+
+// numMsg carries a counter so tests can check order and duplicates.
+type numMsg struct {
+	N uint32
+}
+
+func (m numMsg) MsgType() ngen.MessageType { return numType }
+
+func (m numMsg) Length(*ngen.Context) int { return 4 }
+
+func (m numMsg) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint32(m.N)
+	return nil
+}
+
+func numRead(_ *ngen.Context, mt ngen.MessageType, buf *ngen.Buffer) ngen.Message {
+	if mt != numType {
+		return nil
+	}
+	return &numMsg{N: buf.ReadUint32()}
+}
+
+// exchange writes count numMsg frames to a, a few per Write, and returns the numbers read from b.
+// Reading stops once count numbers arrived or nothing arrived for a while.
+func exchange(t *testing.T, a, b *Conn, count int) []uint32 {
+	t.Helper()
+	go func() {
+		for n := 1; n <= count; n += 3 {
+			var frames []byte
+			for i := n; i < n+3 && i <= count; i++ {
+				frames = append(frames, ngservice.WriteMessage(nil, numMsg{N: uint32(i)})...)
+			}
+			if _, err := a.Write(frames); err != nil {
+				return
+			}
+		}
+	}()
+
+	var got []uint32
+	results := make(chan uint32)
+	go func() {
+		defer close(results)
+		buf := make([]byte, 0, 1024)
+		chunk := make([]byte, 7) // Odd sized reads so frames are split across them.
+		for {
+			n, err := b.Read(chunk)
+			if err != nil {
+				return
+			}
+			buf = append(buf, chunk[:n]...)
+			for {
+				l, ok := ngservice.FrameLength(buf)
+				if !ok {
+					break
+				}
+				p, _ := ngservice.ReadPacket(&ngen.Context{Read: numRead}, buf[:l])
+				results <- p.NetMsg.(*numMsg).N
+				buf = append(buf[:0], buf[l:]...)
+			}
+		}
+	}()
+	for len(got) < count {
+		select {
+		case n := <-results:
+			got = append(got, n)
+		case <-time.After(500 * time.Millisecond):
+			return got
+		}
+	}
+	return got
+}
+
+func TestReliableOrdered(t *testing.T) {
+	da, db := lossyPair(0.3)
+	a, b := New(da, Options{ResendAfter: 20 * time.Millisecond}), New(db, Options{})
+	defer a.Close()
+	defer b.Close()
+
+	got := exchange(t, a, b, 500)
+	if len(got) != 500 {
+		t.Fatalf("Expected 500 messages, got %d", len(got))
+	}
+	for i, n := range got {
+		if n != uint32(i+1) {
+			t.Fatalf("Expected %d at %d, got %d", i+1, i, n)
+		}
+	}
+	if s := a.Stats(); s.Resent == 0 || s.RTT == 0 {
+		t.Fatalf("Expected retransmits and RTT over lossy link, got %+v", s)
+	}
+	if s := b.Stats(); s.Duplicates == 0 {
+		t.Fatalf("Expected duplicates to be suppressed, got %+v", s)
+	}
+}
+
+func TestReliableUnordered(t *testing.T) {
+	da, db := lossyPair(0.3)
+	opts := Options{Modes: map[ngen.MessageType]Mode{numType: Reliable}, ResendAfter: 20 * time.Millisecond}
+	a, b := New(da, opts), New(db, opts)
+	defer a.Close()
+	defer b.Close()
+
+	got := exchange(t, a, b, 500)
+	seen := map[uint32]bool{}
+	for _, n := range got {
+		if seen[n] {
+			t.Fatalf("Received %d twice", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 500 {
+		t.Fatalf("Expected 500 messages, got %d", len(seen))
+	}
+}
+
+func TestUnreliable(t *testing.T) {
+	da, db := lossyPair(0.3)
+	opts := Options{Default: Unreliable}
+	a, b := New(da, opts), New(db, opts)
+	defer a.Close()
+	defer b.Close()
+
+	got := exchange(t, a, b, 300)
+	if len(got) == 0 || len(got) >= 300 {
+		t.Fatalf("Expected some of 300 messages to be lost, got %d", len(got))
+	}
+	if s := a.Stats(); s.Resent != 0 {
+		t.Fatalf("Unreliable messages were retransmitted: %+v", s)
+	}
+}
+
+func TestPacking(t *testing.T) {
+	da, db := lossyPair(0)
+	a, b := New(da, Options{MTU: Overhead + 3*10}), New(db, Options{})
+	defer a.Close()
+	defer b.Close()
+
+	if got := exchange(t, a, b, 30); len(got) != 30 {
+		t.Fatalf("Expected 30 messages, got %d", len(got))
+	}
+	// Three 10 byte frames per Write, but only as many as fit in the MTU.
+	if s := a.Stats(); s.Sent < 10 {
+		t.Fatalf("Expected at least 10 datagrams, got %+v", s)
+	}
+}
+
+func TestUnacknowledged(t *testing.T) {
+	da, db := lossyPair(1)
+	defer db.Close()
+	c := New(da, Options{ResendAfter: 5 * time.Millisecond, MaxResends: 2})
+	if _, err := c.Write(ngservice.WriteMessage(nil, numMsg{N: 1})); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := c.Read(make([]byte, 10)); err != ErrUnacknowledged {
+		t.Fatalf("Expected %v, got %v", ErrUnacknowledged, err)
+	}
+	if _, err := c.Write(ngservice.WriteMessage(nil, numMsg{N: 2})); err != ErrUnacknowledged {
+		t.Fatalf("Expected write to fail with %v, got %v", ErrUnacknowledged, err)
+	}
+}
+
+func TestClientOverLossyLink(t *testing.T) {
+	da, db := lossyPair(0.2)
+	ctx := &ngen.Context{Read: numRead}
+	newClient := func(conn io.ReadWriteCloser) *client.Client {
+		return &client.Client{
+			Conn:     conn,
+			Outgoing: make(chan ngen.Message, 100),
+			Incoming: make(chan ngen.Message, 100),
+			Settings: ctx,
+		}
+	}
+	ca := newClient(New(da, Options{ResendAfter: 20 * time.Millisecond}))
+	cb := newClient(New(db, Options{ResendAfter: 20 * time.Millisecond}))
+	go ca.Run(context.Background())
+	go cb.Run(context.Background())
+	defer ca.Close()
+	defer cb.Close()
+
+	for i := 1; i <= 100; i++ {
+		ca.Outgoing <- numMsg{N: uint32(i)}
+	}
+	for i := 1; i <= 100; i++ {
+		select {
+		case msg := <-cb.Incoming:
+			if n := msg.(*numMsg).N; n != uint32(i) {
+				t.Fatalf("Expected %d, got %d", i, n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %d", i)
+		}
+	}
+}
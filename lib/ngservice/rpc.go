@@ -0,0 +1,112 @@
+package ngservice
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Message types reserved for RPC frames.
+const (
+	MessageTypeRequest  ngen.MessageType = 2
+	MessageTypeResponse ngen.MessageType = 3
+	MessageTypeCancel   ngen.MessageType = 4
+)
+
+// Request is an RPC call frame. Body is the request message of the called method.
+type Request struct {
+	ID      uint32 // Correlates the response with this request
+	Method  uint32 // ID of the method called
+	Timeout uint32 // Milliseconds until the caller gives up, 0 means no deadline
+	Body    ngen.Message
+}
+
+// MsgType is to implement the Message interface
+func (r Request) MsgType() ngen.MessageType {
+	return MessageTypeRequest
+}
+
+// Serialize writes the request frame and body to the buffer.
+func (r Request) Serialize(ctx *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint32(r.ID)
+	buf.WriteUint32(r.Method)
+	buf.WriteUint32(r.Timeout)
+	writeBody(ctx, buf, r.Body)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (r Request) Length(ctx *ngen.Context) int {
+	return 12 + bodyLength(ctx, r.Body)
+}
+
+// Response is the reply to a Request with the same ID.
+// If Error is set the call failed and Body will be nil.
+type Response struct {
+	ID    uint32
+	Error string
+	Body  ngen.Message
+}
+
+// MsgType is to implement the Message interface
+func (r Response) MsgType() ngen.MessageType {
+	return MessageTypeResponse
+}
+
+// Serialize writes the response frame and body to the buffer.
+func (r Response) Serialize(ctx *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint32(r.ID)
+	buf.WriteString(r.Error)
+	writeBody(ctx, buf, r.Body)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (r Response) Length(ctx *ngen.Context) int {
+	return 4 + 4 + len(r.Error) + bodyLength(ctx, r.Body)
+}
+
+// Cancel tells the remote to stop working on the request with the given ID.
+type Cancel struct {
+	ID uint32
+}
+
+// MsgType is to implement the Message interface
+func (c Cancel) MsgType() ngen.MessageType {
+	return MessageTypeCancel
+}
+
+// Serialize writes the cancel frame to the buffer.
+func (c Cancel) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint32(c.ID)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (c Cancel) Length(_ *ngen.Context) int {
+	return 4
+}
+
+// writeBody writes the message type of the body followed by the body itself.
+// A nil body is written as message type 0.
+func writeBody(ctx *ngen.Context, buf *ngen.Buffer, body ngen.Message) {
+	if body == nil {
+		buf.WriteUint32(0)
+		return
+	}
+	buf.WriteUint32(uint32(body.MsgType()))
+	body.Serialize(ctx, buf)
+}
+
+func bodyLength(ctx *ngen.Context, body ngen.Message) int {
+	if body == nil {
+		return 4
+	}
+	return 4 + body.Length(ctx)
+}
+
+func readBody(ctx *ngen.Context, buf *ngen.Buffer) ngen.Message {
+	mt := ngen.MessageType(buf.ReadUint32())
+	if mt == 0 || buf.Err != nil {
+		return nil
+	}
+	return ctx.Read(ctx, mt, buf)
+}
@@ -0,0 +1,234 @@
+// Package rpc implements request/response calls over a client.Client.
+//
+// Services are declared as Go interfaces in a model package:
+//
+//	type EchoService interface {
+//		Echo(ctx context.Context, req *Message) (*Message, error)
+//	}
+//
+// netgen then generates a client stub (NewEchoServiceClient) and a dispatcher
+// (RegisterEchoService) that both run over a Conn.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lologarithm/netgen/lib/ngen"
+	"github.com/lologarithm/netgen/lib/ngservice"
+	"github.com/lologarithm/netgen/lib/ngservice/client"
+)
+
+var (
+	// ErrClosed is returned for calls that were still pending when the Conn closed.
+	ErrClosed = errors.New("rpc: connection closed")
+	// ErrUnexpectedMessage is returned when a request or response body is not the type the method declares.
+	ErrUnexpectedMessage = errors.New("rpc: unexpected message type")
+)
+
+// RemoteError is an error returned by the remote handler of a call.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Handler serves a single method. The context is cancelled when the caller
+// cancels the call or its deadline passes.
+type Handler func(ctx context.Context, req ngen.Message) (ngen.Message, error)
+
+// Conn multiplexes calls in both directions over a single client.
+// Incoming RPC frames must be passed to the Conn using Dispatch or by attaching it to a Mux.
+type Conn struct {
+	c *client.Client
+
+	mu       sync.Mutex
+	nextID   uint32
+	pending  map[uint32]chan *ngservice.Response
+	inflight map[uint32]context.CancelFunc
+	handlers map[uint32]Handler
+	closed   bool
+}
+
+// NewConn creates a Conn sending frames on c.Outgoing.
+func NewConn(c *client.Client) *Conn {
+	return &Conn{
+		c:        c,
+		pending:  map[uint32]chan *ngservice.Response{},
+		inflight: map[uint32]context.CancelFunc{},
+		handlers: map[uint32]Handler{},
+	}
+}
+
+// Register sets the handler for a method id. Generated Register<Service> functions call this.
+func (rc *Conn) Register(method uint32, h Handler) {
+	rc.mu.Lock()
+	rc.handlers[method] = h
+	rc.mu.Unlock()
+}
+
+// Attach registers the Conn as the handler of RPC frames on the mux.
+func (rc *Conn) Attach(m *client.Mux) {
+	h := func(_ *client.Client, msg ngen.Message) {
+		rc.Dispatch(msg)
+	}
+	m.Handle(ngservice.MessageTypeRequest, h)
+	m.Handle(ngservice.MessageTypeResponse, h)
+	m.Handle(ngservice.MessageTypeCancel, h)
+}
+
+// Call sends req to the remote handler of method and waits for the response.
+// The deadline of ctx is sent with the request so the remote can stop early.
+func (rc *Conn) Call(ctx context.Context, method uint32, req ngen.Message) (ngen.Message, error) {
+	wait := make(chan *ngservice.Response, 1)
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return nil, ErrClosed
+	}
+	rc.nextID++
+	id := rc.nextID
+	rc.pending[id] = wait
+	rc.mu.Unlock()
+
+	frame := &ngservice.Request{ID: id, Method: method, Body: req}
+	if dl, ok := ctx.Deadline(); ok {
+		ms := time.Until(dl) / time.Millisecond
+		if ms < 1 {
+			ms = 1
+		}
+		frame.Timeout = uint32(ms)
+	}
+
+	select {
+	case rc.c.Outgoing <- frame:
+	case <-ctx.Done():
+		rc.forget(id)
+		return nil, ctx.Err()
+	case <-rc.c.Done():
+		rc.forget(id)
+		return nil, ErrClosed
+	}
+
+	select {
+	case resp, ok := <-wait:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if resp.Error != "" {
+			return nil, &RemoteError{Message: resp.Error}
+		}
+		return resp.Body, nil
+	case <-rc.c.Done():
+		rc.forget(id)
+		return nil, ErrClosed
+	case <-ctx.Done():
+		rc.forget(id)
+		// Let the remote know it can stop, but don't block if the queue is full.
+		select {
+		case rc.c.Outgoing <- &ngservice.Cancel{ID: id}:
+		default:
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (rc *Conn) forget(id uint32) {
+	rc.mu.Lock()
+	delete(rc.pending, id)
+	rc.mu.Unlock()
+}
+
+// Dispatch handles a single RPC frame. Returns false if msg is not an RPC frame.
+func (rc *Conn) Dispatch(msg ngen.Message) bool {
+	switch m := msg.(type) {
+	case *ngservice.Request:
+		rc.serve(m)
+	case *ngservice.Response:
+		rc.mu.Lock()
+		wait, ok := rc.pending[m.ID]
+		delete(rc.pending, m.ID)
+		rc.mu.Unlock()
+		if ok {
+			wait <- m
+		}
+	case *ngservice.Cancel:
+		rc.mu.Lock()
+		cancel, ok := rc.inflight[m.ID]
+		rc.mu.Unlock()
+		if ok {
+			cancel()
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// serve runs the handler for req in its own goroutine so slow calls do not block the reader.
+func (rc *Conn) serve(req *ngservice.Request) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(req.Timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	rc.mu.Lock()
+	h, ok := rc.handlers[req.Method]
+	if ok {
+		rc.inflight[req.ID] = cancel
+	}
+	rc.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		if !ok {
+			rc.reply(&ngservice.Response{ID: req.ID, Error: "rpc: unknown method"})
+			return
+		}
+
+		resp, err := h(ctx, req.Body)
+		rc.mu.Lock()
+		delete(rc.inflight, req.ID)
+		rc.mu.Unlock()
+		if ctx.Err() != nil {
+			// Caller cancelled or hit its deadline and is no longer waiting.
+			return
+		}
+
+		frame := &ngservice.Response{ID: req.ID, Body: resp}
+		if err != nil {
+			frame.Error = err.Error()
+			frame.Body = nil
+		}
+		rc.reply(frame)
+	}()
+}
+
+func (rc *Conn) reply(resp *ngservice.Response) {
+	select {
+	case rc.c.Outgoing <- resp:
+	case <-rc.c.Done():
+	}
+}
+
+// Close fails all pending calls with ErrClosed and cancels all running handlers.
+func (rc *Conn) Close() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.closed = true
+	for id, wait := range rc.pending {
+		close(wait)
+		delete(rc.pending, id)
+	}
+	for id, cancel := range rc.inflight {
+		cancel()
+		delete(rc.inflight, id)
+	}
+}
@@ -0,0 +1,275 @@
+// Package secure protects the frames of clients on raw transports.
+//
+// Stream transports use TLS, see DialTLS. Datagram transports like ngudp exchange keys during their handshake
+// (see Exchange) and seal every datagram with AES-GCM using Conn.
+package secure
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Overhead is the number of bytes Conn adds to every datagram, the sequence number and the AEAD tag.
+const Overhead = 8 + 16
+
+var (
+	// ErrInvalidKey is returned by Exchange.Keys for a remote public key that isn't a point on the curve.
+	ErrInvalidKey = errors.New("secure: invalid public key")
+	// ErrShortBuffer is returned by Conn.Read if the buffer can't hold the opened datagram.
+	ErrShortBuffer = errors.New("secure: buffer too short for datagram")
+)
+
+// Config enables sealing datagrams.
+type Config struct {
+	// PresharedKey, if set, is mixed into the session keys so only peers that know it can talk.
+	// Without it the key exchange protects against eavesdropping but not against an active man in the middle.
+	PresharedKey []byte
+}
+
+// DialTLS returns a function for client.Client.Dial that connects to addr over TLS.
+// Servers wrap their listener with tls.NewListener.
+func DialTLS(network, addr string, cfg *tls.Config) func(context.Context) (io.ReadWriteCloser, error) {
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var d net.Dialer
+		raw, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conf := cfg.Clone()
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" {
+			host, _, _ := net.SplitHostPort(addr)
+			conf.ServerName = host
+		}
+		conn := tls.Client(raw, conf)
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if err := conn.Handshake(); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// Exchange is an ephemeral P-256 key pair used for one handshake.
+type Exchange struct {
+	priv []byte
+	pub  []byte
+}
+
+// NewExchange generates a key pair.
+func NewExchange() (*Exchange, error) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Exchange{priv: priv, pub: elliptic.Marshal(elliptic.P256(), x, y)}, nil
+}
+
+// Public returns the public key to send to the remote.
+func (e *Exchange) Public() []byte {
+	return e.pub
+}
+
+// Keys derives the session keys from the remote's public key.
+// initiator is true on the side that started the handshake, the other side must pass false.
+func (e *Exchange) Keys(remote []byte, cfg *Config, initiator bool) (*Keys, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), remote)
+	if x == nil {
+		return nil, ErrInvalidKey
+	}
+	sx, _ := elliptic.P256().ScalarMult(x, y, e.priv)
+	shared := make([]byte, 32)
+	b := sx.Bytes()
+	copy(shared[len(shared)-len(b):], b)
+
+	var psk []byte
+	if cfg != nil {
+		psk = cfg.PresharedKey
+	}
+	first, second := e.pub, remote
+	if !initiator {
+		first, second = remote, e.pub
+	}
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(shared)
+	mac.Write(first)
+	mac.Write(second)
+	secret := mac.Sum(nil)
+
+	initKey, err := derive(secret, "netgen initiator")
+	if err != nil {
+		return nil, err
+	}
+	respKey, err := derive(secret, "netgen responder")
+	if err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &Keys{send: initKey, recv: respKey}, nil
+	}
+	return &Keys{send: respKey, recv: initKey}, nil
+}
+
+// derive makes the AES-256-GCM cipher of one direction.
+func derive(secret []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Keys are the ciphers of a session, one per direction.
+type Keys struct {
+	send, recv cipher.AEAD
+}
+
+// Conn seals every Write into one datagram of conn and opens datagrams on Read.
+// Datagrams that fail to open or were already read are dropped, like a lossy network would.
+// Close seals an empty datagram, on which the remote's Read returns io.EOF, so only the remote can
+// end the connection.
+type Conn struct {
+	conn io.ReadWriteCloser
+	keys *Keys
+
+	wmu    sync.Mutex
+	seq    uint64
+	wbuf   []byte
+	closed bool
+
+	rbuf   []byte
+	replay window
+}
+
+// NewConn seals the datagrams of conn with keys.
+func NewConn(conn io.ReadWriteCloser, keys *Keys) *Conn {
+	return &Conn{conn: conn, keys: keys}
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.LittleEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+// Write seals p into a single datagram.
+func (c *Conn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil // Empty datagrams close the connection.
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.write(p)
+}
+
+func (c *Conn) write(p []byte) (int, error) {
+	c.seq++
+	if cap(c.wbuf) < 8 {
+		c.wbuf = make([]byte, 8, 8+len(p)+16)
+	}
+	d := c.wbuf[:8]
+	binary.LittleEndian.PutUint64(d, c.seq)
+	d = c.keys.send.Seal(d, nonce(c.seq), p, d[:8])
+	c.wbuf = d
+	if _, err := c.conn.Write(d); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read opens the next authentic datagram into p.
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, 65536)
+	}
+	for {
+		n, err := c.conn.Read(c.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		if n < Overhead {
+			continue
+		}
+		if n-Overhead > len(p) {
+			return 0, ErrShortBuffer
+		}
+		seq := binary.LittleEndian.Uint64(c.rbuf)
+		if c.replay.seen(seq) {
+			continue
+		}
+		out, err := c.keys.recv.Open(p[:0], nonce(seq), c.rbuf[8:n], c.rbuf[:8])
+		if err != nil {
+			continue // Forged or corrupted.
+		}
+		c.replay.add(seq)
+		if len(out) == 0 {
+			return 0, io.EOF // The remote closed.
+		}
+		return len(out), nil
+	}
+}
+
+// Close tells the remote the connection is gone and closes the underlying conn.
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.write(nil)
+	}
+	c.wmu.Unlock()
+	return c.conn.Close()
+}
+
+// window remembers the last 64 sequence numbers below the highest one read.
+type window struct {
+	top  uint64
+	bits uint64 // bit i is top-1-i
+}
+
+func (w *window) seen(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return true // Never sent.
+	case seq > w.top:
+		return false
+	case seq == w.top:
+		return true
+	case w.top-seq > 64:
+		return true // Too old to tell.
+	}
+	return w.bits&(1<<(w.top-seq-1)) != 0
+}
+
+func (w *window) add(seq uint64) {
+	if seq <= w.top {
+		w.bits |= 1 << (w.top - seq - 1)
+		return
+	}
+	shift := seq - w.top
+	if shift > 64 {
+		w.bits = 0
+	} else {
+		w.bits = w.bits<<shift | 1<<(shift-1)
+	}
+	w.top = seq
+}
@@ -0,0 +1,203 @@
+package secure
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// datagrams is one end of an in memory datagram link. Written datagrams can be tampered with before delivery.
+type datagrams struct {
+	recv, send chan []byte
+}
+
+func datagramPair() (*datagrams, *datagrams) {
+	ab, ba := make(chan []byte, 16), make(chan []byte, 16)
+	return &datagrams{recv: ba, send: ab}, &datagrams{recv: ab, send: ba}
+}
+
+func (d *datagrams) Write(p []byte) (int, error) {
+	d.send <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *datagrams) Read(p []byte) (int, error) {
+	select {
+	case datagram := <-d.recv:
+		return copy(p, datagram), nil
+	case <-time.After(100 * time.Millisecond):
+		return 0, io.EOF
+	}
+}
+
+func (d *datagrams) Close() error { return nil }
+
+// keyPair runs the key exchange for both sides.
+func keyPair(t *testing.T, initiator, responder *Config) (*Keys, *Keys) {
+	t.Helper()
+	a, err := NewExchange()
+	if err != nil {
+		t.Fatalf("NewExchange failed: %v", err)
+	}
+	b, err := NewExchange()
+	if err != nil {
+		t.Fatalf("NewExchange failed: %v", err)
+	}
+	ka, err := a.Keys(b.Public(), initiator, true)
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	kb, err := b.Keys(a.Public(), responder, false)
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	return ka, kb
+}
+
+func TestConn(t *testing.T) {
+	da, db := datagramPair()
+	cfg := &Config{PresharedKey: []byte("local test key")}
+	ka, kb := keyPair(t, cfg, cfg)
+	a, b := NewConn(da, ka), NewConn(db, kb)
+
+	buf := make([]byte, 100)
+	for _, msg := range []string{"hello", "world"} {
+		a.Write([]byte(msg))
+		sealed := <-db.recv
+		if bytes.Contains(sealed, []byte(msg)) || len(sealed) != len(msg)+Overhead {
+			t.Fatalf("Expected %q sealed with %d bytes overhead, got %q", msg, Overhead, sealed)
+		}
+
+		// A tampered copy and a replay are dropped, the original is read once.
+		tampered := append([]byte(nil), sealed...)
+		tampered[len(tampered)-1] ^= 1
+		db.recv <- tampered
+		db.recv <- sealed
+		db.recv <- sealed
+		if n, err := b.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatalf("Expected %q, got %q, %v", msg, buf[:n], err)
+		}
+		if n, err := b.Read(buf); err != io.EOF {
+			t.Fatalf("Expected replay to be dropped, got %q, %v", buf[:n], err)
+		}
+	}
+
+	// The other direction uses its own key.
+	b.Write([]byte("back"))
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "back" {
+		t.Fatalf("Expected back, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestPresharedKeyMismatch(t *testing.T) {
+	da, db := datagramPair()
+	ka, kb := keyPair(t, &Config{PresharedKey: []byte("one")}, &Config{PresharedKey: []byte("two")})
+	a, b := NewConn(da, ka), NewConn(db, kb)
+	a.Write([]byte("hello"))
+	if n, err := b.Read(make([]byte, 100)); err != io.EOF {
+		t.Fatalf("Expected datagram to be dropped, got %d bytes, %v", n, err)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	e, err := NewExchange()
+	if err != nil {
+		t.Fatalf("NewExchange failed: %v", err)
+	}
+	if _, err := e.Keys([]byte{4, 1, 2, 3}, nil, true); err != ErrInvalidKey {
+		t.Fatalf("Expected %v, got %v", ErrInvalidKey, err)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	var w window
+	for _, seq := range []uint64{1, 3, 2, 70, 10} {
+		if w.seen(seq) {
+			t.Fatalf("%d is new", seq)
+		}
+		w.add(seq)
+		if !w.seen(seq) {
+			t.Fatalf("%d was added", seq)
+		}
+	}
+	if !w.seen(5) {
+		t.Fatalf("Expected sequence too far behind to count as seen")
+	}
+	if w.seen(69) || w.seen(71) {
+		t.Fatalf("Expected 69 and 71 to be new")
+	}
+}
+
+// selfSigned makes a certificate for 127.0.0.1.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netgen test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, pool := selfSigned(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := DialTLS("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})(ctx)
+	if err != nil {
+		t.Fatalf("DialTLS failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("echo"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "echo" {
+		t.Fatalf("Expected echo, got %q, %v", buf, err)
+	}
+
+	// Certificates that don't verify fail the dial.
+	if _, err := DialTLS("tcp", l.Addr().String(), &tls.Config{})(ctx); err == nil {
+		t.Fatalf("Expected unknown certificate to fail")
+	}
+}
@@ -0,0 +1,59 @@
+package ngservice
+
+import (
+	"github.com/lologarithm/netgen/lib/ngen"
+)
+
+// Message types reserved for session resumption frames.
+const (
+	MessageTypeResume    ngen.MessageType = 7
+	MessageTypeResumeAck ngen.MessageType = 8
+)
+
+// Resume is the first frame on every connection of a client resuming sessions.
+// Session is 0 when starting a new session or answering a client that doesn't resume.
+// Token is the secret the server gave the session, only a remote knowing it can resume the session.
+type Resume struct {
+	Session  uint64
+	Token    uint64
+	Received uint64 // Messages read from the remote in this session
+}
+
+// MsgType is to implement the Message interface
+func (r Resume) MsgType() ngen.MessageType {
+	return MessageTypeResume
+}
+
+// Serialize writes the resume frame to the buffer.
+func (r Resume) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint64(r.Session)
+	buf.WriteUint64(r.Token)
+	buf.WriteUint64(r.Received)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (r Resume) Length(_ *ngen.Context) int {
+	return 24
+}
+
+// ResumeAck tells the remote how many messages were read so it can stop keeping them for replay.
+type ResumeAck struct {
+	Received uint64
+}
+
+// MsgType is to implement the Message interface
+func (r ResumeAck) MsgType() ngen.MessageType {
+	return MessageTypeResumeAck
+}
+
+// Serialize writes the ack frame to the buffer.
+func (r ResumeAck) Serialize(_ *ngen.Context, buf *ngen.Buffer) error {
+	buf.WriteUint64(r.Received)
+	return buf.Err
+}
+
+// Length returns length of this message
+func (r ResumeAck) Length(_ *ngen.Context) int {
+	return 8
+}